@@ -2,19 +2,45 @@ package main
 
 import (
 	ClientAPI "central/internal/client"
+	"central/internal/gateway"
 	"central/internal/matchmaking"
+	"central/internal/operator"
 	ServiceAPI "central/internal/service"
+	"central/internal/webhook"
+	"log"
 
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
+	// Operator routes stay disabled unless a token is configured
+	operatorToken, err := operator.ReadToken("operator_token.txt")
+	if err != nil {
+		log.Printf("Operator routes disabled: %v", err)
+	}
+
 	// Initialize stores and API
 	clientStore := ClientAPI.GetInMemoryStore()
 	clientAPI := ClientAPI.NewClientAPI(clientStore)
+	clientAPI.SetOperatorToken(operatorToken)
 	serviceStore := ServiceAPI.GetInMemoryStore()
 	serviceAPI := ServiceAPI.NewServiceAPI(serviceStore)
 	matchmakingService := matchmaking.NewMatchmakingServer(clientStore, serviceStore)
+	// Browser clients reach Central over a WebSocket, the gateway delivers their requests
+	wsGateway := gateway.NewGateway(clientStore, serviceStore, matchmakingService)
+	matchmakingService.SetClientDialer(wsGateway)
+	// Web front ends served from elsewhere are listed one origin per line
+	if origins, err := gateway.ReadAllowedOrigins("allowed_origins.txt"); err != nil {
+		log.Printf("Browser clients only accepted from Central's own origin: %v", err)
+	} else {
+		wsGateway.SetAllowedOrigins(origins)
+	}
+	// Operators register webhooks to hear about matches and room changes
+	webhookStore := webhook.GetInMemoryStore()
+	webhookAPI := webhook.NewWebhookAPI(webhookStore, operatorToken)
+	dispatcher := webhook.NewDispatcher(webhookStore)
+	matchmakingService.SetEventPublisher(dispatcher)
+	clientAPI.SetEventPublisher(dispatcher)
 
 	// Create Gin router
 	router := gin.Default()
@@ -22,8 +48,11 @@ func main() {
 	// Register Client API
 	clientAPI.RegisterRoutes(router)
 	serviceAPI.RegisterRoutes(router)
+	wsGateway.RegisterRoutes(router)
+	webhookAPI.RegisterRoutes(router)
 
 	// Start the HTTP server
+	go dispatcher.Start()
 	go matchmakingService.Start(":8081")
 	router.Run(":8080")
 }
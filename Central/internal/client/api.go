@@ -1,19 +1,40 @@
 package clientapi
 
 import (
+	"central/internal/operator"
+	"central/internal/webhook"
 	"fmt"
 	"net/http"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 // ClientAPI represents the REST API for the Client service.
 type ClientAPI struct {
-	store Store
+	store         Store
+	events        webhook.Publisher
+	operatorToken string // Required by the routes for operators and chat servers, see SetOperatorToken
 }
 
 func NewClientAPI(store Store) *ClientAPI {
-	return &ClientAPI{store: store}
+	return &ClientAPI{store: store, events: webhook.Discard{}}
+}
+
+// SetEventPublisher shares the rooms closed through the API, e.g. with the registered webhooks
+func (api *ClientAPI) SetEventPublisher(events webhook.Publisher) {
+	api.events = events
+}
+
+/*
+SetOperatorToken sets the token closing rooms and the offender reports require, chat
+servers send it too. Without one those routes are refused. It must be set before the
+routes are registered.
+*/
+func (api *ClientAPI) SetOperatorToken(token string) {
+	api.operatorToken = token
 }
 
 // RegisterRoutes sets up client-related routes.
@@ -25,12 +46,29 @@ func (api *ClientAPI) RegisterRoutes(router *gin.Engine) {
 		group.GET("/:username", api.GetClientByUsername)
 		group.DELETE("", api.DeleteClient)
 		group.PUT("/delays", api.UpdateDelayList)
+		group.GET("/:username/delays", api.GetDelayList)
+		group.POST("/offenders", operator.Authenticate(api.operatorToken), api.ReportOffender)
+		group.GET("/offenders", operator.Authenticate(api.operatorToken), api.GetOffenders)
+		group.POST("/directory", api.Advertise)
+		group.GET("/directory", api.GetDirectory)
+		group.GET("/:username/contacts", api.GetContacts)
+		group.POST("/:username/contacts", api.AddContact)
+		group.DELETE("/:username/contacts/:contact", api.RemoveContact)
+		group.DELETE("/:username/rooms/:roomId", api.LeaveRoom)
+	}
+
+	rooms := router.Group("/rooms")
+	{
+		rooms.GET("/:roomId", api.GetRoom)
+		rooms.DELETE("/:roomId", operator.Authenticate(api.operatorToken), api.CloseRoom)
 	}
 }
 
 // ClientRegistrationRequest represents the payload for client registration.
 type ClientRegistrationRequest struct {
-	Username string `json:"username" binding:"required"`
+	Username    string `json:"username" binding:"required"`
+	RequestPort int    `json:"requestPort"` // Where the client listens for chat requests, 3001 if unset
+	ReroutePort int    `json:"reroutePort"` // Where the client listens for reroutes, 3003 if unset
 }
 
 // RegisterClient handles client registration (POST).
@@ -40,28 +78,60 @@ func (api *ClientAPI) RegisterClient(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
 		return
 	}
+	if req.RequestPort < 0 || req.RequestPort > 65535 || req.ReroutePort < 0 || req.ReroutePort > 65535 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid port"})
+		return
+	}
 
+	var ports ClientPorts
+	if req.RequestPort != 0 {
+		ports.Request = strconv.Itoa(req.RequestPort)
+	}
+	if req.ReroutePort != 0 {
+		ports.Reroute = strconv.Itoa(req.ReroutePort)
+	}
 	clientIP := c.ClientIP() // Gin automatically extracts the client IP
-	if err := api.store.Create(clientIP, req.Username); err != nil {
+	if err := api.store.Create(clientIP, req.Username, ports); err != nil {
 		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
 		return
 	}
+	ports, _ = api.store.GetPorts(req.Username)
 
 	fmt.Println("REGISTERED CLIENT WITH IP: ", clientIP)
 
-	c.JSON(http.StatusCreated, gin.H{"message": "Client registered", "ip": clientIP, "username": req.Username})
+	c.JSON(http.StatusCreated, gin.H{"message": "Client registered", "ip": clientIP, "username": req.Username, "ports": ports})
+}
+
+/*
+identify finds the user making the request. Several clients can share an IP, they name
+themselves with the username query parameter, which must be registered from that IP.
+*/
+func (api *ClientAPI) identify(c *gin.Context, username string) (string, error) {
+	clientIP := c.ClientIP()
+	if username == "" {
+		return api.store.Read(clientIP)
+	}
+
+	ip, err := api.store.ReadByUsername(username)
+	if err != nil {
+		return "", err
+	}
+	if ip != clientIP {
+		return "", fmt.Errorf("%s is not registered from IP %s", username, clientIP)
+	}
+	return username, nil
 }
 
 // GetClient handles retrieving a client by IP (GET).
 func (api *ClientAPI) GetClient(c *gin.Context) {
-	clientIP := c.ClientIP()
-	username, err := api.store.Read(clientIP)
+	username, err := api.identify(c, c.Query("username"))
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
+	ports, _ := api.store.GetPorts(username)
 
-	c.JSON(http.StatusOK, gin.H{"ip": clientIP, "username": username})
+	c.JSON(http.StatusOK, gin.H{"ip": c.ClientIP(), "username": username, "ports": ports})
 }
 
 func (api *ClientAPI) GetClientByUsername(c *gin.Context) {
@@ -72,26 +142,45 @@ func (api *ClientAPI) GetClientByUsername(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
+	ports, _ := api.store.GetPorts(username)
 
-	c.JSON(http.StatusOK, gin.H{"ip": clientIP, "username": username})
+	c.JSON(http.StatusOK, gin.H{"ip": clientIP, "username": username, "ports": ports})
 }
 
-// DeleteClient handles deleting a client by IP (DELETE).
+// DeleteClient handles deleting a client by IP or username (DELETE), closing the rooms they were in.
 func (api *ClientAPI) DeleteClient(c *gin.Context) {
-	clientIP := c.ClientIP()
+	username, err := api.identify(c, c.Query("username"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
 
-	if err := api.store.Delete(clientIP); err != nil {
+	if err := api.store.Delete(username); err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Client deleted", "ip": clientIP})
+	for {
+		roomId, err := api.store.RemoveChatInstancesForUser(username)
+		if err != nil {
+			break
+		}
+		api.events.Publish(webhook.EventRoomClosed, webhook.RoomEvent{RoomId: roomId, Reason: username + " left"})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Client deleted", "ip": c.ClientIP(), "username": username})
 }
 
+/*
+UpdateDelayList stores the latencies a client measured to the chat servers. "delays" has
+the RTT of each server, "stats" optionally the jitter and loss too, which then take
+precedence.
+*/
 func (api *ClientAPI) UpdateDelayList(c *gin.Context) {
 	type UpdateDelayRequest struct {
-		Username string             `json:"username" binding:"required"`
-		Delays   map[string]float32 `json:"delays" binding:"required"`
+		Username string                  `json:"username" binding:"required"`
+		Delays   map[string]float32      `json:"delays" binding:"required"`
+		Stats    map[string]LatencyStats `json:"stats"`
 	}
 
 	// Parse the JSON payload
@@ -100,11 +189,22 @@ func (api *ClientAPI) UpdateDelayList(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format", "details": err.Error()})
 		return
 	}
+	for server, stats := range req.Stats {
+		if stats.RTT < 0 || stats.Jitter < 0 || stats.Loss < 0 || stats.Loss > 1 || stats.Uplink < 0 || stats.Downlink < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid latency stats", "server": server})
+			return
+		}
+	}
 
 	fmt.Println("Recieved ping list: ")
 	fmt.Println(req.Delays)
 	// Call the store method to update the delay list
-	err := api.store.UpdateDelayList(req.Username, req.Delays)
+	var err error
+	if req.Stats != nil {
+		err = api.store.UpdateLatencies(req.Username, req.Stats)
+	} else {
+		err = api.store.UpdateDelayList(req.Username, req.Delays)
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update delay list", "details": err.Error()})
 		return
@@ -113,3 +213,270 @@ func (api *ClientAPI) UpdateDelayList(c *gin.Context) {
 	// Respond with success
 	c.JSON(http.StatusOK, gin.H{"message": "Delay list updated successfully"})
 }
+
+// GetDelayList returns what a client measured to each chat server, with the cost server selection uses
+func (api *ClientAPI) GetDelayList(c *gin.Context) {
+	username := c.Param("username")
+	latencies, err := api.store.GetLatencies(username)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	servers := gin.H{}
+	for server, stats := range latencies {
+		servers[server] = gin.H{
+			"rtt":      stats.RTT,
+			"jitter":   stats.Jitter,
+			"loss":     stats.Loss,
+			"uplink":   stats.Uplink,
+			"downlink": stats.Downlink,
+			"samples":  stats.Samples,
+			"down":     stats.Down,
+			"cost":     stats.Cost(),
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"username": username, "servers": servers})
+}
+
+/*
+GetRoom tells a chat server where the members of a room are connected, so it can relay to
+its peers. Clients read the minimax score of the home server from it, to tell why the
+room was placed there. Only the room's members see it, naming themselves like for the
+other routes, and chat servers with the operator token.
+*/
+func (api *ClientAPI) GetRoom(c *gin.Context) {
+	roomId := c.Param("roomId")
+
+	instance, err := api.store.GetChatInstance(roomId)
+	if !operator.Valid(c, api.operatorToken) {
+		username, identifyErr := api.identify(c, c.Query("username"))
+		if identifyErr != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the members of a room can look it up"})
+			return
+		}
+		// Other users can't tell the room exists
+		if err == nil && !slices.Contains(instance.Users, username) {
+			err = fmt.Errorf("%s is not in room %s", username, roomId)
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"roomId":  roomId,
+		"home":    instance.ChatServer,
+		"members": instance.Members,
+		"score":   instance.Score,
+		"placed":  instance.Placed,
+		"self":    c.ClientIP(),
+	})
+}
+
+// CloseRoom forgets a room, its members are no longer rerouted (DELETE).
+func (api *ClientAPI) CloseRoom(c *gin.Context) {
+	roomId := c.Param("roomId")
+
+	instance, err := api.store.GetChatInstance(roomId)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := api.store.RemoveChatInstance(roomId); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	api.events.Publish(webhook.EventRoomClosed, webhook.RoomEvent{
+		RoomId:  roomId,
+		Users:   instance.Users,
+		Home:    instance.ChatServer,
+		Members: instance.Members,
+		Reason:  "closed through the API",
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "Room closed", "roomId": roomId})
+}
+
+/*
+LeaveRoom closes a room one of its members left (DELETE). Rooms are between two users, so
+the room is over for both, and Central stops placing and rerouting it.
+*/
+func (api *ClientAPI) LeaveRoom(c *gin.Context) {
+	username, err := api.identify(c, c.Param("username"))
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only a registered client can leave its rooms"})
+		return
+	}
+	roomId := c.Param("roomId")
+
+	instance, err := api.store.GetChatInstance(roomId)
+	if err != nil || !slices.Contains(instance.Users, username) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("%s is not in room %s", username, roomId)})
+		return
+	}
+	if _, err := api.store.RemoveChatInstance(roomId); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	api.events.Publish(webhook.EventRoomClosed, webhook.RoomEvent{
+		RoomId:  roomId,
+		Users:   instance.Users,
+		Home:    instance.ChatServer,
+		Members: instance.Members,
+		Reason:  username + " left",
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "Room left", "roomId": roomId, "username": username})
+}
+
+// ReportOffender records a user who keeps going over a chat server's rate limits (POST).
+func (api *ClientAPI) ReportOffender(c *gin.Context) {
+	type OffenderRequest struct {
+		Username   string `json:"username" binding:"required"`
+		RoomId     string `json:"roomId"`
+		Violations int    `json:"violations"`
+		Action     string `json:"action"`
+	}
+
+	var req OffenderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format", "details": err.Error()})
+		return
+	}
+
+	fmt.Printf("Chat server %s reported %s for %d rate limit violations\n", c.ClientIP(), req.Username, req.Violations)
+	report := OffenderReport{
+		Server:     c.ClientIP(),
+		RoomId:     req.RoomId,
+		Violations: req.Violations,
+		Action:     req.Action,
+		Timestamp:  time.Now(),
+	}
+	if err := api.store.ReportOffender(req.Username, report); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record offender", "details": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Offender recorded"})
+}
+
+// GetOffenders lists the users reported for flooding, with their most recent reports (GET).
+func (api *ClientAPI) GetOffenders(c *gin.Context) {
+	offenders, err := api.store.GetOffenders()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"offenders": offenders})
+}
+
+// Advertise lists a registered client in the directory, with what it does (POST).
+func (api *ClientAPI) Advertise(c *gin.Context) {
+	type AdvertiseRequest struct {
+		Username    string `json:"username" binding:"required"`
+		Description string `json:"description"`
+	}
+
+	var req AdvertiseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format", "details": err.Error()})
+		return
+	}
+
+	// Clients can only advertise themselves
+	if _, err := api.identify(c, req.Username); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only a registered client can advertise itself"})
+		return
+	}
+	if err := api.store.Advertise(req.Username, req.Description); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Client advertised", "username": req.Username})
+}
+
+// GetDirectory lists the advertised clients, such as bots, with their descriptions (GET).
+func (api *ClientAPI) GetDirectory(c *gin.Context) {
+	directory, err := api.store.GetAdvertised()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"directory": directory})
+}
+
+/*
+GetContacts lists a client's contacts with their status, online, offline or in-chat, and
+who added the client as a contact since it last asked (GET). Only the client itself can
+list its contacts, the added-by notices are handed out once.
+*/
+func (api *ClientAPI) GetContacts(c *gin.Context) {
+	username, err := api.identify(c, c.Param("username"))
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only a registered client can list its contacts"})
+		return
+	}
+
+	contacts, err := api.store.GetContacts(username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	addedBy, err := api.store.TakeAddedBy(username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"username": username, "contacts": contacts, "addedBy": addedBy})
+}
+
+// AddContact adds a registered user to a client's contacts, they are told on their next listing (POST).
+func (api *ClientAPI) AddContact(c *gin.Context) {
+	type ContactRequest struct {
+		Contact string `json:"contact" binding:"required"`
+	}
+
+	var req ContactRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format", "details": err.Error()})
+		return
+	}
+
+	username, err := api.identify(c, c.Param("username"))
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only a registered client can change its contacts"})
+		return
+	}
+	if username == req.Contact {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Clients can't add themselves as a contact"})
+		return
+	}
+	if err := api.store.AddContact(username, req.Contact); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Contact added", "username": username, "contact": req.Contact})
+}
+
+// RemoveContact removes a user from a client's contacts (DELETE).
+func (api *ClientAPI) RemoveContact(c *gin.Context) {
+	username, err := api.identify(c, c.Param("username"))
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only a registered client can change its contacts"})
+		return
+	}
+	contact := c.Param("contact")
+	if err := api.store.RemoveContact(username, contact); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Contact removed", "username": username, "contact": contact})
+}
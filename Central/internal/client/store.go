@@ -2,26 +2,121 @@ package clientapi
 
 import (
 	"fmt"
+	"math"
+	"sort"
 	"sync"
+	"time"
 )
 
 // Store is an interface to define generic storage behavior.
 type Store interface {
-	Create(ip, username string) error
+	Create(ip, username string, ports ClientPorts) error
 	Read(ip string) (string, error)
-	Delete(ip string) error
+	Delete(username string) error
 	ReadByUsername(username string) (string, error)
+	GetPorts(username string) (ClientPorts, error)
 	UpdateDelayList(username string, delays map[string]float32) error
+	UpdateLatencies(username string, latencies map[string]LatencyStats) error
+	GetLatencies(username string) (map[string]LatencyStats, error)
 	GetDelayList(username string) (map[string]float32, error)
-	InsertChatInstance(roomId string, chatServer string, users []string) (string, error)
+	InsertChatInstance(roomId string, chatServer string, users []string, members map[string]string, score float32) (string, error)
+	GetChatInstance(roomId string) (ChatInstance, error)
 	RemoveChatInstance(roomId string) (string, error)
+	ReplaceChatInstance(roomId string, chatServer string, users []string, members map[string]string, score float32) error
 	RemoveChatInstancesForServer(server string) ([]string, error)
 	RemoveChatInstancesForUser(user string) (string, error)
 	GetAllChatInstances() ([]ChatInstance, error)
+	ReportOffender(username string, report OffenderReport) error
+	GetOffenders() (map[string][]OffenderReport, error)
+	Advertise(username, description string) error
+	GetAdvertised() (map[string]string, error)
+	AddContact(owner, contact string) error
+	RemoveContact(owner, contact string) error
+	GetContacts(owner string) ([]Contact, error)
+	TakeAddedBy(username string) ([]string, error)
+}
+
+// Ports clients listen on unless they register others
+const (
+	DefaultRequestPort = "3001"
+	DefaultReroutePort = "3003"
+)
+
+// ClientPorts are the ports a client listens on, Central dials them for chat requests and reroutes
+type ClientPorts struct {
+	Request string `json:"request"`
+	Reroute string `json:"reroute"`
+}
+
+// registeredClient is where a user can be reached
+type registeredClient struct {
+	ip    string
+	ports ClientPorts
+}
+
+/*
+LatencyStats is what a client measured to a chat server, times in milliseconds. Loss is
+the share of probes that failed, from 0 to 1, and Down is set when the client's last probes
+all failed. Uplink and Downlink are the one-way delays, when the client could estimate
+them. Clients that only report plain delays get their delay as the RTT.
+*/
+type LatencyStats struct {
+	RTT      float32 `json:"rtt"`
+	Jitter   float32 `json:"jitter"`
+	Loss     float32 `json:"loss"`
+	Uplink   float32 `json:"uplink"`
+	Downlink float32 `json:"downlink"`
+	Samples  int     `json:"samples"`
+	Down     bool    `json:"down"`
+}
+
+// Weights of jitter and loss in the cost of a server, 10% loss doubles it
+const (
+	jitterWeight = 2
+	lossWeight   = 10
+)
+
+// Cost is the delay server selection uses: the RTT padded by the jitter and scaled up by the loss
+func (l LatencyStats) Cost() float32 {
+	if l.Down || l.Loss >= 1 || l.RTT >= math.MaxFloat32/(1+lossWeight) {
+		return math.MaxFloat32
+	}
+	return (l.RTT + jitterWeight*l.Jitter) * (1 + lossWeight*l.Loss)
+}
+
+// Number of offender reports kept per user
+const offenderHistorySize = 20
+
+// OffenderReport is sent by a chat server when a user keeps going over its rate limits
+type OffenderReport struct {
+	Server     string    `json:"server"`
+	RoomId     string    `json:"roomId"`
+	Violations int       `json:"violations"`
+	Action     string    `json:"action"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// Status of a contact, in-chat while they are in a room
+const (
+	StatusOnline  = "online"
+	StatusOffline = "offline"
+	StatusInChat  = "in-chat"
+)
+
+// Number of "added you as a contact" notices kept for a user who doesn't collect them
+const addedByQueueSize = 50
+
+// Contact is a user someone keeps in their contacts, with whether they can be reached
+type Contact struct {
+	Username string `json:"username"`
+	Status   string `json:"status"`
 }
 
 type ChatInstance struct {
-	ChatServer string
+	ChatServer string            // Server minimizing the worst latency of all members
+	Members    map[string]string // Username -> chat server the member is connected to
+	Score      float32           // Worst cost of the members at ChatServer when it was picked, in ms
+	Placed     time.Time         // When ChatServer was picked
 	Users      []string
 	RoomId     string
 	Active     bool
@@ -29,9 +124,13 @@ type ChatInstance struct {
 
 // InMemoryStore is a thread-safe implementation of the Store interface.
 type InMemoryStore struct {
-	data          map[string]string
-	delayLists    map[string]map[string]float32 // username --> server --> delay
+	clients       map[string]registeredClient        // username --> address, several users can share an IP
+	delayLists    map[string]map[string]LatencyStats // username --> server --> latency
 	chatInstances []ChatInstance
+	offenders     map[string][]OffenderReport // username --> most recent reports
+	advertised    map[string]string           // username --> what the bot does
+	contacts      map[string]map[string]bool  // username --> their contacts, kept when they leave
+	addedBy       map[string][]string         // username --> who added them since they last asked
 	mu            sync.RWMutex
 }
 
@@ -44,40 +143,56 @@ var (
 func GetInMemoryStore() *InMemoryStore {
 	once.Do(func() {
 		instance = &InMemoryStore{
-			data:          make(map[string]string),
-			delayLists:    make(map[string]map[string]float32),
+			clients:       make(map[string]registeredClient),
+			delayLists:    make(map[string]map[string]LatencyStats),
 			chatInstances: []ChatInstance{},
+			offenders:     make(map[string][]OffenderReport),
+			advertised:    make(map[string]string),
+			contacts:      make(map[string]map[string]bool),
+			addedBy:       make(map[string][]string),
 		}
 	})
 	return instance
 }
 
-// Create adds an IP-to-username mapping to the store.
-func (s *InMemoryStore) Create(ip, username string) error {
+// Create registers a user at an IP, with the ports they listen on, defaults for those left empty.
+func (s *InMemoryStore) Create(ip, username string, ports ClientPorts) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	// check if there's already a client with this Ip
-	for existingIP, existingUsername := range s.data {
-		if existingUsername == username {
-			return fmt.Errorf("the username %s is already associated with IP %s", username, existingIP)
-		}
+	if existing, exists := s.clients[username]; exists {
+		return fmt.Errorf("the username %s is already associated with IP %s", username, existing.ip)
 	}
 
-	s.data[ip] = username
+	if ports.Request == "" {
+		ports.Request = DefaultRequestPort
+	}
+	if ports.Reroute == "" {
+		ports.Reroute = DefaultReroutePort
+	}
+	s.clients[username] = registeredClient{ip: ip, ports: ports}
 	return nil
 }
 
-// Read retrieves the username for a given IP.
+// Read retrieves the username registered at an IP, which must be the only one there.
 func (s *InMemoryStore) Read(ip string) (string, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	username, exists := s.data[ip]
-	if !exists {
+	found := ""
+	for username, client := range s.clients {
+		if client.ip != ip {
+			continue
+		}
+		if found != "" {
+			return "", fmt.Errorf("several clients are registered from IP %s", ip)
+		}
+		found = username
+	}
+	if found == "" {
 		return "", fmt.Errorf("IP %s not found", ip)
 	}
 
-	return username, nil
+	return found, nil
 }
 
 // ReadByUsername retrieves the IP for a given username.
@@ -85,55 +200,116 @@ func (s *InMemoryStore) ReadByUsername(username string) (string, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	for ip, u := range s.data {
-		if u == username {
-			return ip, nil
-		}
+	client, exists := s.clients[username]
+	if !exists {
+		return "", fmt.Errorf("Username %s not found", username)
 	}
 
-	return "", fmt.Errorf("Username %s not found", username)
+	return client.ip, nil
 }
 
-// Delete removes an IP-to-username mapping from the store.
-func (s *InMemoryStore) Delete(ip string) error {
+// GetPorts retrieves the ports a user listens on.
+func (s *InMemoryStore) GetPorts(username string) (ClientPorts, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	client, exists := s.clients[username]
+	if !exists {
+		return ClientPorts{}, fmt.Errorf("Username %s not found", username)
+	}
+
+	return client.ports, nil
+}
+
+// Delete removes a user from the store.
+func (s *InMemoryStore) Delete(username string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if _, exists := s.data[ip]; !exists {
-		return fmt.Errorf("IP %s not found", ip)
+	if _, exists := s.clients[username]; !exists {
+		return fmt.Errorf("Username %s not found", username)
 	}
 
-	delete(s.data, ip)
+	delete(s.advertised, username)
+	delete(s.clients, username)
 	return nil
 }
 
+// UpdateDelayList stores plain delays, for clients that don't measure jitter and loss
 func (s *InMemoryStore) UpdateDelayList(username string, delays map[string]float32) error {
+	latencies := make(map[string]LatencyStats, len(delays))
+	for server, delay := range delays {
+		latencies[server] = LatencyStats{RTT: delay, Samples: 1}
+	}
+	return s.UpdateLatencies(username, latencies)
+}
+
+func (s *InMemoryStore) UpdateLatencies(username string, latencies map[string]LatencyStats) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.delayLists[username] = delays
+	s.delayLists[username] = latencies
 	return nil
 }
 
-func (s *InMemoryStore) GetDelayList(username string) (map[string]float32, error) {
+func (s *InMemoryStore) GetLatencies(username string) (map[string]LatencyStats, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	delays, exists := s.delayLists[username]
+	latencies, exists := s.delayLists[username]
 	if !exists {
 		return nil, fmt.Errorf("delays for username %s not found", username)
 	}
+	copied := make(map[string]LatencyStats, len(latencies))
+	for server, stats := range latencies {
+		copied[server] = stats
+	}
+	return copied, nil
+}
+
+// GetDelayList returns the cost of each server for a user, which server selection minimizes
+func (s *InMemoryStore) GetDelayList(username string) (map[string]float32, error) {
+	latencies, err := s.GetLatencies(username)
+	if err != nil {
+		return nil, err
+	}
+	delays := make(map[string]float32, len(latencies))
+	for server, stats := range latencies {
+		delays[server] = stats.Cost()
+	}
 	return delays, nil
 }
 
-func (s *InMemoryStore) InsertChatInstance(roomId string, chatServer string, users []string) (string, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	newInstance := ChatInstance{RoomId: roomId, ChatServer: chatServer, Users: users, Active: true}
-	s.chatInstances = append(s.chatInstances, newInstance)
+// clone copies the instance, so callers never share its users or members with the store
+func (instance ChatInstance) clone() ChatInstance {
+	instance.Users = append([]string{}, instance.Users...)
+	members := make(map[string]string, len(instance.Members))
+	for user, server := range instance.Members {
+		members[user] = server
+	}
+	instance.Members = members
+	return instance
+}
+
+func (s *InMemoryStore) InsertChatInstance(roomId string, chatServer string, users []string, members map[string]string, score float32) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	newInstance := ChatInstance{RoomId: roomId, ChatServer: chatServer, Members: members, Users: users, Score: score, Placed: time.Now(), Active: true}
+	s.chatInstances = append(s.chatInstances, newInstance.clone())
 	return roomId, nil
 }
-func (s *InMemoryStore) RemoveChatInstance(roomId string) (string, error) {
+func (s *InMemoryStore) GetChatInstance(roomId string) (ChatInstance, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+	for _, instance := range s.chatInstances {
+		if instance.RoomId == roomId {
+			return instance.clone(), nil
+		}
+	}
+	return ChatInstance{}, fmt.Errorf("chat instance with roomId %s not found", roomId)
+}
+
+func (s *InMemoryStore) RemoveChatInstance(roomId string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for i, instance := range s.chatInstances {
 		if instance.RoomId == roomId {
 			s.chatInstances = append(s.chatInstances[:i], s.chatInstances[i+1:]...)
@@ -143,22 +319,42 @@ func (s *InMemoryStore) RemoveChatInstance(roomId string) (string, error) {
 	return "", fmt.Errorf("chat instance with roomId %s not found", roomId)
 }
 
+/*
+ReplaceChatInstance places a room again, in one step so nobody sees it missing. A room
+closed in the meantime stays closed, and an error is returned.
+*/
+func (s *InMemoryStore) ReplaceChatInstance(roomId string, chatServer string, users []string, members map[string]string, score float32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, instance := range s.chatInstances {
+		if instance.RoomId == roomId {
+			replaced := ChatInstance{RoomId: roomId, ChatServer: chatServer, Members: members, Users: users, Score: score, Placed: time.Now(), Active: true}
+			s.chatInstances[i] = replaced.clone()
+			return nil
+		}
+	}
+	return fmt.Errorf("chat instance with roomId %s not found", roomId)
+}
+
 func (s *InMemoryStore) RemoveChatInstancesForServer(server string) ([]string, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	var removedInstances []string
-	for i, instance := range s.chatInstances {
+	kept := s.chatInstances[:0]
+	for _, instance := range s.chatInstances {
 		if instance.ChatServer == server {
 			removedInstances = append(removedInstances, instance.RoomId)
-			s.chatInstances = append(s.chatInstances[:i], s.chatInstances[i+1:]...)
+		} else {
+			kept = append(kept, instance)
 		}
 	}
+	s.chatInstances = kept
 	return removedInstances, nil
 }
 
 func (s *InMemoryStore) RemoveChatInstancesForUser(user string) (string, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for i, instance := range s.chatInstances {
 		// if chat instance has user, remove it
 		hasUser := false
@@ -184,5 +380,141 @@ func (s *InMemoryStore) RemoveChatInstancesForUser(user string) (string, error)
 func (s *InMemoryStore) GetAllChatInstances() ([]ChatInstance, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.chatInstances, nil
+	instances := make([]ChatInstance, 0, len(s.chatInstances))
+	for _, instance := range s.chatInstances {
+		instances = append(instances, instance.clone())
+	}
+	return instances, nil
+}
+
+func (s *InMemoryStore) ReportOffender(username string, report OffenderReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reports := append(s.offenders[username], report)
+	if len(reports) > offenderHistorySize {
+		reports = reports[len(reports)-offenderHistorySize:]
+	}
+	s.offenders[username] = reports
+	return nil
+}
+
+func (s *InMemoryStore) GetOffenders() (map[string][]OffenderReport, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	offenders := make(map[string][]OffenderReport)
+	for username, reports := range s.offenders {
+		offenders[username] = append([]OffenderReport{}, reports...)
+	}
+	return offenders, nil
+}
+
+// Advertise lists a registered user, typically a bot, in the directory users can browse.
+func (s *InMemoryStore) Advertise(username, description string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.clients[username]; !exists {
+		return fmt.Errorf("Username %s not found", username)
+	}
+	s.advertised[username] = description
+	return nil
+}
+
+func (s *InMemoryStore) GetAdvertised() (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	advertised := make(map[string]string)
+	for username, description := range s.advertised {
+		advertised[username] = description
+	}
+	return advertised, nil
+}
+
+/*
+AddContact adds a registered user to the contacts of owner, and queues a notice for them
+until they ask who added them. Adding a contact again doesn't notify them twice.
+*/
+func (s *InMemoryStore) AddContact(owner, contact string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if owner == contact {
+		return fmt.Errorf("%s can't add themselves as a contact", owner)
+	}
+	if _, exists := s.clients[contact]; !exists {
+		return fmt.Errorf("Username %s not found", contact)
+	}
+	if s.contacts[owner] == nil {
+		s.contacts[owner] = make(map[string]bool)
+	}
+	if s.contacts[owner][contact] {
+		return nil
+	}
+	s.contacts[owner][contact] = true
+
+	notices := append(s.addedBy[contact], owner)
+	if len(notices) > addedByQueueSize {
+		notices = notices[len(notices)-addedByQueueSize:]
+	}
+	s.addedBy[contact] = notices
+	return nil
+}
+
+// RemoveContact removes a user from the contacts of owner, with the notice they may not have seen yet
+func (s *InMemoryStore) RemoveContact(owner, contact string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.contacts[owner][contact] {
+		return fmt.Errorf("%s is not a contact of %s", contact, owner)
+	}
+	delete(s.contacts[owner], contact)
+
+	notices := s.addedBy[contact][:0]
+	for _, by := range s.addedBy[contact] {
+		if by != owner {
+			notices = append(notices, by)
+		}
+	}
+	s.addedBy[contact] = notices
+	return nil
+}
+
+// GetContacts lists the contacts of owner by username, with their current status
+func (s *InMemoryStore) GetContacts(owner string) ([]Contact, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	inChat := make(map[string]bool)
+	for _, instance := range s.chatInstances {
+		for _, user := range instance.Users {
+			inChat[user] = true
+		}
+	}
+
+	contacts := make([]Contact, 0, len(s.contacts[owner]))
+	for username := range s.contacts[owner] {
+		status := StatusOnline
+		if _, registered := s.clients[username]; !registered {
+			status = StatusOffline
+		} else if inChat[username] {
+			status = StatusInChat
+		}
+		contacts = append(contacts, Contact{Username: username, Status: status})
+	}
+	sort.Slice(contacts, func(i, j int) bool { return contacts[i].Username < contacts[j].Username })
+	return contacts, nil
+}
+
+// TakeAddedBy returns who added username as a contact since the last call, oldest first
+func (s *InMemoryStore) TakeAddedBy(username string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addedBy := s.addedBy[username]
+	delete(s.addedBy, username)
+	if addedBy == nil {
+		addedBy = []string{}
+	}
+	return addedBy, nil
 }
@@ -0,0 +1,380 @@
+package gateway
+
+import (
+	"bufio"
+	client "central/internal/client"
+	"central/internal/matchmaking"
+	service "central/internal/service"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+/*
+Gateway exposes registration, matchmaking and chat requests to browser clients over a
+WebSocket, with the same semantics as the TCP protocols. Browsers can't listen for
+Central's connections, so the gateway stands in for them: chat requests and reroutes
+for a user connected here are delivered over their WebSocket instead.
+
+Every frame is a JSON Message. Browsers send register, delays, servers, request,
+accept and decline. The gateway sends registered, servers, status, request,
+matched, reroute and error. A chat request that goes unanswered ends with expired,
+for both users, and one the requester withdrew with cancelled.
+
+Only pages served by Central or from the allowed origins can connect, so other sites
+can't act as the users visiting them.
+*/
+type Gateway struct {
+	clientStore    client.Store
+	serviceStore   service.Store
+	matchmaking    *matchmaking.MatchmakingServer
+	fallback       matchmaking.ClientDialer
+	allowedOrigins []string            // Web front ends browsers may connect from, "*" for any
+	sessions       map[string]*session // Username -> session
+	mu             sync.Mutex
+}
+
+// Message is a single frame exchanged with a browser client
+type Message struct {
+	Type     string             `json:"type"`
+	Username string             `json:"username,omitempty"`
+	Status   string             `json:"status,omitempty"`
+	Server   string             `json:"server,omitempty"`
+	RoomId   string             `json:"roomId,omitempty"`
+	Servers  []string           `json:"servers,omitempty"`
+	Delays   map[string]float32 `json:"delays,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
+
+type session struct {
+	ws       *websocket.Conn
+	key      string              // Stands in for the client IP in the client store
+	username string              // Empty until registered
+	requests map[string]net.Conn // Requester -> pending chat request
+	mu       sync.Mutex
+}
+
+func NewGateway(clientStore client.Store, serviceStore service.Store, ms *matchmaking.MatchmakingServer) *Gateway {
+	return &Gateway{
+		clientStore:  clientStore,
+		serviceStore: serviceStore,
+		matchmaking:  ms,
+		fallback:     matchmaking.TCPDialer{},
+		sessions:     make(map[string]*session),
+	}
+}
+
+// SetAllowedOrigins lists the web front ends browsers may connect from, as origins like https://chat.example.com
+func (g *Gateway) SetAllowedOrigins(origins []string) {
+	g.allowedOrigins = origins
+}
+
+// ReadAllowedOrigins reads the allowed origins from a file, one per line
+func ReadAllowedOrigins(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read allowed origins: %w", err)
+	}
+	origins := strings.Fields(string(data))
+	if len(origins) == 0 {
+		return nil, fmt.Errorf("allowed origins file is empty")
+	}
+	return origins, nil
+}
+
+func (g *Gateway) RegisterRoutes(router *gin.Engine) {
+	server := websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error { return g.checkOrigin(req) },
+		Handler:   g.serve,
+	}
+	router.GET("/ws", gin.WrapH(server))
+}
+
+// checkOrigin refuses WebSocket requests from pages of other origins, requests without one don't come from a browser
+func (g *Gateway) checkOrigin(req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return fmt.Errorf("invalid origin %q", origin)
+	}
+	if strings.EqualFold(parsed.Host, req.Host) {
+		return nil
+	}
+	for _, allowed := range g.allowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %s is not allowed", origin)
+}
+
+// send writes a message to the browser, frames from different goroutines must not interleave
+func (s *session) send(msg Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := websocket.JSON.Send(s.ws, msg); err != nil {
+		log.Printf("Failed to send %s to %s: %v\n", msg.Type, s.key, err)
+	}
+}
+
+func (g *Gateway) serve(ws *websocket.Conn) {
+	s := &session{
+		ws:       ws,
+		key:      "ws:" + ws.Request().RemoteAddr,
+		requests: make(map[string]net.Conn),
+	}
+	defer g.close(s)
+
+	for {
+		var msg Message
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return
+		}
+
+		if msg.Type != "register" && msg.Type != "servers" && s.username == "" {
+			s.send(Message{Type: "error", Error: "Register first"})
+			continue
+		}
+
+		switch msg.Type {
+		case "register":
+			g.register(s, msg.Username)
+		case "servers":
+			servers, err := g.serviceStore.Read()
+			if err != nil {
+				s.send(Message{Type: "error", Error: err.Error()})
+				continue
+			}
+			s.send(Message{Type: "servers", Servers: servers})
+		case "delays":
+			g.clientStore.UpdateDelayList(s.username, msg.Delays)
+		case "request":
+			go g.request(s, msg.Username)
+		case "accept":
+			g.answer(s, msg.Username, true)
+		case "decline":
+			g.answer(s, msg.Username, false)
+		default:
+			s.send(Message{Type: "error", Error: fmt.Sprintf("Unknown message type %q", msg.Type)})
+		}
+	}
+}
+
+func (g *Gateway) register(s *session, username string) {
+	if s.username != "" || username == "" {
+		s.send(Message{Type: "error", Error: "Invalid registration"})
+		return
+	}
+	if err := g.clientStore.Create(s.key, username, client.ClientPorts{}); err != nil {
+		s.send(Message{Type: "error", Error: err.Error()})
+		return
+	}
+
+	s.username = username
+	g.mu.Lock()
+	g.sessions[username] = s
+	g.mu.Unlock()
+	fmt.Println("REGISTERED WEBSOCKET CLIENT: ", username)
+	s.send(Message{Type: "registered", Username: username})
+}
+
+// close unregisters the user and declines their pending requests
+func (g *Gateway) close(s *session) {
+	if s.username != "" {
+		g.mu.Lock()
+		delete(g.sessions, s.username)
+		g.mu.Unlock()
+		g.clientStore.Delete(s.username)
+	}
+
+	s.mu.Lock()
+	requests := s.requests
+	s.requests = make(map[string]net.Conn) // Nobody is left to tell they ended
+	s.mu.Unlock()
+	for _, conn := range requests {
+		conn.Close()
+	}
+	s.ws.Close()
+}
+
+// request runs matchmaking for the browser user, relaying its progress as status messages
+func (g *Gateway) request(s *session, username string) {
+	conn, matchmakingConn := net.Pipe()
+	defer conn.Close()
+	go func() {
+		g.matchmaking.Matchmake(matchmakingConn, s.username)
+		matchmakingConn.Close()
+	}()
+
+	if _, err := conn.Write([]byte(username)); err != nil {
+		s.send(Message{Type: "status", Status: "SERVER_ERROR"})
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	lastStatus := ""
+	server := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(line, "IP:"):
+			server = strings.TrimPrefix(line, "IP:")
+		case strings.HasPrefix(line, "RoomID:"):
+			s.send(Message{Type: "matched", Server: server, RoomId: strings.TrimPrefix(line, "RoomID:")})
+		case line == strings.TrimSpace(string(matchmaking.REQ_EXPIRED)):
+			s.send(Message{Type: "expired", Username: username})
+		case line != lastStatus:
+			// Matchmaking repeats AWAITING_REQ while the other user decides, send it once
+			lastStatus = line
+			s.send(Message{Type: "status", Status: line})
+		}
+	}
+}
+
+// answer accepts or declines a pending chat request, watchRequest reads what matchmaking answers
+func (g *Gateway) answer(s *session, requester string, accept bool) {
+	s.mu.Lock()
+	conn, ok := s.requests[requester]
+	delete(s.requests, requester)
+	s.mu.Unlock()
+	if !ok {
+		s.send(Message{Type: "error", Error: "No chat request from " + requester})
+		return
+	}
+
+	if !accept {
+		conn.Write([]byte("DECLINE\n"))
+		conn.Close()
+		return
+	}
+
+	go func() {
+		if _, err := conn.Write([]byte("ACCEPT_REQ\n")); err != nil {
+			s.send(Message{Type: "status", Status: "SERVER_ERROR"})
+			conn.Close()
+		}
+	}()
+}
+
+/*
+watchRequest reads matchmaking's side of a chat request delivered to the browser. Before
+the browser answers, the request can expire or the requester withdraw it, the browser is
+told with expired or cancelled. Once accepted, matchmaking sends the chat server to
+connect to.
+*/
+func (g *Gateway) watchRequest(s *session, requester string, conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	server := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// Matchmaking hung up, the requester withdrew
+			if s.dropRequest(requester, conn) {
+				s.send(Message{Type: "cancelled", Username: requester})
+			}
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == strings.TrimSpace(string(matchmaking.REQ_EXPIRED)):
+			if s.dropRequest(requester, conn) {
+				s.send(Message{Type: "expired", Username: requester})
+			}
+			return
+		case strings.HasPrefix(line, "IP:"):
+			server = strings.TrimPrefix(line, "IP:")
+		case strings.HasPrefix(line, "RoomID:"):
+			s.send(Message{Type: "matched", Server: server, RoomId: strings.TrimPrefix(line, "RoomID:")})
+			return
+		default:
+			s.send(Message{Type: "status", Status: line})
+			return
+		}
+	}
+}
+
+// dropRequest forgets a pending request, reporting whether it was still waiting for the browser
+func (s *session) dropRequest(requester string, conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.requests[requester] != conn {
+		return false // Answered, or replaced by a newer request
+	}
+	delete(s.requests, requester)
+	return true
+}
+
+/*
+DialClient implements matchmaking.ClientDialer. Users connected over a WebSocket get
+one end of a pipe which behaves like their TCP listener, everyone else is dialed directly.
+*/
+func (g *Gateway) DialClient(username, ip, port string) (net.Conn, error) {
+	g.mu.Lock()
+	s, ok := g.sessions[username]
+	g.mu.Unlock()
+	if !ok {
+		return g.fallback.DialClient(username, ip, port)
+	}
+
+	conn, clientConn := net.Pipe()
+	switch port {
+	case matchmaking.REQUEST_PORT:
+		go g.deliverRequest(s, conn)
+	case matchmaking.REROUTE_PORT:
+		go g.deliverReroute(s, conn)
+	default:
+		conn.Close()
+		clientConn.Close()
+		return nil, fmt.Errorf("unknown client port %s", port)
+	}
+	return clientConn, nil
+}
+
+// deliverRequest reads the requester's username and waits for the browser to answer
+func (g *Gateway) deliverRequest(s *session, conn net.Conn) {
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	requester := strings.TrimSpace(string(buf[:n]))
+
+	s.mu.Lock()
+	if previous, ok := s.requests[requester]; ok {
+		previous.Close()
+	}
+	s.requests[requester] = conn
+	s.mu.Unlock()
+	s.send(Message{Type: "request", Username: requester})
+	g.watchRequest(s, requester, conn)
+}
+
+// deliverReroute tells the browser which chat server to move to, for which room
+func (g *Gateway) deliverReroute(s *session, conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return
+	}
+	server, roomId, _ := strings.Cut(strings.TrimSpace(string(buf[:n])), "\n")
+	s.send(Message{Type: "reroute", Server: server, RoomId: strings.TrimSpace(roomId)})
+}
@@ -3,6 +3,7 @@ package matchmaking
 import (
 	client "central/internal/client"
 	service "central/internal/service"
+	"central/internal/webhook"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
@@ -15,8 +16,36 @@ import (
 )
 
 type MatchmakingServer struct {
-	clientStore  client.Store
-	serviceStore service.Store
+	clientStore    client.Store
+	serviceStore   service.Store
+	dialer         ClientDialer
+	events         webhook.Publisher
+	requestTimeout time.Duration // How long a chat request waits for an answer
+}
+
+// Default ports clients listen on for chat requests and reroutes, they can register others
+const (
+	REQUEST_PORT = client.DefaultRequestPort
+	REROUTE_PORT = client.DefaultReroutePort
+)
+
+// DefaultRequestTimeout is how long a chat request waits for an answer before it expires
+const DefaultRequestTimeout = 2 * time.Minute
+
+// ClientDialer opens the connections Central makes to clients, to send them chat requests and reroutes
+type ClientDialer interface {
+	DialClient(username, ip, port string) (net.Conn, error)
+}
+
+// TCPDialer reaches clients on the ports they listen on
+type TCPDialer struct{}
+
+func (TCPDialer) DialClient(username, ip, port string) (net.Conn, error) {
+	// hack for local testing
+	if ip == "::1" {
+		ip = "localhost"
+	}
+	return net.Dial("tcp", ip+":"+port)
 }
 
 var (
@@ -27,11 +56,27 @@ var (
 	REQ_ACCEPTED   = []byte("REQ_ACCEPTED\n")
 	ACCEPT_REQ     = []byte("ACCEPT_REQ")
 	SERVER_ERROR   = []byte("SERVER_ERROR\n")
+	REQ_EXPIRED    = []byte("REQ_EXPIRED\n")
 )
 
 // NewMatchmakingServer initializes a new matchmaking server
 func NewMatchmakingServer(store client.Store, serviceStore service.Store) *MatchmakingServer {
-	return &MatchmakingServer{clientStore: store, serviceStore: serviceStore}
+	return &MatchmakingServer{clientStore: store, serviceStore: serviceStore, dialer: TCPDialer{}, events: webhook.Discard{}, requestTimeout: DefaultRequestTimeout}
+}
+
+// SetClientDialer replaces how Central reaches clients, e.g. to reach clients connected over a WebSocket
+func (ms *MatchmakingServer) SetClientDialer(dialer ClientDialer) {
+	ms.dialer = dialer
+}
+
+// SetRequestTimeout sets how long a chat request waits for an answer, both users are told once it expires
+func (ms *MatchmakingServer) SetRequestTimeout(timeout time.Duration) {
+	ms.requestTimeout = timeout
+}
+
+// SetEventPublisher shares matches and room changes, e.g. with the registered webhooks
+func (ms *MatchmakingServer) SetEventPublisher(events webhook.Publisher) {
+	ms.events = events
 }
 
 // Start starts the TCP matchmaking server
@@ -64,8 +109,20 @@ func RequestSent(conn net.Conn) {
 	conn.Write(MSG_REQ_SENT)
 }
 
-func AwaitingRequest(conn net.Conn) {
-	conn.Write(AWAITING_REQ)
+// AwaitingRequest tells the requester we still wait for an answer, failing once they hung up
+func AwaitingRequest(conn net.Conn) error {
+	_, err := conn.Write(AWAITING_REQ)
+	return err
+}
+
+/*
+RequestExpired tells both users a request went unanswered for too long. The requested
+user may be connected through a pipe nobody reads, so they get a moment only.
+*/
+func RequestExpired(conn net.Conn, connRequest net.Conn) {
+	conn.Write(REQ_EXPIRED)
+	connRequest.SetWriteDeadline(time.Now().Add(time.Second))
+	connRequest.Write(REQ_EXPIRED)
 }
 
 func UserNotFound(conn net.Conn) {
@@ -198,6 +255,141 @@ func compute_optimal_server(client1 map[string]float32, client2 map[string]float
 	return minimized_latency_servers[randomIndex], nil
 }
 
+/*
+Find the server with the lowest latency for a single client.
+With relaying between chat servers, every member of a room can connect to their own best
+server instead of the compromise above.
+
+if multiple servers have the same minimum latency, we choose one at random.
+*/
+func compute_best_server(delays map[string]float32) (string, error) {
+	best_servers := []string{}
+	minimum_latency := float32(math.MaxFloat32)
+	for server, latency := range delays {
+		if latency < minimum_latency {
+			minimum_latency = latency
+			best_servers = []string{server}
+		} else if latency == minimum_latency {
+			best_servers = append(best_servers, server)
+		}
+	}
+
+	if len(best_servers) == 0 {
+		return "", fmt.Errorf("no server found")
+	}
+
+	r := mathrand.New(mathrand.NewSource(time.Now().UnixNano()))
+	return best_servers[r.Intn(len(best_servers))], nil
+}
+
+/*
+Place the members of a room. The home server is the minimax compromise for both clients,
+each member is then sent to their own best server, falling back to the home server.
+placeRoom keeps them together on the home server unless all those servers relay.
+*/
+func place_members(client1 string, client1Delay map[string]float32, client2 string, client2Delay map[string]float32) (string, map[string]string, error) {
+	home, err := compute_optimal_server(client1Delay, client2Delay)
+	if err != nil {
+		return "", nil, err
+	}
+
+	members := map[string]string{client1: home, client2: home}
+	if server, err := compute_best_server(client1Delay); err == nil {
+		members[client1] = server
+	}
+	if server, err := compute_best_server(client2Delay); err == nil {
+		members[client2] = server
+	}
+	return home, members, nil
+}
+
+// relayed reports whether the servers of a room's members can relay between each other, or need not
+func (ms *MatchmakingServer) relayed(home string, members map[string]string) bool {
+	for _, server := range members {
+		if server != home && (!ms.serviceStore.HasRelay(server) || !ms.serviceStore.HasRelay(home)) {
+			return false
+		}
+	}
+	return true
+}
+
+// minimaxScore is the worst delay of the users at the home server, what compute_optimal_server minimized
+func minimaxScore(home string, users []string, delays map[string]map[string]float32) float32 {
+	score := float32(0)
+	for _, user := range users {
+		score = max(score, delays[user][home])
+	}
+	return score
+}
+
+// availableDelays drops the servers which are down or draining from a client's delay list,
+// so rooms are never placed on them and rooms already on them get moved away
+func (ms *MatchmakingServer) availableDelays(delays map[string]float32) map[string]float32 {
+	servers, err := ms.serviceStore.Read()
+	if err != nil {
+		return delays
+	}
+
+	available := make(map[string]float32)
+	for _, server := range servers {
+		if latency, ok := delays[server]; ok {
+			available[server] = latency
+		}
+	}
+	return available
+}
+
+/*
+placeRoom places the two members of a room on available servers with room for them, and
+reserves it. Members staying on the server they are connected to don't count against its
+capacity, nor do they move to a server that is no better. Members only end up on different
+servers when all of them relay, otherwise everyone meets on the home server. When a placement would overflow
+a server, the members moving there drop it and the room is placed again. Returns the home
+server, the members' servers and the delays used.
+*/
+func (ms *MatchmakingServer) placeRoom(users []string, delays map[string]map[string]float32, current map[string]string) (string, map[string]string, map[string]map[string]float32, error) {
+	available := make(map[string]map[string]float32)
+	for _, user := range users {
+		available[user] = ms.availableDelays(delays[user])
+	}
+
+	for {
+		home, members, err := place_members(users[0], available[users[0]], users[1], available[users[1]])
+		if err != nil {
+			return "", nil, nil, err
+		}
+
+		demand := make(map[string]int)
+		for _, user := range users {
+			server, ok := current[user]
+			// Don't bounce a member between servers that are equally good
+			if latency, known := available[user][server]; ok && known && latency == available[user][members[user]] {
+				members[user] = server
+			}
+		}
+		// A split room loses every message between servers which don't relay
+		if !ms.relayed(home, members) {
+			for _, user := range users {
+				members[user] = home
+			}
+		}
+		for _, user := range users {
+			if members[user] != current[user] {
+				demand[members[user]]++
+			}
+		}
+		full, reserved := ms.serviceStore.ReserveCapacity(demand)
+		if reserved {
+			return home, members, available, nil
+		}
+		for _, user := range users {
+			if members[user] == full && current[user] != full {
+				delete(available[user], full)
+			}
+		}
+	}
+}
+
 // handleConnection processes an individual client connection
 func (ms *MatchmakingServer) handleConnection(conn net.Conn) {
 	defer conn.Close()
@@ -214,10 +406,20 @@ func (ms *MatchmakingServer) handleConnection(conn net.Conn) {
 
 	fmt.Println("Client with IP: " + clientIP + " connected")
 
-	// Check if the client IP is registered
-	username, err := ms.clientStore.Read(clientIP)
+	/*
+		Clients send the requested username, and their own on a second line since several
+		can share an IP. Without it the IP must be registered to a single client.
+	*/
+	req_user, username, _ := strings.Cut(GetRequestedUsername(conn), "\n")
+	username = strings.TrimSpace(username)
+	var err error
+	if username == "" {
+		username, err = ms.clientStore.Read(clientIP)
+	} else if ip, readErr := ms.clientStore.ReadByUsername(username); readErr != nil || ip != clientIP {
+		err = fmt.Errorf("%s is not registered from IP %s", username, clientIP)
+	}
 	if err != nil {
-		log.Printf("Unregistered client attempted to connect: %s\n", clientIP)
+		log.Printf("Unregistered client attempted to connect: %s: %v\n", clientIP, err)
 		conn.Write([]byte("Unauthorized\n"))
 		return
 	}
@@ -228,8 +430,20 @@ func (ms *MatchmakingServer) handleConnection(conn net.Conn) {
 		return
 	}
 
+	ms.matchmake(conn, username, strings.TrimSpace(req_user))
+}
+
+/*
+Matchmake runs the matchmaking protocol for a registered user over conn: it reads the
+requested username, asks that user to accept, and sends both of them their chat server.
+*/
+func (ms *MatchmakingServer) Matchmake(conn net.Conn, username string) {
 	// Requested username from client
-	req_user := GetRequestedUsername(conn)
+	ms.matchmake(conn, username, GetRequestedUsername(conn))
+}
+
+// matchmake runs the protocol once the requested username was read
+func (ms *MatchmakingServer) matchmake(conn net.Conn, username string, req_user string) {
 	fmt.Println("Requested username: " + req_user)
 	if req_user == "" {
 		UserNotFound(conn)
@@ -244,18 +458,22 @@ func (ms *MatchmakingServer) handleConnection(conn net.Conn) {
 		return
 	}
 
-	requestChannel := make(chan string)
-	// hack for local testing
-	if req_user_ip == "::1" {
-		req_user_ip = "localhost"
+	req_user_ports, err := ms.clientStore.GetPorts(req_user)
+	if err != nil {
+		UserNotFound(conn)
+		return
 	}
-	connRequest, err2 := net.Dial("tcp", req_user_ip+":3001")
+
+	// Buffered, the request may expire before they answer
+	requestChannel := make(chan string, 1)
+	connRequest, err2 := ms.dialer.DialClient(req_user, req_user_ip, req_user_ports.Request)
 	if err2 != nil {
 		log.Printf("Failed to connect to client: %v\n", err2)
 		return
 	}
 	go ms.requestMatch(username, connRequest, requestChannel)
 	RequestSent(conn)
+	expires := time.Now().Add(ms.requestTimeout)
 loop:
 	for {
 		select {
@@ -265,10 +483,21 @@ loop:
 				break loop
 			} else {
 				UserNotFound(conn)
-				break loop
+				connRequest.Close()
+				return
 			}
 		default:
-			AwaitingRequest(conn)
+			// Closing the request tells the requested user it was withdrawn or expired
+			if time.Now().After(expires) {
+				RequestExpired(conn, connRequest)
+				connRequest.Close()
+				return
+			}
+			if err := AwaitingRequest(conn); err != nil {
+				log.Printf("%s withdrew their chat request to %s\n", username, req_user)
+				connRequest.Close()
+				return
+			}
 		}
 		// Debounce the loop by 50 ms
 		time.Sleep(50 * time.Millisecond)
@@ -282,7 +511,8 @@ loop:
 		ServerError(connRequest)
 		return
 	}
-	serverIP, err := compute_optimal_server(client1Delay, client2Delay)
+	users := []string{username, req_user}
+	serverIP, members, delays, err := ms.placeRoom(users, map[string]map[string]float32{username: client1Delay, req_user: client2Delay}, nil)
 	if err != nil {
 		ServerError(conn)
 		ServerError(connRequest)
@@ -290,11 +520,17 @@ loop:
 	}
 	roomId := generateRoomId()
 
-	response := fmt.Sprintf("IP:%s\nRoomID:%s\n", serverIP, roomId)
-	conn.Write([]byte(response))
-	connRequest.Write([]byte(response))
+	// The room exists before the members hear of it, their chat servers look it up as they join
+	score := minimaxScore(serverIP, users, delays)
+	ms.clientStore.InsertChatInstance(roomId, serverIP, users, members, score)
+	room := webhook.RoomEvent{RoomId: roomId, Users: users, Home: serverIP, Members: members, Score: score}
+	ms.events.Publish(webhook.EventMatch, room)
+	ms.events.Publish(webhook.EventRoomCreated, room)
+
+	// Each member gets the server they were placed on, the chat servers relay between each other
+	conn.Write([]byte(fmt.Sprintf("IP:%s\nRoomID:%s\n", members[username], roomId)))
+	connRequest.Write([]byte(fmt.Sprintf("IP:%s\nRoomID:%s\n", members[req_user], roomId)))
 	// Close both connections after sending the IP
-	ms.clientStore.InsertChatInstance(roomId, serverIP, []string{username, req_user})
 	conn.Close()
 	connRequest.Close()
 }
@@ -309,8 +545,8 @@ func (ms *MatchmakingServer) backgroundAnalysis() {
 		select {
 		case <-ticker.C:
 			// Iterate over each server, and get the chat instances, if the server
-			// hasn't sent a heartbeat in the last 10 seconds, reroute the clients
-			// to the best server
+			// hasn't sent a heartbeat in the last 10 seconds or is draining, reroute
+			// the clients to the best server
 			allChatInstances, err := ms.clientStore.GetAllChatInstances()
 			if err != nil {
 				log.Printf("Error getting chat instances: %v\n", err)
@@ -326,36 +562,59 @@ func (ms *MatchmakingServer) backgroundAnalysis() {
 					log.Printf("Error getting delay list for clients: %v\n", err)
 					continue
 				}
-				serverIP, err := compute_optimal_server(client1Delay, client2Delay)
+				delays := map[string]map[string]float32{client1: client1Delay, client2: client2Delay}
+				serverIP, members, delays, err := ms.placeRoom(instance.Users, delays, instance.Members)
 				if err != nil {
 					log.Printf("Error computing optimal server: %v\n", err)
 					continue
 				}
-				if serverIP != instance.ChatServer {
-					// Reroute the clients
-					ms.clientStore.RemoveChatInstancesForUser(client1)
-					ms.clientStore.RemoveChatInstancesForUser(client2)
-					ms.clientStore.InsertChatInstance(instance.RoomId, serverIP, []string{client1, client2})
-					fmt.Printf("Rerouting clients %s and %s to server %s\n", client1, client2, serverIP)
-
-					client1IP, err := ms.clientStore.ReadByUsername(client1)
-					client2IP, err2 := ms.clientStore.ReadByUsername(client2)
-					if err != nil || err2 != nil {
-						log.Printf("Error getting client IPs: %v\n", err)
+				moved := []string{}
+				for _, user := range instance.Users {
+					if members[user] != instance.Members[user] {
+						moved = append(moved, user)
+					}
+				}
+				if len(moved) == 0 && serverIP == instance.ChatServer {
+					continue
+				}
+
+				// Reroute the clients, placeRoom reserved the servers they move to
+				// Users can be in several rooms, only this one is replaced, unless it was closed since
+				score := minimaxScore(serverIP, instance.Users, delays)
+				if err := ms.clientStore.ReplaceChatInstance(instance.RoomId, serverIP, []string{client1, client2}, members, score); err != nil {
+					continue
+				}
+				ms.events.Publish(webhook.EventRoomRerouted, webhook.RoomEvent{
+					RoomId:  instance.RoomId,
+					Users:   instance.Users,
+					Home:    serverIP,
+					Members: members,
+					Score:   score,
+					Moved:   moved,
+				})
+
+				// Only the members whose server changed need to reconnect
+				for _, user := range moved {
+					fmt.Printf("Rerouting client %s to server %s\n", user, members[user])
+					userIP, err := ms.clientStore.ReadByUsername(user)
+					if err != nil {
+						log.Printf("Error getting client IP: %v\n", err)
 						continue
 					}
 
-					// Redirect them to server 2
-					connRedirect1, err2 := net.Dial("tcp", client1IP+":3003")
-					connRedirect2, err3 := net.Dial("tcp", client2IP+":3003")
-					if err2 != nil || err3 != nil {
+					userPorts, err := ms.clientStore.GetPorts(user)
+					if err != nil {
+						log.Printf("Error getting client ports: %v\n", err)
 						continue
 					}
-					connRedirect1.Write([]byte(serverIP))
-					connRedirect2.Write([]byte(serverIP))
 
-					connRedirect1.Close()
-					connRedirect2.Close()
+					connRedirect, err := ms.dialer.DialClient(user, userIP, userPorts.Reroute)
+					if err != nil {
+						continue
+					}
+					// The room too, clients can be in several rooms on different servers
+					connRedirect.Write([]byte(fmt.Sprintf("%s\n%s\n", members[user], instance.RoomId)))
+					connRedirect.Close()
 				}
 			}
 		}
@@ -0,0 +1,58 @@
+package operator
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Operator routes change how Central behaves for everyone, or reach out to other hosts, so
+they require the operator token, either as a bearer token or in the X-Operator-Token
+header. Chat servers send it too when they report to Central. Without a configured
+token those routes are refused.
+*/
+
+// ReadToken reads the operator token from a file, it is empty if the file is missing or blank
+func ReadToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read operator token: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("operator token file is empty")
+	}
+	return token, nil
+}
+
+// Authenticate returns a handler rejecting requests which don't carry the token
+func Authenticate(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Disabled, no operator token configured"})
+			return
+		}
+		if !Valid(c, token) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid operator token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Valid reports whether a request carries the token, for routes operators share with others
+func Valid(c *gin.Context, token string) bool {
+	if token == "" {
+		return false
+	}
+	given := c.GetHeader("X-Operator-Token")
+	if bearer := c.GetHeader("Authorization"); strings.HasPrefix(bearer, "Bearer ") {
+		given = strings.TrimPrefix(bearer, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
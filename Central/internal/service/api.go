@@ -2,6 +2,7 @@ package serviceapi
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -24,6 +25,10 @@ func (api *ServiceAPI) RegisterRoutes(router *gin.Engine) {
 		group.GET("", api.GetServices)
 		group.PATCH("", api.PatchService)
 		group.DELETE("", api.DeleteService)
+		group.POST("/drain", api.DrainService)
+		group.GET("/draining", api.GetDrainingServices)
+		group.GET("/load", api.GetServicesLoad)
+		group.GET("/load/:ip", api.GetServiceLoad)
 	}
 }
 
@@ -47,14 +52,40 @@ func (api *ServiceAPI) GetServices(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"services": ips})
 }
 
+// ServiceHeartbeatRequest represents the optional payload of a heartbeat.
+type ServiceHeartbeatRequest struct {
+	Draining bool             `json:"draining"`
+	Load     *ServiceLoad     `json:"load"`
+	Capacity *ServiceCapacity `json:"capacity"`
+	Relay    bool             `json:"relay"`
+}
+
 func (api *ServiceAPI) PatchService(c *gin.Context) {
 	clientIP := c.ClientIP()
+	var req ServiceHeartbeatRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
+			return
+		}
+	}
+
 	// if it's not registered, just register it (incase central restarts)
-	api.store.Create(clientIP)
 	if _, err := api.store.Patch(clientIP); err != nil {
+		api.store.Create(clientIP)
+	}
+	if err := api.store.SetDraining(clientIP, req.Draining); err != nil {
 		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
 		return
 	}
+	if req.Load != nil {
+		req.Load.Timestamp = time.Now()
+		api.store.RecordLoad(clientIP, *req.Load)
+	}
+	if req.Capacity != nil {
+		api.store.SetCapacity(clientIP, *req.Capacity)
+	}
+	api.store.SetRelay(clientIP, req.Relay)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Service patched", "ip": clientIP})
 }
@@ -68,3 +99,47 @@ func (api *ServiceAPI) DeleteService(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"message": "Service deleted", "ip": clientIP})
 }
+
+// DrainService stops new rooms from being assigned to the calling server and moves its rooms elsewhere.
+func (api *ServiceAPI) DrainService(c *gin.Context) {
+	clientIP := c.ClientIP()
+	if err := api.store.SetDraining(clientIP, true); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Service draining", "ip": clientIP})
+}
+
+func (api *ServiceAPI) GetDrainingServices(c *gin.Context) {
+	ips, err := api.store.ReadDraining()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"services": ips})
+}
+
+// GetServicesLoad returns the recent load reports of every chat server which is up.
+func (api *ServiceAPI) GetServicesLoad(c *gin.Context) {
+	history, err := api.store.GetAllLoadHistory()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"load": history})
+}
+
+// GetServiceLoad returns the recent load reports of a single chat server.
+func (api *ServiceAPI) GetServiceLoad(c *gin.Context) {
+	ip := c.Param("ip")
+	history, err := api.store.GetLoadHistory(ip)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"ip": ip, "load": history})
+}
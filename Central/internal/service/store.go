@@ -2,6 +2,7 @@ package serviceapi
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 )
@@ -12,10 +13,44 @@ type Store interface {
 	Read() ([]string, error)
 	Delete(ip string) error
 	Patch(ip string) (string, error)
+	SetDraining(ip string, draining bool) error
+	ReadDraining() ([]string, error)
+	RecordLoad(ip string, load ServiceLoad) error
+	GetLoadHistory(ip string) ([]ServiceLoad, error)
+	GetAllLoadHistory() (map[string][]ServiceLoad, error)
+	SetCapacity(ip string, capacity ServiceCapacity) error
+	SetRelay(ip string, relay bool) error
+	HasRelay(ip string) bool
+	ReserveCapacity(demand map[string]int) (string, bool)
+}
+
+// Number of load reports kept per server, about a minute of heartbeats
+const loadHistorySize = 20
+
+// ServiceLoad is a load report sent by a chat server with its heartbeat
+type ServiceLoad struct {
+	Timestamp         time.Time `json:"timestamp"`
+	Rooms             int       `json:"rooms"`
+	Connections       int       `json:"connections"`
+	MessagesPerSecond float64   `json:"messagesPerSecond"`
+	QueueDepth        int       `json:"queueDepth"`
+	CPUPercent        float64   `json:"cpuPercent"`
+	MemoryBytes       uint64    `json:"memoryBytes"`
+}
+
+// ServiceCapacity is what a chat server accepts, as reported with its heartbeats, 0 is unlimited
+type ServiceCapacity struct {
+	MaxConnections int `json:"maxConnections"`
+	MaxRoomMembers int `json:"maxRoomMembers"`
 }
 
 type ServiceHeartbeat struct {
 	lastHeartbeat time.Time
+	draining      bool          // Draining servers get no new rooms and have their rooms moved away
+	loadHistory   []ServiceLoad // Most recent load reports, oldest first
+	capacity      ServiceCapacity
+	relay         bool // Whether the server relays rooms with the other chat servers
+	reserved      int  // Members sent to the server since its last load report
 }
 
 // InMemoryStore is a thread-safe implementation of the Store interface.
@@ -52,14 +87,14 @@ func (s *InMemoryStore) Create(ip string) error {
 	return nil
 }
 
-// Read retrieves the ips of all chat servers which are up
+// Read retrieves the ips of all chat servers which are up and accepting rooms
 func (s *InMemoryStore) Read() ([]string, error) {
 	s.mu.RLock() // Lock for read-only access
 	defer s.mu.RUnlock()
 
 	var ips []string
 	for ip, heartbeat := range s.data {
-		if time.Since(heartbeat.lastHeartbeat) <= 10*time.Second {
+		if time.Since(heartbeat.lastHeartbeat) <= 10*time.Second && !heartbeat.draining {
 			ips = append(ips, ip)
 		}
 	}
@@ -73,7 +108,7 @@ func (s *InMemoryStore) Delete(ip string) error {
 	defer s.mu.Unlock()
 	for k := range s.data {
 		if k == ip {
-			s.data[k] = ServiceHeartbeat{lastHeartbeat: time.Now()}
+			s.data[k] = ServiceHeartbeat{}
 			return nil
 		}
 	}
@@ -82,14 +117,174 @@ func (s *InMemoryStore) Delete(ip string) error {
 
 /* Patch sets the status of the ip to true */
 func (s *InMemoryStore) Patch(ip string) (string, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	for k := range s.data {
+	for k, heartbeat := range s.data {
 		if k == ip {
-			s.data[k] = ServiceHeartbeat{lastHeartbeat: time.Now()}
+			heartbeat.lastHeartbeat = time.Now()
+			s.data[k] = heartbeat
 			return ip, nil
 		}
 	}
 	return "", fmt.Errorf("IP %s not found", ip)
 }
+
+// SetDraining marks whether a server is being drained
+func (s *InMemoryStore) SetDraining(ip string, draining bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	heartbeat, exists := s.data[ip]
+	if !exists {
+		return fmt.Errorf("IP %s not found", ip)
+	}
+	heartbeat.draining = draining
+	s.data[ip] = heartbeat
+	return nil
+}
+
+// RecordLoad appends a load report to the server's history, dropping the oldest ones
+func (s *InMemoryStore) RecordLoad(ip string, load ServiceLoad) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	heartbeat, exists := s.data[ip]
+	if !exists {
+		return fmt.Errorf("IP %s not found", ip)
+	}
+	heartbeat.loadHistory = append(heartbeat.loadHistory, load)
+	heartbeat.reserved = 0 // The report counts them now
+	if len(heartbeat.loadHistory) > loadHistorySize {
+		heartbeat.loadHistory = heartbeat.loadHistory[len(heartbeat.loadHistory)-loadHistorySize:]
+	}
+	s.data[ip] = heartbeat
+	return nil
+}
+
+// GetLoadHistory retrieves the recent load reports of a server
+func (s *InMemoryStore) GetLoadHistory(ip string) ([]ServiceLoad, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	heartbeat, exists := s.data[ip]
+	if !exists {
+		return nil, fmt.Errorf("IP %s not found", ip)
+	}
+	return append([]ServiceLoad{}, heartbeat.loadHistory...), nil
+}
+
+// GetAllLoadHistory retrieves the recent load reports of every chat server which is up
+func (s *InMemoryStore) GetAllLoadHistory() (map[string][]ServiceLoad, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	history := make(map[string][]ServiceLoad)
+	for ip, heartbeat := range s.data {
+		if time.Since(heartbeat.lastHeartbeat) <= 10*time.Second {
+			history[ip] = append([]ServiceLoad{}, heartbeat.loadHistory...)
+		}
+	}
+	return history, nil
+}
+
+// ReadDraining retrieves the ips of all chat servers which are up but draining
+func (s *InMemoryStore) ReadDraining() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ips []string
+	for ip, heartbeat := range s.data {
+		if time.Since(heartbeat.lastHeartbeat) <= 10*time.Second && heartbeat.draining {
+			ips = append(ips, ip)
+		}
+	}
+
+	return ips, nil
+}
+
+// SetCapacity records the caps a chat server enforces
+func (s *InMemoryStore) SetCapacity(ip string, capacity ServiceCapacity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	heartbeat, exists := s.data[ip]
+	if !exists {
+		return fmt.Errorf("IP %s not found", ip)
+	}
+	heartbeat.capacity = capacity
+	s.data[ip] = heartbeat
+	return nil
+}
+
+// SetRelay records whether a chat server relays rooms with the other chat servers
+func (s *InMemoryStore) SetRelay(ip string, relay bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	heartbeat, exists := s.data[ip]
+	if !exists {
+		return fmt.Errorf("IP %s not found", ip)
+	}
+	heartbeat.relay = relay
+	s.data[ip] = heartbeat
+	return nil
+}
+
+// HasRelay reports whether a chat server said it relays rooms with the other chat servers
+func (s *InMemoryStore) HasRelay(ip string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.data[ip].relay
+}
+
+/*
+ReserveCapacity counts the members of a room sent to each server against its capacity,
+until the server's next load report includes them. Either every server has room for its
+members and all of them are reserved, or nothing is and the first full server is
+returned. Checking and reserving under one lock keeps concurrent placements from
+overbooking a server.
+*/
+func (s *InMemoryStore) ReserveCapacity(demand map[string]int) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	servers := make([]string, 0, len(demand))
+	for ip := range demand {
+		servers = append(servers, ip)
+	}
+	sort.Strings(servers)
+	for _, ip := range servers {
+		if !s.hasCapacity(ip, demand[ip]) {
+			return ip, false
+		}
+	}
+	for ip, members := range demand {
+		heartbeat := s.data[ip]
+		heartbeat.reserved += members
+		s.data[ip] = heartbeat
+	}
+	return "", true
+}
+
+// hasCapacity reports whether a server would accept that many more members of a single room, s.mu must be held
+func (s *InMemoryStore) hasCapacity(ip string, members int) bool {
+	heartbeat, exists := s.data[ip]
+	if !exists {
+		return false
+	}
+	capacity := heartbeat.capacity
+	if capacity.MaxRoomMembers > 0 && members > capacity.MaxRoomMembers {
+		return false
+	}
+	if capacity.MaxConnections > 0 {
+		connections := heartbeat.reserved
+		if len(heartbeat.loadHistory) > 0 {
+			connections += heartbeat.loadHistory[len(heartbeat.loadHistory)-1].Connections
+		}
+		if connections+members > capacity.MaxConnections {
+			return false
+		}
+	}
+	return true
+}
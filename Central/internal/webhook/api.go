@@ -0,0 +1,131 @@
+package webhook
+
+import (
+	"central/internal/operator"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+API for registering webhooks, for operators only: webhooks make Central call any URL and
+hear about every room. A webhook's secret is returned once, when it is created, either as
+given in the request or generated by Central.
+*/
+type WebhookAPI struct {
+	store Store
+	token string // Operator token, the routes are refused without one
+}
+
+func NewWebhookAPI(store Store, token string) *WebhookAPI {
+	return &WebhookAPI{store: store, token: token}
+}
+
+func (api *WebhookAPI) RegisterRoutes(router *gin.Engine) {
+	group := router.Group("/webhooks", operator.Authenticate(api.token))
+	{
+		group.POST("", api.CreateWebhook)
+		group.GET("", api.GetWebhooks)
+		group.GET("/:id", api.GetWebhook)
+		group.DELETE("/:id", api.DeleteWebhook)
+		group.GET("/:id/deliveries", api.GetDeliveries)
+	}
+}
+
+// WebhookRequest represents the payload for registering a webhook.
+type WebhookRequest struct {
+	URL    string   `json:"url" binding:"required"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+// CreateWebhook registers a webhook (POST).
+func (api *WebhookAPI) CreateWebhook(c *gin.Context) {
+	var req WebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
+		return
+	}
+
+	target, err := url.Parse(req.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Webhook URL must be an absolute http or https URL"})
+		return
+	}
+	for _, event := range req.Events {
+		if !isEvent(event) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown event " + event, "events": Events})
+			return
+		}
+	}
+	if req.Secret == "" {
+		req.Secret = newID()
+	}
+
+	webhook := Webhook{
+		ID:        newID(),
+		URL:       req.URL,
+		Events:    req.Events,
+		Secret:    req.Secret,
+		CreatedAt: time.Now(),
+	}
+	if err := api.store.Create(webhook); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Webhook registered", "webhook": webhook, "secret": webhook.Secret})
+}
+
+// GetWebhooks lists the registered webhooks, without their secrets (GET).
+func (api *WebhookAPI) GetWebhooks(c *gin.Context) {
+	webhooks, err := api.store.ReadAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"webhooks": webhooks})
+}
+
+func (api *WebhookAPI) GetWebhook(c *gin.Context) {
+	webhook, err := api.store.Read(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"webhook": webhook})
+}
+
+func (api *WebhookAPI) DeleteWebhook(c *gin.Context) {
+	id := c.Param("id")
+	if err := api.store.Delete(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted", "id": id})
+}
+
+// GetDeliveries returns the delivery log of a webhook, oldest first (GET).
+func (api *WebhookAPI) GetDeliveries(c *gin.Context) {
+	deliveries, err := api.store.GetDeliveries(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
+
+func isEvent(event string) bool {
+	for _, known := range Events {
+		if known == event {
+			return true
+		}
+	}
+	return false
+}
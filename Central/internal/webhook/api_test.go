@@ -0,0 +1,112 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestRouter(token string) (*gin.Engine, *InMemoryStore) {
+	gin.SetMode(gin.TestMode)
+	store := newInMemoryStore()
+	router := gin.New()
+	NewWebhookAPI(store, token).RegisterRoutes(router)
+	return router, store
+}
+
+func serve(router *gin.Engine, method, path, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestRoutesRequireOperatorToken(t *testing.T) {
+	router, _ := newTestRouter("op-token")
+	create := `{"url": "http://example.com/hook"}`
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{"no token", http.Header{}, http.StatusUnauthorized},
+		{"wrong token", http.Header{"X-Operator-Token": {"nope"}}, http.StatusUnauthorized},
+		{"header", http.Header{"X-Operator-Token": {"op-token"}}, http.StatusCreated},
+		{"bearer", http.Header{"Authorization": {"Bearer op-token"}}, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serve(router, http.MethodPost, "/webhooks", create, tt.header).Code; got != tt.want {
+				t.Errorf("POST /webhooks = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	for _, route := range []struct{ method, path string }{
+		{http.MethodGet, "/webhooks"},
+		{http.MethodGet, "/webhooks/x"},
+		{http.MethodDelete, "/webhooks/x"},
+		{http.MethodGet, "/webhooks/x/deliveries"},
+	} {
+		if got := serve(router, route.method, route.path, "", http.Header{}).Code; got != http.StatusUnauthorized {
+			t.Errorf("%s %s without a token = %d, want %d", route.method, route.path, got, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestRoutesDisabledWithoutToken(t *testing.T) {
+	router, _ := newTestRouter("")
+	header := http.Header{"X-Operator-Token": {""}}
+	if got := serve(router, http.MethodGet, "/webhooks", "", header).Code; got != http.StatusServiceUnavailable {
+		t.Errorf("GET /webhooks = %d, want %d", got, http.StatusServiceUnavailable)
+	}
+}
+
+func TestCreateAndList(t *testing.T) {
+	router, store := newTestRouter("op-token")
+	header := http.Header{"X-Operator-Token": {"op-token"}}
+
+	bad := []string{
+		`{"url": "ftp://example.com"}`,
+		`{"url": "/relative"}`,
+		`{"url": "http://example.com", "events": ["nope"]}`,
+	}
+	for _, body := range bad {
+		if got := serve(router, http.MethodPost, "/webhooks", body, header).Code; got != http.StatusBadRequest {
+			t.Errorf("POST %s = %d, want %d", body, got, http.StatusBadRequest)
+		}
+	}
+
+	created := serve(router, http.MethodPost, "/webhooks", `{"url": "https://example.com/hook", "events": ["match"], "secret": "s3cret"}`, header)
+	var response struct {
+		Webhook Webhook `json:"webhook"`
+		Secret  string  `json:"secret"`
+	}
+	json.Unmarshal(created.Body.Bytes(), &response)
+	if created.Code != http.StatusCreated || response.Secret != "s3cret" || response.Webhook.ID == "" {
+		t.Fatalf("POST /webhooks = %d %s", created.Code, created.Body)
+	}
+	if stored, _ := store.Read(response.Webhook.ID); stored.Secret != "s3cret" {
+		t.Errorf("stored secret = %q", stored.Secret)
+	}
+
+	// Secrets are only shown once
+	listed := serve(router, http.MethodGet, "/webhooks", "", header)
+	if listed.Code != http.StatusOK || strings.Contains(listed.Body.String(), "s3cret") {
+		t.Errorf("GET /webhooks = %d %s, want the webhooks without their secrets", listed.Code, listed.Body)
+	}
+
+	if got := serve(router, http.MethodDelete, "/webhooks/"+response.Webhook.ID, "", header).Code; got != http.StatusOK {
+		t.Errorf("DELETE = %d, want %d", got, http.StatusOK)
+	}
+	if got := serve(router, http.MethodGet, "/webhooks/"+response.Webhook.ID+"/deliveries", "", header).Code; got != http.StatusNotFound {
+		t.Errorf("deliveries of a deleted webhook = %d, want %d", got, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,187 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Events Central publishes
+const (
+	EventMatch        = "match"         // Two users agreed to chat
+	EventRoomCreated  = "room.created"  // A room was placed on chat servers
+	EventRoomRerouted = "room.rerouted" // Members of a room were moved to other chat servers
+	EventRoomClosed   = "room.closed"   // A room was removed from Central
+)
+
+// Events lists every event a webhook can subscribe to
+var Events = []string{EventMatch, EventRoomCreated, EventRoomRerouted, EventRoomClosed}
+
+// Publisher is notified of the events other parts of Central want to share
+type Publisher interface {
+	Publish(event string, data interface{})
+}
+
+// Discard is a Publisher dropping every event, for when webhooks are not set up
+type Discard struct{}
+
+func (Discard) Publish(event string, data interface{}) {}
+
+// Event is the payload POSTed to webhooks
+type Event struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// RoomEvent is the data of every event, with the fields that apply to it
+type RoomEvent struct {
+	RoomId  string            `json:"roomId"`
+	Users   []string          `json:"users,omitempty"`
+	Home    string            `json:"home,omitempty"`    // Server minimizing the worst latency of all members
+	Members map[string]string `json:"members,omitempty"` // Username -> chat server the member is connected to
+	Score   float32           `json:"score,omitempty"`   // Worst cost of the members at Home, in ms
+	Moved   []string          `json:"moved,omitempty"`   // Members sent to another server, for room.rerouted
+	Reason  string            `json:"reason,omitempty"`  // Why the room closed, for room.closed
+}
+
+// Retry schedule of a delivery, the delay doubles after every failed attempt
+const (
+	maxAttempts     = 6
+	initialBackoff  = time.Second
+	maxBackoff      = time.Minute
+	deliveryTimeout = 10 * time.Second
+	queueSize       = 256
+)
+
+/*
+Dispatcher delivers events to the webhooks subscribed to them, in the background so
+matchmaking never waits on a slow endpoint. Every request carries the event in the
+X-Webhook-Event header and an HMAC-SHA256 of the body, keyed with the webhook's secret,
+in X-Webhook-Signature as "sha256=<hex>". Failed deliveries are retried with exponential
+backoff, every attempt is recorded in the delivery log.
+*/
+type Dispatcher struct {
+	store   Store
+	queue   chan Event
+	client  *http.Client
+	backoff time.Duration // Before the first retry
+}
+
+func NewDispatcher(store Store) *Dispatcher {
+	return &Dispatcher{
+		store:   store,
+		queue:   make(chan Event, queueSize),
+		client:  &http.Client{Timeout: deliveryTimeout},
+		backoff: initialBackoff,
+	}
+}
+
+// Start fans queued events out to the webhooks
+func (d *Dispatcher) Start() {
+	for event := range d.queue {
+		webhooks, err := d.store.ReadAll()
+		if err != nil {
+			log.Printf("Failed to read webhooks: %v\n", err)
+			continue
+		}
+		for _, webhook := range webhooks {
+			if webhook.Subscribed(event.Type) {
+				go d.deliver(webhook, event)
+			}
+		}
+	}
+}
+
+// Publish queues an event for delivery, dropping it if the queue is full
+func (d *Dispatcher) Publish(event string, data interface{}) {
+	select {
+	case d.queue <- Event{ID: newID(), Type: event, Timestamp: time.Now(), Data: data}:
+	default:
+		log.Printf("Webhook queue is full, dropping %s event\n", event)
+	}
+}
+
+// deliver sends an event to a webhook until it succeeds or runs out of attempts
+func (d *Dispatcher) deliver(webhook Webhook, event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v\n", event.Type, err)
+		return
+	}
+
+	backoff := d.backoff
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		delivery := Delivery{
+			WebhookID: webhook.ID,
+			EventID:   event.ID,
+			Event:     event.Type,
+			Attempt:   attempt,
+			Timestamp: time.Now(),
+		}
+		statusCode, err := d.send(webhook, event, body)
+		delivery.StatusCode = statusCode
+		if err != nil {
+			delivery.Error = err.Error()
+		} else {
+			delivery.Success = true
+		}
+
+		// A deleted webhook stops being retried
+		if err := d.store.RecordDelivery(delivery); err != nil || delivery.Success {
+			return
+		}
+		if attempt < maxAttempts {
+			time.Sleep(backoff)
+			backoff = min(backoff*2, maxBackoff)
+		}
+	}
+	log.Printf("Giving up on delivering %s event %s to %s\n", event.Type, event.ID, webhook.URL)
+}
+
+// send POSTs a signed event to a webhook, any status outside 2xx is a failure
+func (d *Dispatcher) send(webhook Webhook, event Event, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", event.Type)
+	req.Header.Set("X-Webhook-Id", event.ID)
+	req.Header.Set("X-Webhook-Signature", "sha256="+Sign(webhook.Secret, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign returns the hex HMAC-SHA256 of a payload, receivers compare it to X-Webhook-Signature
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newID returns a random identifier for webhooks, events and secrets
+func newID() string {
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		panic("Failed to generate cryptographically secure random string")
+	}
+	return hex.EncodeToString(randomBytes)
+}
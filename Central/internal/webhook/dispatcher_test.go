@@ -0,0 +1,236 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is a webhook endpoint answering with the given statuses in turn, then 200
+type receiver struct {
+	server   *httptest.Server
+	statuses []int
+	mu       sync.Mutex
+	requests []received
+	arrived  chan struct{}
+}
+
+type received struct {
+	header http.Header
+	body   []byte
+	time   time.Time
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	rc := &receiver{statuses: statuses, arrived: make(chan struct{}, 16)}
+	rc.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rc.mu.Lock()
+		status := http.StatusOK
+		if len(rc.requests) < len(rc.statuses) {
+			status = rc.statuses[len(rc.requests)]
+		}
+		rc.requests = append(rc.requests, received{header: r.Header.Clone(), body: body, time: time.Now()})
+		rc.mu.Unlock()
+		w.WriteHeader(status)
+		rc.arrived <- struct{}{}
+	}))
+	t.Cleanup(rc.server.Close)
+	return rc
+}
+
+// await waits for n requests to arrive
+func (rc *receiver) await(t *testing.T, n int) []received {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-rc.arrived:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %d requests, want %d", i, n)
+		}
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]received{}, rc.requests...)
+}
+
+func newTestDispatcher(t *testing.T, webhooks ...Webhook) (*Dispatcher, *InMemoryStore) {
+	store := newInMemoryStore()
+	for _, webhook := range webhooks {
+		if err := store.Create(webhook); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dispatcher := NewDispatcher(store)
+	dispatcher.backoff = 10 * time.Millisecond
+	return dispatcher, store
+}
+
+func TestDeliverySignature(t *testing.T) {
+	rc := newReceiver(t)
+	dispatcher, _ := newTestDispatcher(t, Webhook{ID: "w1", URL: rc.server.URL, Secret: "s3cret"})
+	go dispatcher.Start()
+	defer close(dispatcher.queue)
+
+	dispatcher.Publish(EventRoomCreated, RoomEvent{RoomId: "room1", Users: []string{"alice", "bob"}})
+	request := rc.await(t, 1)[0]
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(request.body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := request.header.Get("X-Webhook-Signature"); got != want {
+		t.Errorf("X-Webhook-Signature = %q, want %q", got, want)
+	}
+	if got := request.header.Get("X-Webhook-Event"); got != EventRoomCreated {
+		t.Errorf("X-Webhook-Event = %q, want %q", got, EventRoomCreated)
+	}
+
+	var event struct {
+		ID   string    `json:"id"`
+		Type string    `json:"type"`
+		Data RoomEvent `json:"data"`
+	}
+	if err := json.Unmarshal(request.body, &event); err != nil {
+		t.Fatalf("invalid payload: %v", err)
+	}
+	if event.Type != EventRoomCreated || event.Data.RoomId != "room1" {
+		t.Errorf("payload = %+v, want a room.created event of room1", event)
+	}
+	if got := request.header.Get("X-Webhook-Id"); got != event.ID {
+		t.Errorf("X-Webhook-Id = %q, want the event ID %q", got, event.ID)
+	}
+}
+
+func TestEventFiltering(t *testing.T) {
+	matches := newReceiver(t)
+	closed := newReceiver(t)
+	everything := newReceiver(t)
+	dispatcher, store := newTestDispatcher(t,
+		Webhook{ID: "matches", URL: matches.server.URL, Events: []string{EventMatch}},
+		Webhook{ID: "closed", URL: closed.server.URL, Events: []string{EventRoomClosed}},
+		Webhook{ID: "everything", URL: everything.server.URL},
+	)
+	go dispatcher.Start()
+	defer close(dispatcher.queue)
+
+	dispatcher.Publish(EventMatch, RoomEvent{RoomId: "room1"})
+	dispatcher.Publish(EventRoomRerouted, RoomEvent{RoomId: "room1"})
+
+	if got := matches.await(t, 1)[0].header.Get("X-Webhook-Event"); got != EventMatch {
+		t.Errorf("match webhook got %q", got)
+	}
+	everything.await(t, 2)
+
+	// Both events went out, the room.closed webhook must not have heard of either
+	time.Sleep(50 * time.Millisecond)
+	if deliveries, _ := store.GetDeliveries("closed"); len(deliveries) != 0 {
+		t.Errorf("room.closed webhook got %d deliveries, want none", len(deliveries))
+	}
+	if deliveries, _ := store.GetDeliveries("matches"); len(deliveries) != 1 {
+		t.Errorf("match webhook got %d deliveries, want 1", len(deliveries))
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	rc := newReceiver(t, http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusMovedPermanently)
+	webhook := Webhook{ID: "w1", URL: rc.server.URL, Secret: "s3cret"}
+	dispatcher, store := newTestDispatcher(t, webhook)
+
+	dispatcher.deliver(webhook, Event{ID: "e1", Type: EventMatch, Timestamp: time.Now()})
+	requests := rc.await(t, 4)
+
+	// The delay doubles after every failure
+	for i := 1; i < len(requests); i++ {
+		gap := requests[i].time.Sub(requests[i-1].time)
+		want := dispatcher.backoff << (i - 1)
+		if gap < want {
+			t.Errorf("retry %d came after %v, want at least %v", i, gap, want)
+		}
+	}
+
+	deliveries, err := store.GetDeliveries("w1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := []int{500, 503, 301, 200}
+	if len(deliveries) != len(statuses) {
+		t.Fatalf("got %d deliveries, want %d", len(deliveries), len(statuses))
+	}
+	for i, delivery := range deliveries {
+		success := i == len(statuses)-1
+		if delivery.Attempt != i+1 || delivery.StatusCode != statuses[i] || delivery.Success != success || delivery.EventID != "e1" {
+			t.Errorf("delivery %d = %+v, want attempt %d with status %d, success %v", i, delivery, i+1, statuses[i], success)
+		}
+		if !success && delivery.Error == "" {
+			t.Errorf("failed delivery %d has no error", i)
+		}
+	}
+}
+
+func TestGivingUp(t *testing.T) {
+	statuses := make([]int, maxAttempts+1)
+	for i := range statuses {
+		statuses[i] = http.StatusBadGateway
+	}
+	rc := newReceiver(t, statuses...)
+	webhook := Webhook{ID: "w1", URL: rc.server.URL}
+	dispatcher, store := newTestDispatcher(t, webhook)
+	dispatcher.backoff = time.Millisecond
+
+	dispatcher.deliver(webhook, Event{ID: "e1", Type: EventMatch})
+	deliveries, _ := store.GetDeliveries("w1")
+	if len(deliveries) != maxAttempts {
+		t.Fatalf("got %d deliveries, want %d", len(deliveries), maxAttempts)
+	}
+	if last := deliveries[len(deliveries)-1]; last.Success || last.Attempt != maxAttempts {
+		t.Errorf("last delivery = %+v, want failed attempt %d", last, maxAttempts)
+	}
+}
+
+func TestDeletedWebhookStopsRetrying(t *testing.T) {
+	rc := newReceiver(t, http.StatusInternalServerError, http.StatusInternalServerError)
+	webhook := Webhook{ID: "w1", URL: rc.server.URL}
+	dispatcher, store := newTestDispatcher(t, webhook)
+	store.Delete("w1")
+
+	dispatcher.deliver(webhook, Event{ID: "e1", Type: EventMatch})
+	if got := len(rc.await(t, 1)); got != 1 {
+		t.Errorf("got %d attempts, want 1", got)
+	}
+}
+
+func TestDeliveryLog(t *testing.T) {
+	store := newInMemoryStore()
+	store.Create(Webhook{ID: "w1"})
+
+	for i := 1; i <= deliveryLogSize+20; i++ {
+		if err := store.RecordDelivery(Delivery{WebhookID: "w1", Attempt: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deliveries, err := store.GetDeliveries("w1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != deliveryLogSize {
+		t.Fatalf("log keeps %d deliveries, want %d", len(deliveries), deliveryLogSize)
+	}
+	if first, last := deliveries[0].Attempt, deliveries[len(deliveries)-1].Attempt; first != 21 || last != deliveryLogSize+20 {
+		t.Errorf("log runs from %d to %d, want the latest deliveries, oldest first", first, last)
+	}
+
+	if err := store.RecordDelivery(Delivery{WebhookID: "unknown"}); err == nil {
+		t.Error("recorded a delivery of an unknown webhook")
+	}
+	store.Delete("w1")
+	if _, err := store.GetDeliveries("w1"); err == nil {
+		t.Error("deleted webhook still has a delivery log")
+	}
+}
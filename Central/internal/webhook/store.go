@@ -0,0 +1,151 @@
+package webhook
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Store is an interface to define how webhooks and their deliveries are stored.
+type Store interface {
+	Create(webhook Webhook) error
+	Read(id string) (Webhook, error)
+	ReadAll() ([]Webhook, error)
+	Delete(id string) error
+	RecordDelivery(delivery Delivery) error
+	GetDeliveries(webhookId string) ([]Delivery, error)
+}
+
+// Number of deliveries kept per webhook
+const deliveryLogSize = 100
+
+// Webhook is an HTTP endpoint notified of the events it subscribed to, all of them if Events is empty
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"-"` // Key of the payload signatures, only shown when the webhook is created
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Delivery is an attempt at sending an event to a webhook
+type Delivery struct {
+	WebhookID  string    `json:"webhookId"`
+	EventID    string    `json:"eventId"`
+	Event      string    `json:"event"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Success    bool      `json:"success"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// Subscribed reports whether the webhook wants an event
+func (w Webhook) Subscribed(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, subscribed := range w.Events {
+		if subscribed == event {
+			return true
+		}
+	}
+	return false
+}
+
+// InMemoryStore is a thread-safe implementation of the Store interface.
+type InMemoryStore struct {
+	webhooks   map[string]Webhook
+	deliveries map[string][]Delivery // webhook ID --> most recent deliveries
+	mu         sync.RWMutex
+}
+
+var (
+	instance *InMemoryStore
+	once     sync.Once
+)
+
+// GetInMemoryStore returns the singleton instance of InMemoryStore.
+func GetInMemoryStore() *InMemoryStore {
+	once.Do(func() {
+		instance = newInMemoryStore()
+	})
+	return instance
+}
+
+func newInMemoryStore() *InMemoryStore {
+	return &InMemoryStore{
+		webhooks:   make(map[string]Webhook),
+		deliveries: make(map[string][]Delivery),
+	}
+}
+
+func (s *InMemoryStore) Create(webhook Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.webhooks[webhook.ID]; exists {
+		return fmt.Errorf("webhook %s already exists", webhook.ID)
+	}
+	s.webhooks[webhook.ID] = webhook
+	return nil
+}
+
+func (s *InMemoryStore) Read(id string) (Webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	webhook, exists := s.webhooks[id]
+	if !exists {
+		return Webhook{}, fmt.Errorf("webhook %s not found", id)
+	}
+	return webhook, nil
+}
+
+func (s *InMemoryStore) ReadAll() ([]Webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	webhooks := []Webhook{}
+	for _, webhook := range s.webhooks {
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
+
+func (s *InMemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.webhooks[id]; !exists {
+		return fmt.Errorf("webhook %s not found", id)
+	}
+	delete(s.webhooks, id)
+	delete(s.deliveries, id)
+	return nil
+}
+
+func (s *InMemoryStore) RecordDelivery(delivery Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.webhooks[delivery.WebhookID]; !exists {
+		return fmt.Errorf("webhook %s not found", delivery.WebhookID)
+	}
+	deliveries := append(s.deliveries[delivery.WebhookID], delivery)
+	if len(deliveries) > deliveryLogSize {
+		deliveries = deliveries[len(deliveries)-deliveryLogSize:]
+	}
+	s.deliveries[delivery.WebhookID] = deliveries
+	return nil
+}
+
+func (s *InMemoryStore) GetDeliveries(webhookId string) ([]Delivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, exists := s.webhooks[webhookId]; !exists {
+		return nil, fmt.Errorf("webhook %s not found", webhookId)
+	}
+	return append([]Delivery{}, s.deliveries[webhookId]...), nil
+}
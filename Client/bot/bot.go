@@ -0,0 +1,242 @@
+/*
+Package bot runs automated chat participants. A bot registers with Central like any
+user, reports its latencies so rooms are placed the same way, and handles one room at
+a time through callbacks, which run one at a time in the order of the events, off the
+goroutine reading them so they can call any method of the bot:
+
+	b, err := bot.New(bot.Config{Username: "echo", CentralURL: "http://localhost:8080"})
+	b.OnMessage(func(b *bot.Bot, message bot.Message) {
+		b.Say(message.Text)
+	})
+	err = b.Run(ctx)
+
+Like the TUI, a bot listens for requests and reroutes on the client ports, bots sharing
+a machine need their own, see Config.Options.
+*/
+package bot
+
+import (
+	"client/client"
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Message is a line another member sent to the bot's room
+type Message struct {
+	RoomId string
+	From   string
+	Text   string
+}
+
+// Config describes a bot to Central and decides who it talks to
+type Config struct {
+	Username    string
+	CentralURL  string
+	Description string                     // Listed in Central's directory, empty to stay unlisted
+	Accept      func(username string) bool // Filters chat requests, nil accepts everyone
+	Options     []client.Option            // Passed on to client.New, e.g. the ports to listen on
+}
+
+type Bot struct {
+	config    Config
+	client    *client.Client
+	onMessage []func(b *Bot, message Message)
+	onJoin    []func(b *Bot, roomId, with string)
+	roomId    string        // Current room, empty when free for a new chat
+	joining   bool          // Accepting a request, the room isn't known yet
+	calls     []func()      // Callbacks waiting to run, unbounded so reading events never waits on them
+	queued    chan struct{} // Signals the callback goroutine that calls were added
+	mu        sync.Mutex
+}
+
+func New(config Config) (*Bot, error) {
+	c, err := client.New(config.CentralURL, config.Username, config.Options...)
+	if err != nil {
+		return nil, err
+	}
+	return &Bot{config: config, client: c, queued: make(chan struct{}, 1)}, nil
+}
+
+// OnMessage adds a callback for every message other members send to the bot's room
+func (b *Bot) OnMessage(handler func(b *Bot, message Message)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onMessage = append(b.onMessage, handler)
+}
+
+// OnJoin adds a callback for when the bot joins a room with another user
+func (b *Bot) OnJoin(handler func(b *Bot, roomId, with string)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onJoin = append(b.onJoin, handler)
+}
+
+// Username returns the name the bot is registered under
+func (b *Bot) Username() string {
+	return b.config.Username
+}
+
+// Say sends a message to the bot's current room, with newlines replaced by spaces
+func (b *Bot) Say(text string) error {
+	return b.client.Send(b.currentRoom(), text)
+}
+
+// Leave disconnects from the current room, the bot can then accept another chat
+func (b *Bot) Leave() error {
+	return b.client.Leave(b.currentRoom())
+}
+
+func (b *Bot) currentRoom() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.roomId
+}
+
+// Run starts the bot and serves chat requests until ctx is done, then deregisters it
+func (b *Bot) Run(ctx context.Context) error {
+	if err := b.Start(ctx); err != nil {
+		return err
+	}
+	<-b.client.Done()
+	return nil
+}
+
+/*
+Start registers the bot with Central and serves chat requests in the background until
+ctx is done. Requests are declined while the bot is in a room or when Config.Accept
+refuses them.
+*/
+func (b *Bot) Start(ctx context.Context) error {
+	if err := b.client.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start %s: %w", b.config.Username, err)
+	}
+	if b.config.Description != "" {
+		if err := b.client.Advertise(b.config.Description); err != nil {
+			return err
+		}
+	}
+	go b.serve(ctx)
+	go b.runCallbacks(ctx)
+	return nil
+}
+
+// Request asks a user to chat and joins the room once they accept
+func (b *Bot) Request(ctx context.Context, username string) error {
+	if !b.reserve() {
+		return fmt.Errorf("already in a chat")
+	}
+	_, err := b.client.Request(ctx, username)
+	if err != nil {
+		b.release()
+	}
+	return err
+}
+
+// serve handles the client's events until ctx is done
+func (b *Bot) serve(ctx context.Context) {
+	for {
+		select {
+		case event := <-b.client.Events():
+			b.handle(ctx, event)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *Bot) handle(ctx context.Context, event client.Event) {
+	switch event := event.(type) {
+	case client.RequestReceived:
+		if (b.config.Accept != nil && !b.config.Accept(event.From)) || !b.reserve() {
+			b.client.Decline(event.From)
+			return
+		}
+		go func() {
+			if _, err := b.client.Accept(ctx, event.From); err != nil {
+				fmt.Printf("Failed to accept chat request from %s: %v\n", event.From, err)
+				b.release()
+			}
+		}()
+
+	case client.Matched:
+		b.mu.Lock()
+		b.roomId, b.joining = event.Room.ID, false
+		onJoin := append([]func(b *Bot, roomId, with string){}, b.onJoin...)
+		b.mu.Unlock()
+		b.enqueue(func() {
+			for _, handler := range onJoin {
+				handler(b, event.Room.ID, event.Room.With)
+			}
+		})
+
+	case client.MessageReceived:
+		// Notices from the server and our own messages coming back are not for the handlers
+		if event.Notice || event.From == "" || event.From == b.config.Username {
+			return
+		}
+		b.dispatch(Message{RoomId: event.RoomID, From: event.From, Text: event.Text})
+
+	case client.Left:
+		// Also when Central closed the room, e.g. because the other member left
+		b.release()
+	}
+}
+
+func (b *Bot) dispatch(message Message) {
+	b.mu.Lock()
+	handlers := append([]func(b *Bot, message Message){}, b.onMessage...)
+	b.mu.Unlock()
+	b.enqueue(func() {
+		for _, handler := range handlers {
+			handler(b, message)
+		}
+	})
+}
+
+// enqueue adds a callback for runCallbacks, without waiting
+func (b *Bot) enqueue(call func()) {
+	b.mu.Lock()
+	b.calls = append(b.calls, call)
+	b.mu.Unlock()
+	select {
+	case b.queued <- struct{}{}:
+	default: // Already signalled
+	}
+}
+
+// runCallbacks runs the queued callbacks in order until ctx is done
+func (b *Bot) runCallbacks(ctx context.Context) {
+	for {
+		select {
+		case <-b.queued:
+		case <-ctx.Done():
+			return
+		}
+		b.mu.Lock()
+		calls := b.calls
+		b.calls = nil
+		b.mu.Unlock()
+		for _, call := range calls {
+			call()
+		}
+	}
+}
+
+// reserve claims the bot for a new chat, false when it is busy
+func (b *Bot) reserve() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.roomId != "" || b.joining {
+		return false
+	}
+	b.joining = true
+	return true
+}
+
+// release frees the bot for a new chat
+func (b *Bot) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roomId, b.joining = "", false
+}
@@ -0,0 +1,188 @@
+/*
+Package cli is the non-interactive client, for scripts and debugging from a shell.
+`register` runs a session in the foreground; the other subcommands talk to it over a
+unix socket and print JSON:
+
+	client register -name alice &
+	client listen -name alice > events.jsonl &
+	client request -name alice bob
+	client send -name alice <room> "hello"
+	client leave -name alice <room>
+
+Every subcommand prints one JSON object, `listen` one per event. Errors are printed as
+{"error": "..."} and exit with status 1.
+*/
+package cli
+
+import (
+	"bufio"
+	"client/client"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+)
+
+const usage = `Usage: client <command> -name <username> [flags] [args]
+
+Commands:
+  register                 Register with Central and serve the other commands, until interrupted.
+                           Use -request-port 0 -reroute-port 0 to run several clients on a machine
+  servers                  Chat servers and their measured latency, jitter and loss
+  request <user>           Ask user to chat, and join the room once they accept
+  accept <user>            Accept the chat request of user, and join the room
+  decline [user]           Decline the chat request of user, or all pending requests
+  rooms                    The rooms the session is in
+  send <room> <message>    Send a message to the room
+  plaintext <room>         Send the room's messages without encryption, for peers that can't encrypt
+  listen                   Stream events as JSON lines, until interrupted
+  leave [room]             Leave the room, or all rooms
+  history [room]           The rooms in the chat history, or the messages of one
+  search <words>           Messages in the chat history containing all words
+  diagnostics [room]       Latency to each server, where Central placed the rooms, or one
+                           room, and the reroutes of the session
+  contacts                 The contacts kept by Central, online, offline or in-chat
+  add-contact <user>       Add user to the contacts, they are notified
+  remove-contact <user>    Remove user from the contacts
+
+The chat history is kept with -history <dir>, encrypted with the passphrase in
+the CHAT_HISTORY_PASSPHRASE environment variable.
+
+Without a command the interactive client starts.
+`
+
+// Run runs the subcommand in args and returns the exit status
+func Run(args []string) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	name := args[0]
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	username := flags.String("name", os.Getenv("CHAT_USERNAME"), "Username of the session")
+	centralURL := flags.String("central", "", "URL of the Central server, read from "+client.ConfigFile+" by default")
+	control := flags.String("control", "", "Control socket of the session, in the temporary directory by default")
+	requestPort := flags.Int("request-port", 3001, "Port to listen on for chat requests, 0 picks a free one (register)")
+	reroutePort := flags.Int("reroute-port", 3003, "Port to listen on for reroutes, 0 picks a free one (register)")
+	historyDir := flags.String("history", "", "Directory of the chat history, none is kept by default (register)")
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if *username == "" {
+		return fail(fmt.Errorf("-name is required"))
+	}
+	if *control == "" {
+		*control = filepath.Join(os.TempDir(), fmt.Sprintf("chat-client-%s.sock", *username))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	switch name {
+	case "register":
+		if *centralURL == "" {
+			url, err := client.ReadConfig(client.ConfigFile)
+			if err != nil {
+				return fail(err)
+			}
+			*centralURL = url
+		}
+		opts := []client.Option{client.WithRequestPort(*requestPort), client.WithReroutePort(*reroutePort)}
+		if *historyDir != "" {
+			opts = append(opts, client.WithHistory(*historyDir, os.Getenv("CHAT_HISTORY_PASSPHRASE")))
+		}
+		c, err := client.New(*centralURL, *username, opts...)
+		if err != nil {
+			return fail(err)
+		}
+		if err := runSession(ctx, c, *control); err != nil {
+			return fail(err)
+		}
+		return 0
+
+	case "listen":
+		return stream(ctx, *control)
+
+	case "servers", "request", "accept", "decline", "rooms", "send", "plaintext", "leave", "history", "search",
+		"diagnostics", "contacts", "add-contact", "remove-contact":
+		return call(*control, command{Command: name, Args: flags.Args()})
+	}
+	fmt.Fprint(os.Stderr, usage)
+	return 2
+}
+
+// call sends a command to the session and prints its reply
+func call(path string, cmd command) int {
+	conn, err := dialSession(path)
+	if err != nil {
+		return fail(err)
+	}
+	defer conn.Close()
+	if err := writeJSON(conn, cmd); err != nil {
+		return fail(err)
+	}
+
+	var reply map[string]interface{}
+	if err := json.NewDecoder(conn).Decode(&reply); err != nil {
+		return fail(fmt.Errorf("no reply from the session: %w", err))
+	}
+	writeJSON(os.Stdout, reply)
+	if _, failed := reply["error"]; failed {
+		return 1
+	}
+	return 0
+}
+
+// stream prints the session's events until ctx is done or the session stops
+func stream(ctx context.Context, path string) int {
+	conn, err := dialSession(path)
+	if err != nil {
+		return fail(err)
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	if err := writeJSON(conn, command{Command: "listen"}); err != nil {
+		return fail(err)
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fmt.Println(scanner.Text())
+	}
+	return 0
+}
+
+func dialSession(path string) (net.Conn, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("no session running, start one with register: %w", err)
+	}
+	return conn, nil
+}
+
+// fail prints err as JSON and returns the exit status for errors
+func fail(err error) int {
+	writeJSON(os.Stdout, errorReply(err))
+	return 1
+}
+
+// writeJSON writes value as a single line of JSON
+func writeJSON(w io.Writer, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,100 @@
+package cli
+
+import (
+	"client/client"
+	"time"
+)
+
+// encodeRoom describes a room for the JSON output
+func encodeRoom(room client.Room) map[string]interface{} {
+	return map[string]interface{}{"id": room.ID, "server": room.Server, "with": room.With, "reconnecting": room.Reconnecting}
+}
+
+// encodeHistory describes entries of the chat history for the JSON output
+func encodeHistory(entries []client.HistoryEntry) []interface{} {
+	encoded := []interface{}{}
+	for _, entry := range entries {
+		encoded = append(encoded, map[string]interface{}{
+			"room":    entry.RoomID,
+			"with":    entry.With,
+			"time":    entry.Time.Format(time.RFC3339Nano),
+			"kind":    entry.Kind,
+			"sender":  entry.Sender,
+			"message": entry.Message,
+		})
+	}
+	return encoded
+}
+
+// encodeEvent describes a client event for the JSON output, with its kind in "type"
+func encodeEvent(event client.Event) map[string]interface{} {
+	switch event := event.(type) {
+	case client.RequestReceived:
+		return map[string]interface{}{"type": "request", "from": event.From, "time": event.Received.Format(time.RFC3339Nano)}
+	case client.RequestCancelled:
+		return map[string]interface{}{"type": "request_cancelled", "from": event.From, "expired": event.Expired}
+	case client.RequestProgress:
+		return map[string]interface{}{"type": "progress", "to": event.To, "status": event.Status}
+	case client.Matched:
+		return map[string]interface{}{"type": "matched", "room": encodeRoom(event.Room)}
+	case client.MessageReceived:
+		return map[string]interface{}{
+			"type":   "message",
+			"room":   event.RoomID,
+			"from":   event.From,
+			"text":   event.Text,
+			"notice": event.Notice,
+			"time":   event.Time.Format(time.RFC3339Nano),
+		}
+	case client.Rerouted:
+		return map[string]interface{}{"type": "rerouted", "room": event.RoomID, "server": event.Server}
+	case client.Reconnecting:
+		reconnecting := map[string]interface{}{
+			"type":    "reconnecting",
+			"room":    event.RoomID,
+			"attempt": event.Attempt,
+			"retry":   event.Retry.Seconds(),
+		}
+		if event.Err != nil {
+			reconnecting["error"] = event.Err.Error()
+		}
+		return reconnecting
+	case client.Reconnected:
+		return map[string]interface{}{"type": "reconnected", "room": encodeRoom(event.Room)}
+	case client.TransferUpdated:
+		transfer := map[string]interface{}{
+			"type":     "transfer",
+			"room":     event.Transfer.RoomID,
+			"id":       event.Transfer.ID,
+			"name":     event.Transfer.Name,
+			"from":     event.Transfer.From,
+			"size":     event.Transfer.Size,
+			"chunks":   event.Transfer.Chunks,
+			"done":     event.Transfer.Done,
+			"outgoing": event.Transfer.Outgoing,
+			"complete": event.Transfer.Complete,
+			"saved_to": event.Transfer.SavedTo,
+		}
+		if event.Transfer.Err != nil {
+			transfer["error"] = event.Transfer.Err.Error()
+		}
+		return transfer
+	case client.ContactsUpdated:
+		return map[string]interface{}{"type": "contacts", "contacts": event.Contacts}
+	case client.ContactAdded:
+		return map[string]interface{}{"type": "contact_added", "by": event.By}
+	case client.Left:
+		left := map[string]interface{}{"type": "left", "room": event.RoomID}
+		if event.Err != nil {
+			left["error"] = event.Err.Error()
+		}
+		return left
+	case client.ErrorEvent:
+		failure := map[string]interface{}{"type": "error", "error": event.Err.Error()}
+		if event.RoomID != "" {
+			failure["room"] = event.RoomID
+		}
+		return failure
+	}
+	return map[string]interface{}{"type": "unknown"}
+}
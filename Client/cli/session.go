@@ -0,0 +1,315 @@
+package cli
+
+import (
+	"bufio"
+	"client/client"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// command is a line the subcommands send to the session over its control socket
+type command struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+/*
+session is the registered client behind the subcommands. `register` runs it in the
+foreground, the other subcommands connect to its control socket, send a command and
+print the reply. `listen` connections get the client's events as they happen.
+*/
+type session struct {
+	client    *client.Client
+	ctx       context.Context
+	lock      sync.Mutex
+	listeners map[chan map[string]interface{}]struct{}
+}
+
+// runSession registers c and serves the control socket at path until ctx is done
+func runSession(ctx context.Context, c *client.Client, path string) error {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("a session is already running on %s", path)
+	}
+	os.Remove(path) // Left behind by a session that didn't stop cleanly
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	defer os.Remove(path)
+	defer listener.Close()
+
+	if err := c.Start(ctx); err != nil {
+		return err
+	}
+	s := &session{client: c, ctx: ctx, listeners: make(map[chan map[string]interface{}]struct{})}
+	go s.publishEvents()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	requestPort, reroutePort := c.Ports()
+	writeJSON(os.Stdout, map[string]interface{}{
+		"type":        "registered",
+		"username":    c.Username(),
+		"control":     path,
+		"requestPort": requestPort,
+		"reroutePort": reroutePort,
+	})
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		go s.serve(conn)
+	}
+	<-c.Done()
+	return nil
+}
+
+// publishEvents passes the client's events on to the listen connections, dropping them for slow ones
+func (s *session) publishEvents() {
+	for {
+		select {
+		case event := <-s.client.Events():
+			encoded := encodeEvent(event)
+			s.lock.Lock()
+			for listener := range s.listeners {
+				select {
+				case listener <- encoded:
+				default:
+				}
+			}
+			s.lock.Unlock()
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// serve answers the command sent over conn
+func (s *session) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return
+	}
+	// Nothing else is sent, a read returning means the subcommand went away, e.g. interrupted
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	go func() {
+		reader.ReadByte()
+		cancel()
+	}()
+
+	var cmd command
+	if err := json.Unmarshal(line, &cmd); err != nil {
+		writeJSON(conn, errorReply(fmt.Errorf("invalid command: %w", err)))
+		return
+	}
+	if cmd.Command == "listen" {
+		s.listen(ctx, conn)
+		return
+	}
+	writeJSON(conn, s.handle(ctx, cmd))
+}
+
+// listen streams the events to conn until either side goes away
+func (s *session) listen(ctx context.Context, conn net.Conn) {
+	events := make(chan map[string]interface{}, 256)
+	s.lock.Lock()
+	s.listeners[events] = struct{}{}
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.listeners, events)
+		s.lock.Unlock()
+	}()
+
+	for {
+		select {
+		case event := <-events:
+			if err := writeJSON(conn, event); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *session) handle(ctx context.Context, cmd command) map[string]interface{} {
+	arg := func(i int) string {
+		if i < len(cmd.Args) {
+			return cmd.Args[i]
+		}
+		return ""
+	}
+
+	switch cmd.Command {
+	case "servers":
+		// Smoothed latencies in milliseconds, null for servers that didn't answer the last probes
+		servers := map[string]interface{}{}
+		for server, stats := range s.client.ServerStats() {
+			servers[server] = nil
+			if stats.Reachable() {
+				servers[server] = stats
+			}
+		}
+		return map[string]interface{}{"servers": servers}
+
+	case "request", "accept":
+		if arg(0) == "" {
+			return errorReply(fmt.Errorf("%s needs a username", cmd.Command))
+		}
+		var room client.Room
+		var err error
+		if cmd.Command == "request" {
+			room, err = s.client.Request(ctx, arg(0))
+		} else {
+			room, err = s.client.Accept(ctx, arg(0))
+		}
+		if err != nil {
+			return errorReply(err)
+		}
+		return map[string]interface{}{"room": encodeRoom(room)}
+
+	case "decline":
+		// Without a username every pending request is declined
+		usernames := []string{arg(0)}
+		if arg(0) == "" {
+			usernames = s.client.PendingRequests()
+		}
+		for _, username := range usernames {
+			if err := s.client.Decline(username); err != nil {
+				return errorReply(err)
+			}
+		}
+		return map[string]interface{}{"declined": usernames}
+
+	case "rooms":
+		rooms := []interface{}{}
+		for _, room := range s.client.Rooms() {
+			rooms = append(rooms, encodeRoom(room))
+		}
+		return map[string]interface{}{"rooms": rooms}
+
+	case "history":
+		if arg(0) == "" {
+			rooms, err := s.client.HistoryRooms()
+			if err != nil {
+				return errorReply(err)
+			}
+			encoded := []interface{}{}
+			for _, room := range rooms {
+				encoded = append(encoded, map[string]interface{}{
+					"id":      room.ID,
+					"with":    room.With,
+					"first":   room.First.Format(time.RFC3339Nano),
+					"last":    room.Last.Format(time.RFC3339Nano),
+					"entries": room.Entries,
+				})
+			}
+			return map[string]interface{}{"rooms": encoded}
+		}
+		entries, err := s.client.History(arg(0))
+		if err != nil {
+			return errorReply(err)
+		}
+		return map[string]interface{}{"room": arg(0), "entries": encodeHistory(entries)}
+
+	case "search":
+		entries, err := s.client.SearchHistory(strings.Join(cmd.Args, " "))
+		if err != nil {
+			return errorReply(err)
+		}
+		return map[string]interface{}{"entries": encodeHistory(entries)}
+
+	case "diagnostics":
+		servers := map[string]interface{}{}
+		for server, stats := range s.client.ServerStats() {
+			encoded := map[string]interface{}{"stats": stats, "last_probe": nil}
+			if !stats.LastProbe.IsZero() {
+				encoded["last_probe"] = stats.LastProbe.Format(time.RFC3339Nano)
+			}
+			servers[server] = encoded
+		}
+		// Without a room, where every room the session is in was placed
+		roomIds := []string{arg(0)}
+		if arg(0) == "" {
+			roomIds = []string{}
+			for _, room := range s.client.Rooms() {
+				roomIds = append(roomIds, room.ID)
+			}
+		}
+		placements := []interface{}{}
+		for _, roomId := range roomIds {
+			placement, err := s.client.Placement(roomId)
+			if err != nil {
+				return errorReply(err)
+			}
+			placements = append(placements, placement)
+		}
+		return map[string]interface{}{"servers": servers, "placements": placements, "reroutes": s.client.Reroutes()}
+
+	case "contacts":
+		return map[string]interface{}{"contacts": s.client.Contacts()}
+
+	case "add-contact", "remove-contact":
+		if arg(0) == "" {
+			return errorReply(fmt.Errorf("%s needs a username", cmd.Command))
+		}
+		var err error
+		if cmd.Command == "add-contact" {
+			err = s.client.AddContact(arg(0))
+		} else {
+			err = s.client.RemoveContact(arg(0))
+		}
+		if err != nil {
+			return errorReply(err)
+		}
+		return map[string]interface{}{"contacts": s.client.Contacts()}
+
+	case "send":
+		if err := s.client.Send(arg(0), arg(1)); err != nil {
+			return errorReply(err)
+		}
+		return map[string]interface{}{"sent": arg(1), "room": arg(0)}
+
+	case "plaintext":
+		if err := s.client.AllowPlaintext(arg(0)); err != nil {
+			return errorReply(err)
+		}
+		return map[string]interface{}{"plaintext": arg(0)}
+
+	case "leave":
+		// Without a room every room is left
+		roomIds := []string{arg(0)}
+		if arg(0) == "" {
+			roomIds = []string{}
+			for _, room := range s.client.Rooms() {
+				roomIds = append(roomIds, room.ID)
+			}
+		}
+		for _, roomId := range roomIds {
+			if err := s.client.Leave(roomId); err != nil {
+				return errorReply(err)
+			}
+		}
+		return map[string]interface{}{"left": roomIds}
+	}
+	return errorReply(fmt.Errorf("unknown command %s", cmd.Command))
+}
+
+func errorReply(err error) map[string]interface{} {
+	return map[string]interface{}{"error": err.Error()}
+}
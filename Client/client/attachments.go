@@ -0,0 +1,479 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files are sent into the room in chunks, see the chat server's attachments.go for the protocol
+const (
+	fileCommandPrefix = "/file "
+	fileChunkSize     = 16 * 1024
+	fileChunkInterval = 50 * time.Millisecond // Leaves room for chat messages between chunks
+	maxFileSize       = 10 * 1024 * 1024
+
+	encryptedFilePrefix = "e" // Marks the IDs of files sealed with the room key
+
+	transferStallTimeout = time.Minute // Incoming files that make no progress for this long fail
+	maxSaveAttempts      = 100         // Names tried when saving a file, "name (1).ext" and so on
+)
+
+// Transfer is a file being sent or received in a room
+type Transfer struct {
+	ID       string
+	RoomID   string
+	Name     string
+	From     string
+	Size     int64
+	Checksum string
+	Chunks   int
+	Done     int  // Chunks sent through the server, or received
+	Outgoing bool // Whether we are the sender
+	Complete bool
+	Accepted bool   // Recipient asked to save the file
+	SavedTo  string // Where the file was saved, once complete and accepted
+	Err      error
+
+	data     *os.File  // Received chunks, until the file is saved
+	progress time.Time // Last time a chunk came in
+}
+
+// Progress returns how much of the file went through, between 0 and 1
+func (t Transfer) Progress() float64 {
+	if t.Chunks == 0 {
+		return 1
+	}
+	return float64(t.Done) / float64(t.Chunks)
+}
+
+// SendFile offers a file to a room and uploads it in the background
+func (c *Client) SendFile(roomId, path string) error {
+	r, err := c.room(roomId)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	if info.Size() > maxFileSize {
+		return fmt.Errorf("file is too large, the limit is %d bytes", maxFileSize)
+	}
+
+	// Like messages, files are only sent in plain text once the user allowed it
+	if !c.hasRoomKey(r) && !c.Unencrypted(roomId) {
+		return ErrNotEncrypted
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+
+	idBytes := make([]byte, 4)
+	rand.Read(idBytes)
+	transfer := &Transfer{
+		ID:       hex.EncodeToString(idBytes),
+		RoomID:   roomId,
+		Name:     filepath.Base(path),
+		From:     c.username,
+		Size:     info.Size(),
+		Checksum: hex.EncodeToString(hash.Sum(nil)),
+		Chunks:   int((info.Size() + fileChunkSize - 1) / fileChunkSize),
+		Outgoing: true,
+	}
+
+	// With a room key, the name, checksum and chunks are sealed and the server sees sizes only
+	offer := fmt.Sprintf("%soffer %s %d %s %d %s", fileCommandPrefix,
+		transfer.ID, transfer.Size, transfer.Checksum, transfer.Chunks, transfer.Name)
+	encrypted := false
+	if c.hasRoomKey(r) {
+		encrypted = true
+		transfer.ID = encryptedFilePrefix + transfer.ID
+		metadata, _ := c.seal(r, []byte(transfer.Checksum+" "+transfer.Name), transfer.ID)
+		offer = fmt.Sprintf("%soffer %s %d %s %d -", fileCommandPrefix, transfer.ID,
+			transfer.Size+int64(transfer.Chunks*encryptionOverhead), metadata, transfer.Chunks)
+	}
+	r.transferLock.Lock()
+	r.transfers[transfer.ID] = transfer
+	r.transferLock.Unlock()
+
+	if err := c.sendLine(r, offer); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to offer file: %w", err)
+	}
+
+	// Upload in the background, chunks interleave with the room's messages
+	go func() {
+		defer file.Close()
+		file.Seek(0, io.SeekStart)
+		buf := make([]byte, fileChunkSize)
+		for index := 0; index < transfer.Chunks; index++ {
+			r.transferLock.Lock()
+			failed := transfer.Err != nil
+			r.transferLock.Unlock()
+			if failed {
+				return // Cancelled, by the server too if it refused a chunk
+			}
+			n, err := io.ReadFull(file, buf)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				c.sendLine(r, fmt.Sprintf("%scancel %s", fileCommandPrefix, transfer.ID))
+				c.updateTransfer(r, transfer, func(t *Transfer) { t.Err = err })
+				return
+			}
+			data := base64.StdEncoding.EncodeToString(buf[:n])
+			if encrypted {
+				data, _ = c.seal(r, buf[:n], fmt.Sprintf("%s#%d", transfer.ID, index))
+			}
+			c.sendLine(r, fmt.Sprintf("%schunk %s %d %s", fileCommandPrefix, transfer.ID, index, data))
+			time.Sleep(fileChunkInterval)
+		}
+	}()
+	return nil
+}
+
+// AcceptFile saves a file received in a room to the downloads directory, as soon as it is complete
+func (c *Client) AcceptFile(roomId, id string) error {
+	r, err := c.room(roomId)
+	if err != nil {
+		return err
+	}
+	r.transferLock.Lock()
+	transfer, ok := r.transfers[id]
+	r.transferLock.Unlock()
+	if !ok || transfer.Outgoing {
+		return fmt.Errorf("no incoming file with id %s", id)
+	}
+
+	c.updateTransfer(r, transfer, func(t *Transfer) {
+		t.Accepted = true
+		if t.Complete {
+			t.save(c.options.downloadDir)
+		}
+	})
+	return nil
+}
+
+// updateTransfer changes a transfer under the lock and publishes its new state
+func (c *Client) updateTransfer(r *chatRoom, transfer *Transfer, update func(t *Transfer)) {
+	r.transferLock.Lock()
+	update(transfer)
+	snapshot := *transfer
+	r.transferLock.Unlock()
+	c.emit(TransferUpdated{Transfer: snapshot})
+}
+
+/*
+handleFileMessage processes a file transfer line relayed by the chat server, returning
+the text to show in the chat instead, if any. Our own lines come back from the server too,
+they tell us how far our upload got.
+*/
+func (c *Client) handleFileMessage(r *chatRoom, line string) (string, bool) {
+	sender, payload, found := strings.Cut(line, ": ")
+	if !found || !strings.HasPrefix(payload, fileCommandPrefix) {
+		return "", false
+	}
+	fields := strings.Fields(payload)
+	if len(fields) < 3 {
+		return "", true
+	}
+	command, id := fields[1], fields[2]
+
+	r.transferLock.Lock()
+	transfer, exists := r.transfers[id]
+	r.transferLock.Unlock()
+
+	switch {
+	// Nothing follows the offer of an empty file
+	case command == "offer" && sender == c.username && exists && transfer.Chunks == 0:
+		return c.completeTransfer(r, transfer), true
+
+	case command == "offer" && sender != c.username && len(fields) >= 7:
+		size, _ := strconv.ParseInt(fields[3], 10, 64)
+		chunks, _ := strconv.Atoi(fields[5])
+		checksum, name := fields[4], strings.Join(fields[6:], " ")
+		var err error
+		if strings.HasPrefix(id, encryptedFilePrefix) {
+			size -= int64(chunks * encryptionOverhead)
+			checksum, name, err = c.openFileMetadata(r, id, checksum)
+		}
+		name, nameErr := fileName(name)
+		if err == nil {
+			err = nameErr
+		}
+		data, createErr := os.CreateTemp("", "chat-file-*")
+		if err == nil {
+			err = createErr
+		}
+		transfer = &Transfer{
+			ID:       id,
+			RoomID:   r.id,
+			Name:     name,
+			From:     sender,
+			Size:     size,
+			Checksum: checksum,
+			Chunks:   chunks,
+			Err:      err,
+			data:     data,
+			progress: time.Now(),
+		}
+		r.transferLock.Lock()
+		r.transfers[id] = transfer
+		r.transferLock.Unlock()
+		c.updateTransfer(r, transfer, func(t *Transfer) {
+			if t.Err != nil {
+				t.discard()
+			}
+		})
+		if err != nil {
+			return fmt.Sprintf("* Failed to receive a file from %s: %v", sender, err), true
+		}
+		offered := fmt.Sprintf("* %s is sending %s (%s), type /save %s to save it", sender, transfer.Name, formatSize(size), id)
+		if chunks == 0 {
+			c.deliver(r, offered)
+			return c.completeTransfer(r, transfer), true
+		}
+		if err == nil {
+			go c.watchTransfer(r, transfer)
+		}
+		return offered, true
+
+	case command == "chunk" && exists && len(fields) == 5:
+		finished := false
+		c.updateTransfer(r, transfer, func(t *Transfer) {
+			if t.Outgoing {
+				t.Done++
+				finished = t.Done == t.Chunks
+				return
+			}
+			if t.Err != nil || t.Done == t.Chunks {
+				return
+			}
+			// The server relays chunks in order, a gap means part of the file is lost
+			if index, err := strconv.Atoi(fields[3]); err != nil || index != t.Done {
+				t.Err = fmt.Errorf("chunk %d missing", t.Done)
+				t.discard()
+				return
+			}
+			t.Done++
+			t.progress = time.Now()
+			t.appendChunk(c.openChunk(r, t.ID, fields[3], fields[4]))
+			finished = t.Done == t.Chunks
+		})
+		if finished {
+			return c.completeTransfer(r, transfer), true
+		}
+
+	case command == "cancel" && exists:
+		c.updateTransfer(r, transfer, func(t *Transfer) {
+			t.Err = fmt.Errorf("cancelled by %s", sender)
+			t.discard()
+		})
+		return fmt.Sprintf("* %s cancelled %s", sender, transfer.Name), true
+	}
+	return "", true
+}
+
+/*
+fileName reduces the name a peer sent to a file name which stays in the downloads
+directory, rejecting names that are a directory or nothing at all.
+*/
+func fileName(name string) (string, error) {
+	base := filepath.Base(strings.TrimSpace(name))
+	if base == "." || base == ".." || base == string(filepath.Separator) {
+		return "file", fmt.Errorf("invalid file name %q", name)
+	}
+	return base, nil
+}
+
+// openFileMetadata decrypts the checksum and name of an encrypted file offer
+func (c *Client) openFileMetadata(r *chatRoom, id string, sealed string) (string, string, error) {
+	metadata, err := c.open(r, sealed, id)
+	if err != nil {
+		return "", "encrypted file", fmt.Errorf("failed to decrypt file: %w", err)
+	}
+	checksum, name, _ := strings.Cut(string(metadata), " ")
+	return checksum, name, nil
+}
+
+// openChunk decodes the data of a received chunk, decrypting it for encrypted files
+func (c *Client) openChunk(r *chatRoom, id string, index string, data string) ([]byte, error) {
+	if strings.HasPrefix(id, encryptedFilePrefix) {
+		return c.open(r, data, id+"#"+index)
+	}
+	return base64.StdEncoding.DecodeString(data)
+}
+
+/*
+watchTransfer fails an incoming transfer that stops making progress, the sender may be
+gone without cancelling it. Its chunks are thrown away.
+*/
+func (c *Client) watchTransfer(r *chatRoom, transfer *Transfer) {
+	ticker := time.NewTicker(transferStallTimeout / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.transferLock.Lock()
+		done := transfer.Err != nil || transfer.Complete
+		stalled := !done && time.Since(transfer.progress) > transferStallTimeout
+		r.transferLock.Unlock()
+		if done {
+			return
+		}
+		if stalled {
+			c.updateTransfer(r, transfer, func(t *Transfer) {
+				t.Err = fmt.Errorf("stalled, nothing received for %s", transferStallTimeout)
+				t.discard()
+			})
+			c.deliver(r, fmt.Sprintf("* Failed to receive %s: stalled", transfer.Name))
+			return
+		}
+	}
+}
+
+// discardTransfers throws away the files still being received in a room, once it is left
+func (c *Client) discardTransfers(r *chatRoom) {
+	r.transferLock.Lock()
+	defer r.transferLock.Unlock()
+	for _, transfer := range r.transfers {
+		if transfer.Err == nil && !transfer.Complete {
+			transfer.Err = fmt.Errorf("left the room")
+		}
+		if transfer.SavedTo == "" {
+			transfer.discard()
+		}
+	}
+}
+
+// discard removes the temporary file of a received transfer, transferLock must be held
+func (t *Transfer) discard() {
+	if t.data == nil {
+		return
+	}
+	t.data.Close()
+	os.Remove(t.data.Name())
+	t.data = nil
+}
+
+// appendChunk writes a received chunk to the temporary file, transferLock must be held
+func (t *Transfer) appendChunk(chunk []byte, err error) {
+	if err != nil {
+		t.Err = fmt.Errorf("invalid chunk: %w", err)
+		return
+	}
+	if _, err := t.data.Write(chunk); err != nil {
+		t.Err = err
+	}
+}
+
+// completeTransfer verifies a finished transfer and saves it if it was accepted
+func (c *Client) completeTransfer(r *chatRoom, transfer *Transfer) string {
+	if transfer.Outgoing {
+		c.updateTransfer(r, transfer, func(t *Transfer) { t.Complete = true })
+		return fmt.Sprintf("* Sent %s", transfer.Name)
+	}
+
+	// What to tell is read under the lock, the user can accept the file meanwhile
+	var err error
+	savedTo := ""
+	c.updateTransfer(r, transfer, func(t *Transfer) {
+		defer func() { err, savedTo = t.Err, t.SavedTo }()
+		if t.Err != nil {
+			t.discard()
+			return
+		}
+		hash := sha256.New()
+		t.data.Seek(0, io.SeekStart)
+		io.Copy(hash, t.data)
+		if hex.EncodeToString(hash.Sum(nil)) != t.Checksum {
+			t.Err = fmt.Errorf("checksum mismatch")
+			t.discard()
+			return
+		}
+		t.Complete = true
+		if t.Accepted {
+			t.save(c.options.downloadDir)
+		}
+	})
+
+	if err != nil {
+		return fmt.Sprintf("* Failed to receive %s: %v", transfer.Name, err)
+	}
+	if savedTo != "" {
+		return fmt.Sprintf("* Saved %s to %s", transfer.Name, savedTo)
+	}
+	return fmt.Sprintf("* Received %s, type /save %s to save it", transfer.Name, transfer.ID)
+}
+
+/*
+save moves a complete file to dir, transferLock must be held. Files already there are
+kept, the new one gets a " (n)" suffix instead.
+*/
+func (t *Transfer) save(dir string) {
+	if t.SavedTo != "" {
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Err = err
+		return
+	}
+	out, err := createUnique(dir, t.Name)
+	if err != nil {
+		t.Err = err
+		return
+	}
+	defer out.Close()
+
+	t.data.Seek(0, io.SeekStart)
+	if _, err := io.Copy(out, t.data); err != nil {
+		t.Err = err
+		os.Remove(out.Name())
+		return
+	}
+	t.SavedTo = out.Name()
+	t.discard()
+}
+
+// createUnique creates a new file named name in dir, or "name (n).ext" when name is taken
+func createUnique(dir, name string) (*os.File, error) {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	if stem == "" {
+		stem, ext = name, "" // ".profile (1)"
+	}
+	target := filepath.Join(dir, name)
+	for n := 1; n <= maxSaveAttempts; n++ {
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !errors.Is(err, fs.ErrExist) {
+			return out, err
+		}
+		target = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", stem, n, ext))
+	}
+	return nil, fmt.Errorf("%s and %d more files of that name already exist", name, maxSaveAttempts)
+}
+
+// formatSize formats a byte count for humans
+func formatSize(size int64) string {
+	switch {
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
+	case size >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(size)/1024)
+	}
+	return fmt.Sprintf("%d B", size)
+}
@@ -1,494 +1,442 @@
+/*
+Package client talks to Central and the chat servers on behalf of a user. Programs
+create a Client, start it, and react to its events:
+
+	c, err := client.New("http://localhost:8080", "alice")
+	if err != nil { ... }
+	if err := c.Start(ctx); err != nil { ... }
+	go c.Request(ctx, "bob")
+	for event := range c.Events() {
+		switch event := event.(type) {
+		case client.MessageReceived:
+			fmt.Println(event)
+		}
+	}
+
+Central dials the client back for chat requests and reroutes, on ports 3001 and 3003
+by default. Clients sharing a machine need their own, see WithRequestPort.
+*/
 package client
 
 import (
 	"bytes"
 	"client/service"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"math"
 	"net"
 	"net/http"
-	"os"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
 )
 
 type Client struct {
-	UserName              string
-	CentralURL            string
-	serverRegistryAPI     service.ServerRegistryAPI
-	ServerRegistry        map[string]float32
-	messageRequestChannel chan string
-	ChatRequests          map[string]net.Conn
-	currentChatConn       net.Conn
-	CurrentChatServer     string
-	currentRoomId         string
+	username    string
+	centralURL  string
+	matchmaking string // Address of Central's matchmaking server
+	options     options
+	registry    service.ServerRegistryAPI
+	events      chan Event
+	done        chan struct{} // Closed once Start's context is done and the client shut down
+
+	lock     sync.Mutex // Guards the fields below and those of the rooms
+	ctx      context.Context
+	stats    map[string]ServerStats  // Latency to each chat server, see latency.go
+	requests map[string]*chatRequest // Pending chat requests, by username, see matchmaking.go
+	rooms    map[string]*chatRoom    // Rooms the client is in, by ID, see room.go
+	contacts []Contact               // As of the last refresh, see contacts.go
+	reroutes []Reroute               // Of every room since the client started, see diagnostics.go
+
+	history *historyStore // Nil unless the client keeps a history, see history.go
 }
 
-var lock = &sync.Mutex{}
-var chatLock = &sync.Mutex{}
-var clientInstance *Client
-
 var (
-	ACK_CONN       = "ACK"
-	MSG_REQ_SENT   = "REQ_SENT"
-	AWAITING_REQ   = "AWAITING_REQ"
-	USER_NOT_FOUND = "USER_NOT_FOUND"
-	SERVER_ERROR   = "SERVER_ERROR"
-	ACCEPT_REQ     = "ACCEPT_REQ"
+	ErrUsernameTaken   = errors.New("username is already taken")
+	ErrNotRegistered   = errors.New("not registered with Central")
+	ErrUnavailable     = errors.New("user is not available or declined")
+	ErrMatchmaking     = errors.New("matchmaking failed")
+	ErrExpired         = errors.New("chat request expired without an answer")
+	ErrNoHistory       = errors.New("the client keeps no chat history")
+	ErrWrongPassphrase = errors.New("wrong passphrase for the chat history")
+	ErrHistoryTampered = errors.New("the chat history was tampered with")
+	ErrNotInRoom       = errors.New("not in a room")
+	ErrNotEncrypted    = errors.New("encryption is not set up yet, wait for the other member's key or allow plain text")
+	ErrReconnecting    = errors.New("connection to the chat server lost, reconnecting")
+	ErrRoomClosed      = errors.New("the room was closed, by the other member or an operator")
 )
 
-func (c *Client) SendMessage(message string) {
-	if c.currentChatConn == nil {
-		fmt.Println("No chat connection established")
-		return
-	}
-	chatLock.Lock()
-	_, err := c.currentChatConn.Write([]byte(message + "\n"))
-	chatLock.Unlock()
-	if err != nil {
-		fmt.Printf("Failed to send message: %v\n", err)
-	}
+// Ports of Central's matchmaking server and of the chat servers
+const (
+	matchmakingPort = "8081"
+	chatPort        = "3002"
+	pingPort        = "3000"
+)
+
+type options struct {
+	pingInterval     time.Duration
+	downloadDir      string
+	eventBuffer      int
+	requestPort      int
+	reroutePort      int
+	reconnectTimeout time.Duration
+	historyDir       string
+	passphrase       string
 }
 
-// StartChat connects to the server and handles sending and receiving messages.
-func (c *Client) StartChat(messages chan string, serverAddress string, roomId string) {
-	// Connect to the server
-	conn, err := net.Dial("tcp", serverAddress+":3002")
+// Option configures a Client, see New
+type Option func(*options)
+
+// WithPingInterval sets how often the chat servers are pinged and the latencies reported to Central
+func WithPingInterval(interval time.Duration) Option {
+	return func(o *options) { o.pingInterval = interval }
+}
+
+// WithDownloadDir sets where received files and transcripts are saved
+func WithDownloadDir(dir string) Option {
+	return func(o *options) { o.downloadDir = dir }
+}
+
+// WithRequestPort sets the port to listen on for chat requests, 0 picks a free one
+func WithRequestPort(port int) Option {
+	return func(o *options) { o.requestPort = port }
+}
+
+// WithReroutePort sets the port to listen on for reroutes, 0 picks a free one
+func WithReroutePort(port int) Option {
+	return func(o *options) { o.reroutePort = port }
+}
+
+// WithReconnectTimeout sets how long the client tries to get back into a room after losing its connection, 0 gives up right away
+func WithReconnectTimeout(timeout time.Duration) Option {
+	return func(o *options) { o.reconnectTimeout = timeout }
+}
+
+// WithHistory keeps the messages of every room in dir, encrypted with a key derived from passphrase
+func WithHistory(dir, passphrase string) Option {
+	return func(o *options) { o.historyDir, o.passphrase = dir, passphrase }
+}
+
+// WithEventBuffer sets how many events are buffered before the client waits for the reader
+func WithEventBuffer(size int) Option {
+	return func(o *options) { o.eventBuffer = size }
+}
+
+// New creates a client for username, talking to the Central server at centralURL
+func New(centralURL, username string, opts ...Option) (*Client, error) {
+	if username == "" {
+		return nil, fmt.Errorf("username is required")
+	}
+	if centralURL == "" {
+		return nil, fmt.Errorf("central URL is required")
+	}
+	centralURL = strings.TrimSuffix(centralURL, "/")
+	matchmaking, err := matchmakingAddress(centralURL)
 	if err != nil {
-		fmt.Printf("Failed to connect to server at %s: %v\n", serverAddress, err)
-		return
+		return nil, err
 	}
 
-	chatLock.Lock()
-	c.currentChatConn = conn
-	c.CurrentChatServer = serverAddress
-	c.currentRoomId = roomId
-	chatLock.Unlock()
-	// Send the room ID to the server
-	_, err = conn.Write([]byte(fmt.Sprintf("%s#%s\n", c.UserName, roomId)))
-	if err != nil {
-		fmt.Printf("Failed to send room ID: %v\n", err)
-		return
+	o := options{
+		pingInterval:     3 * time.Second,
+		downloadDir:      "downloads",
+		eventBuffer:      64,
+		requestPort:      3001,
+		reroutePort:      3003,
+		reconnectTimeout: 2 * time.Minute,
 	}
-	messages <- "START_CHAT"
-	// Listen for messages from the server
-	serverMessages, err := net.Listen("tcp", ":3003")
-	if err != nil {
-		messages <- "FAILED"
-		return
+	for _, opt := range opts {
+		opt(&o)
 	}
-	// Create a channel to handle new server connections
-	connChan := make(chan net.Conn)
+	return &Client{
+		username:    username,
+		centralURL:  centralURL,
+		matchmaking: matchmaking,
+		options:     o,
+		registry:    service.NewCentralServerRegistry(centralURL),
+		events:      make(chan Event, o.eventBuffer),
+		done:        make(chan struct{}),
+		ctx:         context.Background(),
+		stats:       make(map[string]ServerStats),
+		requests:    make(map[string]*chatRequest),
+		rooms:       make(map[string]*chatRoom),
+	}, nil
+}
 
-	go func() {
-		// Goroutine to accept connections and send them to the channel
-		for {
-			conn, err := serverMessages.Accept()
-			if err != nil {
-				fmt.Printf("Failed to accept connection: %v\n", err)
-				continue
-			}
-			connChan <- conn
-		}
-	}()
+// Username returns the name the client registers under
+func (c *Client) Username() string {
+	return c.username
+}
 
-	go func() {
-		buffer := make([]byte, 1024)
-		incomplete := ""
-		for {
-			select {
-			case serverConn := <-connChan: // Handle new server connection
-				buf := make([]byte, 1024)
-				n, err := serverConn.Read(buf)
-				if err != nil {
-					fmt.Printf("Failed to read from server: %v\n", err)
-					continue
-				}
-				newServerAddress := strings.TrimSuffix(string(buf[:n]), "\n")
-				newConn, err := net.Dial("tcp", newServerAddress+":3002")
-				if err != nil {
-					fmt.Printf("Failed to connect to new server: %v\n", err)
-					continue
-				}
-				c.CurrentChatServer = newServerAddress
-				c.currentChatConn = newConn
-
-				// Send the room ID to the new server
-				_, err = c.currentChatConn.Write([]byte(fmt.Sprintf("%s#%s\n",
-					c.UserName,
-					c.currentRoomId)))
-				if err != nil {
-					fmt.Printf("Failed to send room ID: %v\n", err)
-				}
-
-			default: // Handle chat messages
-				n, err := c.currentChatConn.Read(buffer)
-				if err != nil {
-					// Handle the error and continue
-					continue
-				}
-				incomplete += string(buffer[:n])
-
-				// Split and process messages
-				messagesArr := splitMessages(&incomplete, '\n')
-				for _, msg := range messagesArr {
-					messages <- msg
-				}
-			}
-		}
-	}()
+// Ports returns the ports the client listens on for chat requests and reroutes, once started
+func (c *Client) Ports() (int, int) {
+	return c.options.requestPort, c.options.reroutePort
 }
 
-// Utility to split messages based on a delimiter and handle leftover data
-func splitMessages(data *string, delimiter rune) []string {
-	parts := []string{}
-	lastIndex := 0
+/*
+Events returns the events of the client. They must be read: the client waits for the
+reader once the buffer is full, see WithEventBuffer. The channel is never closed, use
+the context passed to Start, or Done.
+*/
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
 
-	for i, char := range *data {
-		if char == delimiter {
-			parts = append(parts, (*data)[lastIndex:i])
-			lastIndex = i + 1
-		}
+// Done is closed once the context passed to Start is done and the client deregistered
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// emit publishes an event, giving up once the client stops
+func (c *Client) emit(event Event) {
+	select {
+	case c.events <- event:
+	case <-c.context().Done():
 	}
+}
 
-	// Keep any incomplete message
-	*data = (*data)[lastIndex:]
-	return parts
+func (c *Client) context() context.Context {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.ctx
 }
 
-func (c *Client) StartMatchmaking(username string, statusChannel chan string) error {
-	matchMakingPort := "8081"
-	matchMakingAddress := c.CentralURL[:len(c.CentralURL)-4] + matchMakingPort
-	matchMakingAddress = strings.Replace(matchMakingAddress, "http://", "", 1)
-	fmt.Println("Matchmaking address: ", matchMakingAddress)
-	conn, err := net.Dial("tcp", matchMakingAddress) // Establish a connection to the matchmaking server
+/*
+Start listens for chat requests and reroutes, registers with Central and starts measuring
+the latency to the chat servers. When ctx is done the client leaves its rooms, stops
+listening and deregisters.
+*/
+func (c *Client) Start(ctx context.Context) error {
+	if c.options.historyDir != "" {
+		history, err := openHistory(c.options.historyDir, c.username, c.options.passphrase)
+		if err != nil {
+			return err
+		}
+		c.history = history
+	}
+	requests, err := net.Listen("tcp", fmt.Sprintf(":%d", c.options.requestPort))
 	if err != nil {
-		statusChannel <- SERVER_ERROR
-		return fmt.Errorf("failed to connect to matchmaking server: %w", err)
+		c.closeHistory()
+		return fmt.Errorf("failed to listen for chat requests: %w", err)
 	}
-	defer conn.Close()
-
-	// Send initial message to the server
-	_, err = conn.Write([]byte(username))
+	reroutes, err := net.Listen("tcp", fmt.Sprintf(":%d", c.options.reroutePort))
 	if err != nil {
-		statusChannel <- SERVER_ERROR
-		return fmt.Errorf("failed to send initial message: %w", err)
+		requests.Close()
+		c.closeHistory()
+		return fmt.Errorf("failed to listen for reroutes: %w", err)
 	}
-
-	// Continuously read messages from the server
-	for {
-		buf := make([]byte, 1024)
-		n, err := conn.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				fmt.Println("Connection closed by server.")
-			} else {
-				fmt.Printf("Error reading from server: %v\n", err)
-			}
-			break
-		}
-
-		message := string(buf[:n])
-		// break up the messages by delimiter (newline)
-		messages := strings.Split(message, "\n")
-		for _, msg := range messages {
-			if msg == "" {
-				continue
-			}
-			statusChannel <- msg
-		}
+	stop := func() {
+		requests.Close()
+		reroutes.Close()
 	}
-	return nil
-}
 
-// PingServer pings a server and calculates the two-way delay.
-func pingServer(serverIP string) (float32, error) {
-	if serverIP == "::1" {
-		serverIP = "localhost"
+	// Central learns the ports actually bound, in case they were picked
+	c.options.requestPort = requests.Addr().(*net.TCPAddr).Port
+	c.options.reroutePort = reroutes.Addr().(*net.TCPAddr).Port
+	if err := c.register(ctx); err != nil {
+		stop()
+		c.closeHistory()
+		return err
 	}
-	start := time.Now()
-	conn, err := net.DialTimeout("tcp", serverIP+":3000", 2*time.Second) // Adjust the port and timeout as needed.
+	servers, err := c.registry.GetServers()
 	if err != nil {
-		return 0, fmt.Errorf("failed to ping server %s: %w", serverIP, err)
+		stop()
+		c.closeHistory()
+		c.deregister()
+		return fmt.Errorf("failed to initialize client: %w", err)
 	}
-	defer conn.Close()
 
-	delay := time.Since(start).Seconds() * 1000 // Convert to milliseconds
-	return float32(delay), nil
-}
+	c.lock.Lock()
+	c.ctx = ctx
+	for _, server := range servers {
+		c.stats[server] = ServerStats{Down: true} // Until probed
+	}
+	c.lock.Unlock()
 
-// StartPingJob starts a background job to ping servers and update the registry.
-func (c *Client) startPingJob(interval time.Duration) {
-	ticker := time.NewTicker(interval)
+	go c.listenForRequests(requests)
+	go c.listenForReroutes(reroutes)
+	go c.startPingJob(ctx)
+	go c.startContactsJob(ctx)
+	go c.startRoomsJob(ctx)
 	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				c.updateServerDelays()
-			}
-		}
+		<-ctx.Done()
+		stop()
+		c.leaveAll()
+		c.closeHistory()
+		c.deregister()
+		close(c.done)
 	}()
+	return nil
 }
 
-func (c *Client) reportDelaysToCentral() {
-	// Prepare the request payload
+// register sends the username and listener ports to the central server's register endpoint
+func (c *Client) register(ctx context.Context) error {
 	payload := map[string]interface{}{
-		"username": c.UserName,
-		"delays":   c.ServerRegistry,
+		"username":    c.username,
+		"requestPort": c.options.requestPort,
+		"reroutePort": c.options.reroutePort,
 	}
-
-	// Serialize the payload to JSON
 	jsonPayload, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Error serializing payload: %v", err)
-		return
+		return err
 	}
 
-	// Send the HTTP POST request to the central server
-	url := c.CentralURL + "/clients/delays"
-	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(jsonPayload))
+	req, err := http.NewRequestWithContext(ctx, "POST", c.centralURL+"/clients", bytes.NewBuffer(jsonPayload))
 	if err != nil {
-		log.Printf("Error creating request: %v", err)
-		return
+		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
-
-	// Execute the HTTP request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Printf("Error sending request to central server: %v", err)
-		return
+		return fmt.Errorf("failed to register: %w", err)
 	}
 	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return nil
+	case http.StatusConflict:
+		return ErrUsernameTaken
+	}
+	return fmt.Errorf("failed to register: %s", resp.Status)
 }
 
-// updateServerDelays updates the delay values in the ServerRegistry.
-func (c *Client) updateServerDelays() {
-	// Fetch all the servers again
-	servers, err := c.serverRegistryAPI.GetServers()
+// deregister removes the client from Central, which closes its rooms
+func (c *Client) deregister() {
+	req, err := http.NewRequest("DELETE", c.centralURL+"/clients?username="+url.QueryEscape(c.username), nil)
 	if err != nil {
 		return
 	}
+	httpClient := &http.Client{Timeout: 2 * time.Second}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Printf("Error deregistering from central server: %v", err)
+		return
+	}
+	resp.Body.Close()
+}
 
-	newServerMap := make(map[string]float32)
-	for _, server := range servers {
-		newServerMap[server] = math.MaxFloat32
+// Advertise lists the client in Central's directory with a description, for bots users can find
+func (c *Client) Advertise(description string) error {
+	payload := map[string]string{"username": c.username, "description": description}
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return err
 	}
-	c.ServerRegistry = newServerMap
 
-	for serverIP := range c.ServerRegistry {
-		delay, err := pingServer(serverIP)
-		if err != nil {
-			// the server is likely down, just set it to max float32
-			delay = math.MaxFloat32
-		}
+	resp, err := http.Post(c.centralURL+"/clients/directory", "application/json", bytes.NewBuffer(jsonPayload))
+	if err != nil {
+		return fmt.Errorf("failed to advertise: %w", err)
+	}
+	defer resp.Body.Close()
 
-		// Update the delay in the ServerRegistry
-		lock.Lock()
-		c.ServerRegistry[serverIP] = delay
-		lock.Unlock()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("failed to advertise: %s", resp.Status)
+	}
+	return nil
+}
 
-		//fmt.Printf("Updated delay for server %s: %.2f ms\n", serverIP, delay)
+// Servers returns the smoothed latency to each chat server in milliseconds, math.MaxFloat32 for unreachable ones
+func (c *Client) Servers() map[string]float32 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delays := make(map[string]float32, len(c.stats))
+	for server, stats := range c.stats {
+		delays[server] = stats.delay()
+	}
+	return delays
+}
 
-		// Putting this inside the loop so we can provide updated ping lists earlier
-		c.reportDelaysToCentral()
+// ServerStats returns the latency, jitter and loss measured to each chat server
+func (c *Client) ServerStats() map[string]ServerStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stats := make(map[string]ServerStats, len(c.stats))
+	for server, s := range c.stats {
+		stats[server] = s
 	}
+	return stats
 }
 
-func GetClient() *Client {
-	if clientInstance == nil {
-		lock.Lock()
-		defer lock.Unlock()
-		if clientInstance == nil {
-			// Basic initialization without network calls
-			url, err := readConfig("client/config.txt")
-			if err != nil {
-				fmt.Printf("Error reading config: %v\n", err)
-				return nil
-			}
-			clientInstance = &Client{
-				CentralURL:            url,
-				ServerRegistry:        make(map[string]float32), // Empty for now
-				serverRegistryAPI:     service.NewCentralServerRegistry(url),
-				messageRequestChannel: make(chan string),
-				ChatRequests:          make(map[string]net.Conn),
-			}
+// startPingJob pings the servers and updates the registry until ctx is done
+func (c *Client) startPingJob(ctx context.Context) {
+	ticker := time.NewTicker(c.options.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.updateServerDelays()
+		case <-ctx.Done():
+			return
 		}
 	}
-	return clientInstance
 }
 
-func (c *Client) AcceptMessageRequest(username string, statusChannel chan string) {
-	conn, exists := c.ChatRequests[username]
-	if !exists {
-		fmt.Println("FATAL: Could not find user in chat requests")
-		os.Exit(1) // blow up for now, get better error handling later.
-		return
+func (c *Client) reportDelaysToCentral() {
+	// Prepare the request payload, the plain delays for Central versions without stats
+	payload := map[string]interface{}{
+		"username": c.username,
+		"delays":   c.Servers(),
+		"stats":    c.ServerStats(),
 	}
 
-	// send a ACCEPT_REQ message to Central
-	_, err := conn.Write([]byte(ACCEPT_REQ + "\n"))
+	// Serialize the payload to JSON
+	jsonPayload, err := json.Marshal(payload)
 	if err != nil {
-		fmt.Printf("Failed to send ACCEPT_REQ message: %v\n", err)
-		os.Exit(1) // let's just blow up for now
+		log.Printf("Error serializing payload: %v", err)
+		return
 	}
-	statusChannel <- ACCEPT_REQ
 
-	// Wait for server to send you an chat server to connect to
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
+	// Send the HTTP PUT request to the central server
+	url := c.centralURL + "/clients/delays"
+	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(jsonPayload))
 	if err != nil {
-		fmt.Printf("Failed to read server: %v\n", err)
-		os.Exit(1) // let's just blow up for now
-	}
-	serverResponse := string(buf[:n])
-	if !strings.HasPrefix(serverResponse, "IP:") {
-		statusChannel <- SERVER_ERROR
+		log.Printf("Error creating request: %v", err)
 		return
 	}
-	// Split on newline
-	responseTokens := strings.Split(serverResponse, "\n")
-	serverAddress := responseTokens[0]
-	roomId := responseTokens[1]
-
-	serverAddress = strings.TrimPrefix(serverAddress, "IP:")
-	serverAddress = strings.TrimSuffix(serverAddress, "\n")
+	req.Header.Set("Content-Type", "application/json")
 
-	if !strings.HasPrefix(roomId, "RoomID:") {
-		statusChannel <- SERVER_ERROR
+	// Execute the HTTP request
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Error sending request to central server: %v", err)
 		return
 	}
-	roomId = strings.TrimPrefix(roomId, "RoomID:")
-	roomId = strings.TrimSuffix(roomId, "\n")
-	// remove new line
-
-	statusChannel <- serverAddress
-	statusChannel <- roomId
+	defer resp.Body.Close()
 }
 
-func handleChatRequest(conn net.Conn) {
-	// Read the username from the connection
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
+// updateServerDelays probes every server Central knows and folds the round into their stats
+func (c *Client) updateServerDelays() {
+	// Fetch all the servers again
+	servers, err := c.registry.GetServers()
 	if err != nil {
-		fmt.Printf("Failed to read from connection: %v\n", err)
-		os.Exit(1) // blow up for now
+		return
 	}
-	username := string(buf[:n])
-	clientInstance.ChatRequests[username] = conn
-}
 
-// Listen for message requests on port 3001
-func messageRequestListener() {
-	listener, err := net.Listen("tcp", ":3001")
-	if err != nil {
-		fmt.Println("failed to start message request listener: %w", err)
-		os.Exit(0)
-	}
-	defer listener.Close()
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			// just eat it for now
-			//fmt.Printf("Failed to accept connection: %v\n", err)
-			continue
+	// Keep what was measured to servers still listed, start over for the others
+	c.lock.Lock()
+	current := make(map[string]ServerStats, len(servers))
+	for _, server := range servers {
+		stats, exists := c.stats[server]
+		if !exists {
+			stats = ServerStats{Down: true}
 		}
-		go handleChatRequest(conn)
+		current[server] = stats
 	}
-}
+	c.stats = current
+	c.lock.Unlock()
 
-func (c *Client) Initialize() <-chan error {
-	// Create a channel to communicate the result
-	resultChan := make(chan error)
-	go messageRequestListener()
-	// Start the initialization in a goroutine
-	go func() {
-		// Create channels for server fetching
-		serverChan := make(chan []string)
-		errorChan := make(chan error)
-
-		// Fetch servers asynchronously
-		go func() {
-			servers, err := c.serverRegistryAPI.GetServers()
-			if err != nil {
-				errorChan <- fmt.Errorf("failed to initialize client: %w", err)
-				return
-			}
-			serverChan <- servers
-		}()
-
-		// Logic a bit sketchy
-		select {
-		case servers := <-serverChan:
-			for _, server := range servers {
-				c.ServerRegistry[server] = math.MaxFloat32
-			}
-			c.startPingJob(3 * time.Second)
-			resultChan <- nil
-		case err := <-errorChan:
-			resultChan <- err
-		}
+	for _, serverIP := range servers {
+		// Failed probes count as loss, a server that is down ends up with a loss of 1
+		samples := probeServer(serverIP)
 
-		// Close the result channel
-		close(resultChan)
-	}()
-
-	return resultChan
-}
-
-// ReadConfig reads the central server URL from a configuration file
-func readConfig(configFile string) (string, error) {
-	data, err := os.ReadFile(configFile)
-	if err != nil {
-		return "", fmt.Errorf("failed to read config file: %w", err)
-	}
+		c.lock.Lock()
+		c.stats[serverIP] = c.stats[serverIP].add(samples, probeSamples, time.Now())
+		c.lock.Unlock()
 
-	url := string(bytes.TrimSpace(data))
-	if url == "" {
-		return "", fmt.Errorf("config file is empty")
+		// Putting this inside the loop so we can provide updated ping lists earlier
+		c.reportDelaysToCentral()
 	}
-
-	return url, nil
-}
-
-// Register sends the username to the central server's register endpoint
-func (c *Client) Register() <-chan error {
-	result := make(chan error)
-	go func() {
-		defer close(result)
-
-		// Read the central server URL from the configuration file
-		url := c.CentralURL
-
-		// Prepare the request payload
-		payload := map[string]string{"username": c.UserName}
-		jsonPayload, err := json.Marshal(payload)
-		if err != nil {
-			//fmt.Printf("Error marshaling payload: %v\n", err)
-			result <- err
-			return
-		}
-
-		// Make the POST request to the central server
-		resp, err := http.Post(fmt.Sprintf("%s/clients", url), "application/json", bytes.NewBuffer(jsonPayload))
-		if err != nil {
-			//fmt.Printf("Error sending POST request: %v\n", err)
-			result <- err
-			return
-		}
-		defer resp.Body.Close()
-
-		// Handle the response
-		if resp.StatusCode != http.StatusCreated {
-			fmt.Println("\nPlease Register Using a unique username!")
-			os.Exit(1)
-		}
-		result <- nil
-	}()
-	return result
 }
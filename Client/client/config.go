@@ -0,0 +1,25 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// ConfigFile holds the URL of the Central server, relative to the client's directory
+const ConfigFile = "client/config.txt"
+
+// ReadConfig reads the central server URL from a configuration file
+func ReadConfig(configFile string) (string, error) {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	url := string(bytes.TrimSpace(data))
+	if url == "" {
+		return "", fmt.Errorf("config file is empty")
+	}
+
+	return url, nil
+}
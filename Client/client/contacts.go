@@ -0,0 +1,141 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Status of a contact, as Central sees them
+const (
+	ContactOnline  = "online"
+	ContactOffline = "offline"
+	ContactInChat  = "in-chat"
+)
+
+// Contact is a user in the client's contacts, kept by Central
+type Contact struct {
+	Username string `json:"username"`
+	Status   string `json:"status"` // ContactOnline, ContactOffline or ContactInChat
+}
+
+// contactsURL is where Central keeps the contacts of the client
+func (c *Client) contactsURL() string {
+	return c.centralURL + "/clients/" + url.PathEscape(c.username) + "/contacts"
+}
+
+// Contacts returns the contacts of the client by username, with their status as of the last refresh
+func (c *Client) Contacts() []Contact {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]Contact{}, c.contacts...)
+}
+
+// AddContact adds a registered user to the client's contacts, Central lets them know
+func (c *Client) AddContact(username string) error {
+	jsonPayload, err := json.Marshal(map[string]string{"contact": username})
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(c.contactsURL(), "application/json", bytes.NewBuffer(jsonPayload))
+	if err != nil {
+		return fmt.Errorf("failed to add contact: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("failed to add contact: %s", centralError(resp))
+	}
+	c.refreshContacts()
+	return nil
+}
+
+// RemoveContact removes a user from the client's contacts
+func (c *Client) RemoveContact(username string) error {
+	req, err := http.NewRequest("DELETE", c.contactsURL()+"/"+url.PathEscape(username), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to remove contact: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to remove contact: %s", centralError(resp))
+	}
+	c.refreshContacts()
+	return nil
+}
+
+// centralError is the error Central explains a failed request with, or the status without one
+func centralError(resp *http.Response) string {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&body) == nil && body.Error != "" {
+		return body.Error
+	}
+	return resp.Status
+}
+
+// startContactsJob refreshes the contacts until ctx is done, as often as the servers are probed
+func (c *Client) startContactsJob(ctx context.Context) {
+	c.refreshContacts()
+	ticker := time.NewTicker(c.options.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.refreshContacts()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+/*
+refreshContacts fetches the contacts and their status from Central, emitting
+ContactsUpdated when something changed and ContactAdded for each user who added the
+client since the last refresh.
+*/
+func (c *Client) refreshContacts() {
+	httpClient := &http.Client{Timeout: 2 * time.Second}
+	resp, err := httpClient.Get(c.contactsURL())
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+
+	var body struct {
+		Contacts []Contact `json:"contacts"`
+		AddedBy  []string  `json:"addedBy"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return
+	}
+
+	c.lock.Lock()
+	changed := len(body.Contacts) != len(c.contacts)
+	for i := 0; !changed && i < len(body.Contacts); i++ {
+		changed = body.Contacts[i] != c.contacts[i]
+	}
+	c.contacts = body.Contacts
+	c.lock.Unlock()
+
+	if changed {
+		c.emit(ContactsUpdated{Contacts: append([]Contact{}, body.Contacts...)})
+	}
+	for _, username := range body.AddedBy {
+		c.emit(ContactAdded{By: username})
+	}
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Number of reroutes kept for the diagnostics
+const maxReroutes = 100
+
+// Reroute is Central moving one of the rooms to another chat server
+type Reroute struct {
+	RoomID string    `json:"room"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Time   time.Time `json:"time"`
+}
+
+/*
+Placement is where Central placed a room. Home minimizes the worst cost of the members,
+that cost is the Score, in milliseconds. Each member connects to their own best server,
+in Members, which the chat servers relay between.
+*/
+type Placement struct {
+	RoomID  string            `json:"roomId"`
+	Home    string            `json:"home"`
+	Members map[string]string `json:"members"`
+	Score   float32           `json:"score"`
+	Placed  time.Time         `json:"placed"`
+}
+
+// recordReroute keeps a reroute for the diagnostics, the oldest go first
+func (c *Client) recordReroute(reroute Reroute) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.reroutes = append(c.reroutes, reroute)
+	if len(c.reroutes) > maxReroutes {
+		c.reroutes = c.reroutes[len(c.reroutes)-maxReroutes:]
+	}
+}
+
+// Reroutes returns the reroutes of every room since the client started, oldest first
+func (c *Client) Reroutes() []Reroute {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]Reroute{}, c.reroutes...)
+}
+
+// roomURL looks a room up in Central, naming ourselves as several clients can share an IP
+func (c *Client) roomURL(roomId string) string {
+	return c.centralURL + "/rooms/" + url.PathEscape(roomId) + "?username=" + url.QueryEscape(c.username)
+}
+
+// Placement asks Central where it placed a room, and the score that server won with
+func (c *Client) Placement(roomId string) (Placement, error) {
+	httpClient := &http.Client{Timeout: 2 * time.Second}
+	resp, err := httpClient.Get(c.roomURL(roomId))
+	if err != nil {
+		return Placement{}, fmt.Errorf("failed to fetch placement: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Placement{}, fmt.Errorf("failed to fetch placement: %s", centralError(resp))
+	}
+
+	var placement Placement
+	if err := json.NewDecoder(resp.Body).Decode(&placement); err != nil {
+		return Placement{}, fmt.Errorf("failed to fetch placement: %w", err)
+	}
+	return placement, nil
+}
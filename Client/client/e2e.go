@@ -0,0 +1,326 @@
+package client
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+/*
+End-to-end encryption between the two members of a room. Each member announces an
+ephemeral X25519 key into the room when joining, the chat server only relays it:
+
+	/key <base64 public key>
+	/enc <base64 nonce and AES-GCM ciphertext>
+
+Both members derive the same AES-256 key from the shared secret, so the server only
+ever forwards ciphertext. Rejoining after a reroute announces a fresh key, and both
+members can compare the fingerprint of the two public keys to detect a tampering server.
+
+Only keys from the member the room is with are accepted, and a key they replaced is
+never accepted again, so an old announcement replayed into the room can't roll the room
+back to it. Messages wait for the exchange, plain text is only sent once the user asks
+for it with AllowPlaintext, e.g. to talk to a browser which can't encrypt.
+*/
+const (
+	keyCommandPrefix       = "/key "
+	encryptedMessagePrefix = "/enc "
+	encryptionOverhead     = 12 + 16 // Nonce and GCM tag added to every sealed payload
+)
+
+type e2eSession struct {
+	roomId      string
+	private     *ecdh.PrivateKey
+	peerKey     []byte
+	key         cipher.AEAD
+	previous    cipher.AEAD // Key before the last exchange, for messages still in flight
+	fingerprint string
+	pending     []string        // Messages waiting for the key exchange to complete
+	plaintext   bool            // The user allowed plain text, see AllowPlaintext
+	warned      bool            // The user was told the other member sent plain text
+	current     string          // Latest key accepted from the other member, across exchanges
+	retired     map[string]bool // Keys the other member replaced, refused if replayed
+}
+
+// Fingerprint returns the fingerprint of a room's keys, empty until the exchange completes
+func (c *Client) Fingerprint(roomId string) string {
+	r, err := c.room(roomId)
+	if err != nil {
+		return ""
+	}
+	r.e2eLock.Lock()
+	defer r.e2eLock.Unlock()
+	if r.e2e == nil {
+		return ""
+	}
+	return r.e2e.fingerprint
+}
+
+// Unencrypted reports whether the user allowed plain text in a room, see AllowPlaintext
+func (c *Client) Unencrypted(roomId string) bool {
+	r, err := c.room(roomId)
+	if err != nil {
+		return false
+	}
+	r.e2eLock.Lock()
+	defer r.e2eLock.Unlock()
+	return r.e2e != nil && r.e2e.plaintext
+}
+
+// hasRoomKey reports whether the key exchange of the room completed
+func (c *Client) hasRoomKey(r *chatRoom) bool {
+	r.e2eLock.Lock()
+	defer r.e2eLock.Unlock()
+	return r.e2e != nil && r.e2e.key != nil
+}
+
+// startKeyExchange announces a fresh key to the room, after joining or rejoining it
+func (c *Client) startKeyExchange(r *chatRoom) error {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	r.e2eLock.Lock()
+	session := &e2eSession{roomId: r.id, private: private, retired: make(map[string]bool)}
+	if r.e2e != nil {
+		session.previous = r.e2e.key
+		session.pending = r.e2e.pending
+		session.plaintext, session.warned = r.e2e.plaintext, r.e2e.warned
+		session.current, session.retired = r.e2e.current, r.e2e.retired
+	}
+	r.e2e = session
+	r.e2eLock.Unlock()
+
+	return c.sendLine(r, keyCommandPrefix+base64.StdEncoding.EncodeToString(private.PublicKey().Bytes()))
+}
+
+// handleKeyMessage completes the exchange when the other member announces their key
+func (c *Client) handleKeyMessage(r *chatRoom, line string) (string, bool) {
+	sender, payload, found := strings.Cut(line, ": ")
+	if !found || !strings.HasPrefix(payload, keyCommandPrefix) {
+		return "", false
+	}
+	if sender == c.username {
+		return "", true
+	}
+	c.lock.Lock()
+	with := r.with
+	c.lock.Unlock()
+	if with != "" && sender != with {
+		return fmt.Sprintf("* Ignored an encryption key from %s, this chat is with %s", sender, with), true
+	}
+	peerKey, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(payload, keyCommandPrefix))
+	if err != nil {
+		return fmt.Sprintf("* Invalid encryption key from %s", sender), true
+	}
+
+	r.e2eLock.Lock()
+	session := r.e2e
+	if session == nil || bytes.Equal(session.peerKey, peerKey) {
+		r.e2eLock.Unlock()
+		return "", true
+	}
+	encoded := string(peerKey)
+	if session.retired[encoded] {
+		r.e2eLock.Unlock()
+		return fmt.Sprintf("* Ignored a replayed encryption key from %s", sender), true
+	}
+	key, fingerprint, err := deriveKey(session.roomId, session.private, peerKey)
+	if err != nil {
+		r.e2eLock.Unlock()
+		return fmt.Sprintf("* Invalid encryption key from %s: %v", sender, err), true
+	}
+	if session.key != nil {
+		session.previous = session.key
+	}
+	if session.current != "" && session.current != encoded {
+		session.retired[session.current] = true
+	}
+	session.peerKey, session.key, session.fingerprint = peerKey, key, fingerprint
+	session.current = encoded
+	session.plaintext = false
+	pending := session.pending
+	session.pending = nil
+	ownKey := session.private.PublicKey().Bytes()
+	r.e2eLock.Unlock()
+
+	// They may have joined after we announced ours
+	c.sendLine(r, keyCommandPrefix+base64.StdEncoding.EncodeToString(ownKey))
+	for _, message := range pending {
+		c.Send(r.id, message)
+	}
+	return fmt.Sprintf("* Messages with %s are end-to-end encrypted, fingerprint %s", sender, fingerprint), true
+}
+
+// decryptMessage replaces an encrypted line with its plaintext
+func (c *Client) decryptMessage(r *chatRoom, line string) (string, bool) {
+	sender, payload, found := strings.Cut(line, ": ")
+	if !found || !strings.HasPrefix(payload, encryptedMessagePrefix) {
+		return "", false
+	}
+
+	plaintext, err := c.open(r, strings.TrimPrefix(payload, encryptedMessagePrefix), sender)
+	if err != nil {
+		return fmt.Sprintf("%s: [message could not be decrypted]", sender), true
+	}
+	return fmt.Sprintf("%s: %s", sender, plaintext), true
+}
+
+// seal encrypts a payload for the room, bound to the given context, returning false before the key exchange
+func (c *Client) seal(r *chatRoom, plaintext []byte, context string) (string, bool) {
+	r.e2eLock.Lock()
+	defer r.e2eLock.Unlock()
+	if r.e2e == nil || r.e2e.key == nil {
+		return "", false
+	}
+
+	nonce := make([]byte, r.e2e.key.NonceSize())
+	rand.Read(nonce)
+	sealed := r.e2e.key.Seal(nonce, nonce, plaintext, []byte(r.e2e.roomId+"#"+context))
+	return base64.StdEncoding.EncodeToString(sealed), true
+}
+
+// open decrypts a payload sealed for the room with the given context
+func (c *Client) open(r *chatRoom, payload string, context string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	r.e2eLock.Lock()
+	defer r.e2eLock.Unlock()
+	// Rejoining keeps the previous key until the next exchange, for messages replayed meanwhile
+	if r.e2e == nil || (r.e2e.key == nil && r.e2e.previous == nil) {
+		return nil, fmt.Errorf("no key exchanged")
+	}
+	for _, key := range []cipher.AEAD{r.e2e.key, r.e2e.previous} {
+		if key == nil || len(sealed) < key.NonceSize() {
+			continue
+		}
+		nonce, ciphertext := sealed[:key.NonceSize()], sealed[key.NonceSize():]
+		if plaintext, err := key.Open(nil, nonce, ciphertext, []byte(r.e2e.roomId+"#"+context)); err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, fmt.Errorf("message authentication failed")
+}
+
+// queueUntilKeyed holds a message until the key exchange completes, returning false if it can be sent now
+func (c *Client) queueUntilKeyed(r *chatRoom, message string) bool {
+	r.e2eLock.Lock()
+	defer r.e2eLock.Unlock()
+	if r.e2e == nil || r.e2e.key != nil || r.e2e.plaintext {
+		return false
+	}
+	r.e2e.pending = append(r.e2e.pending, message)
+	return true
+}
+
+/*
+noteUnencrypted warns once when the other member sends plain text before any key, their
+client may not encrypt. Nothing is sent in plain text until the user calls
+AllowPlaintext: anyone able to put a line in the room could send one, and falling back
+on their word would let them turn encryption off.
+*/
+func (c *Client) noteUnencrypted(r *chatRoom, line string) string {
+	sender, _, found := strings.Cut(line, ": ")
+	if !found || sender == c.username || sender == "*" {
+		return ""
+	}
+
+	r.e2eLock.Lock()
+	defer r.e2eLock.Unlock()
+	session := r.e2e
+	if session == nil || session.key != nil || session.plaintext || session.warned {
+		return ""
+	}
+	session.warned = true
+	return fmt.Sprintf("* %s sent a message without encryption, yours wait for their key unless you allow plain text", sender)
+}
+
+/*
+AllowPlaintext sends the messages of a room in plain text until the other member
+announces a key, for clients which can't encrypt. The messages waiting for the key are
+sent right away.
+*/
+func (c *Client) AllowPlaintext(roomId string) error {
+	r, err := c.room(roomId)
+	if err != nil {
+		return err
+	}
+	r.e2eLock.Lock()
+	session := r.e2e
+	if session == nil {
+		r.e2eLock.Unlock()
+		return fmt.Errorf("%w: %s", ErrNotInRoom, roomId)
+	}
+	if session.key != nil {
+		r.e2eLock.Unlock()
+		return fmt.Errorf("messages in room %s are already encrypted", roomId)
+	}
+	session.plaintext = true
+	pending := session.pending
+	session.pending = nil
+	r.e2eLock.Unlock()
+
+	for _, message := range pending {
+		if err := c.Send(roomId, message); err != nil {
+			return err
+		}
+	}
+	c.deliver(r, "* You allowed plain text, messages are not encrypted until the other member sends a key")
+	return nil
+}
+
+// deriveKey derives the room key and its fingerprint from our private key and the peer's public key
+func deriveKey(roomId string, private *ecdh.PrivateKey, peerKey []byte) (cipher.AEAD, string, error) {
+	peer, err := ecdh.X25519().NewPublicKey(peerKey)
+	if err != nil {
+		return nil, "", err
+	}
+	shared, err := private.ECDH(peer)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Both members must order the public keys the same way
+	keys := [][]byte{private.PublicKey().Bytes(), peerKey}
+	if bytes.Compare(keys[0], keys[1]) > 0 {
+		keys[0], keys[1] = keys[1], keys[0]
+	}
+	transcript := bytes.Join(keys, nil)
+
+	// HKDF with a single block: extract with the room as salt, expand with both public keys
+	extract := hmac.New(sha256.New, []byte(roomId))
+	extract.Write(shared)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte("chat e2e v1"))
+	expand.Write(transcript)
+	expand.Write([]byte{1})
+
+	block, err := aes.NewCipher(expand.Sum(nil))
+	if err != nil {
+		return nil, "", err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, "", err
+	}
+
+	digest := sha256.Sum256(transcript)
+	hexDigest := hex.EncodeToString(digest[:10])
+	groups := []string{}
+	for i := 0; i < len(hexDigest); i += 4 {
+		groups = append(groups, hexDigest[i:i+4])
+	}
+	return aead, strings.Join(groups, " "), nil
+}
@@ -0,0 +1,121 @@
+package client
+
+import "time"
+
+/*
+Event is something that happened to the client, see Client.Events. It is one of
+RequestReceived, RequestCancelled, RequestProgress, Matched, MessageReceived, Rerouted,
+Reconnecting, Reconnected, TransferUpdated, ContactsUpdated, ContactAdded, Left or
+ErrorEvent.
+*/
+type Event interface {
+	event()
+}
+
+// RequestReceived is another user asking to chat, answer it with Accept or Decline
+type RequestReceived struct {
+	From     string
+	Received time.Time
+}
+
+// RequestCancelled is a pending chat request going away unanswered, withdrawn by its sender or Expired
+type RequestCancelled struct {
+	From    string
+	Expired bool
+}
+
+// RequestProgress is a status Central reports while our request to a user is pending,
+// one of ACK_CONN, MSG_REQ_SENT, AWAITING_REQ or REQ_ACCEPTED
+type RequestProgress struct {
+	To     string
+	Status string
+}
+
+// Matched is the client joining a room, after a request was accepted either way
+type Matched struct {
+	Room Room
+}
+
+// MessageReceived is a line of one of the rooms, our own messages included
+type MessageReceived struct {
+	RoomID string
+	From   string // Empty for notices
+	Text   string
+	Notice bool // From the chat server or the client itself, e.g. a file offer
+	Time   time.Time
+}
+
+// Rerouted is Central moving the client to another chat server, the room stays the same
+type Rerouted struct {
+	RoomID string
+	Server string
+}
+
+/*
+Reconnecting is the connection to the chat server being lost, the client tries to rejoin
+the room after Retry. Err is why the connection or the previous attempt failed. Once the
+client gives up a Left event follows, see WithReconnectTimeout.
+*/
+type Reconnecting struct {
+	RoomID  string
+	Attempt int
+	Retry   time.Duration
+	Err     error
+}
+
+// Reconnected is the client back in the room after losing its connection, what it missed follows
+type Reconnected struct {
+	Room Room
+}
+
+// TransferUpdated is a change to a file transfer, for progress indicators
+type TransferUpdated struct {
+	Transfer Transfer
+}
+
+// ContactsUpdated is a change to the contacts of the client or to their status
+type ContactsUpdated struct {
+	Contacts []Contact
+}
+
+// ContactAdded is another user adding the client to their contacts
+type ContactAdded struct {
+	By string
+}
+
+// Left is the client leaving a room, Err is set when the connection was lost or Central closed the room
+type Left struct {
+	RoomID string
+	Err    error
+}
+
+// ErrorEvent is a failure in the background, e.g. a reroute that couldn't be followed
+type ErrorEvent struct {
+	RoomID string // Empty for failures outside of a room
+	Err    error
+}
+
+func (RequestReceived) event()  {}
+func (RequestCancelled) event() {}
+func (RequestProgress) event()  {}
+func (Matched) event()          {}
+func (MessageReceived) event()  {}
+func (Rerouted) event()         {}
+func (Reconnecting) event()     {}
+func (Reconnected) event()      {}
+func (TransferUpdated) event()  {}
+func (ContactsUpdated) event()  {}
+func (ContactAdded) event()     {}
+func (Left) event()             {}
+func (ErrorEvent) event()       {}
+
+// String formats the message the way the chat server sends it
+func (m MessageReceived) String() string {
+	switch {
+	case m.Notice:
+		return "* " + m.Text
+	case m.From == "":
+		return m.Text
+	}
+	return m.From + ": " + m.Text
+}
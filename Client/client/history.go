@@ -0,0 +1,357 @@
+package client
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+/*
+The client keeps what its rooms showed in a local history, one file per user, encrypted
+with a key derived from a passphrase. The first line of the file describes the key, every
+other line is an entry sealed on its own, so entries are appended as they arrive:
+
+	{"version":2,"salt":"<base64>","iterations":<n>,"check":"<sealed historyCheck>"}
+	<sequence number> <base64 nonce and AES-GCM ciphertext of a HistoryEntry in JSON>
+
+Entries are numbered from 1, and the number is sealed with the entry, so entries deleted,
+reordered or duplicated in the file are detected when it is loaded. The key is derived
+with PBKDF2-HMAC-SHA256.
+
+The whole history is decrypted into memory when the client starts, searches run there.
+*/
+const (
+	historyVersion    = 2
+	historyIterations = 200000
+	historyCheck      = "chat history v2" // Sealed in the header as entry 0, to tell a wrong passphrase
+)
+
+// HistoryEntry is a message or notice a room showed
+type HistoryEntry struct {
+	RoomID  string    `json:"room"`
+	With    string    `json:"with"`
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"` // EntryMessage or EntryNotice
+	Sender  string    `json:"sender,omitempty"`
+	Message string    `json:"message"`
+}
+
+// HistoryRoom sums up the history of a room
+type HistoryRoom struct {
+	ID      string
+	With    string
+	First   time.Time
+	Last    time.Time
+	Entries int
+}
+
+type historyHeader struct {
+	Version    int    `json:"version"`
+	Salt       string `json:"salt"`
+	Iterations int    `json:"iterations"`
+	Check      string `json:"check"`
+}
+
+// historyStore is the decrypted history, and the file new entries are appended to
+type historyStore struct {
+	file    *os.File
+	key     cipher.AEAD
+	aad     string // Binds the entries to the user
+	next    uint64 // Sequence number of the next entry
+	entries []HistoryEntry
+	mu      sync.Mutex
+}
+
+// openHistory decrypts the history of username in dir, creating it with passphrase the first time
+func openHistory(dir, username, passphrase string) (*historyStore, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("a passphrase is required for the chat history")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to open chat history: %w", err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, username+".history"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open chat history: %w", err)
+	}
+
+	store := &historyStore{file: file, aad: "history#" + username, next: 1}
+	if err := store.load(passphrase); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// load reads the header and entries, or writes a header to a new file
+func (h *historyStore) load(passphrase string) error {
+	reader := bufio.NewReader(h.file)
+	line, err := reader.ReadString('\n')
+	if line == "" && err != nil {
+		return h.create(passphrase)
+	}
+
+	var header historyHeader
+	if err := json.Unmarshal([]byte(line), &header); err != nil || header.Version != historyVersion {
+		return fmt.Errorf("chat history is corrupt or from a newer client")
+	}
+	salt, err := base64.StdEncoding.DecodeString(header.Salt)
+	if err != nil {
+		return fmt.Errorf("chat history is corrupt: %w", err)
+	}
+	if h.key, err = historyKey(passphrase, salt, header.Iterations); err != nil {
+		return err
+	}
+	if check, err := h.open(header.Check, 0); err != nil || string(check) != historyCheck {
+		return ErrWrongPassphrase
+	}
+
+	// A line cut short by a crash is skipped, the next entry starts on a new line and takes its number.
+	// Any other line out of sequence was moved, copied or follows a deleted one.
+	for {
+		line, err := reader.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			if openErr := h.loadEntry(line); openErr != nil {
+				return openErr
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if _, err := h.file.Seek(0, 2); err != nil {
+		return fmt.Errorf("failed to open chat history: %w", err)
+	}
+	if _, err := h.file.WriteString("\n"); err != nil {
+		return fmt.Errorf("failed to open chat history: %w", err)
+	}
+	return nil
+}
+
+// loadEntry decrypts an entry line, which must be the next in sequence unless it was cut short
+func (h *historyStore) loadEntry(line string) error {
+	number, payload, found := strings.Cut(line, " ")
+	sequence, err := strconv.ParseUint(number, 10, 64)
+	if !found || err != nil {
+		return nil // Cut short
+	}
+	plaintext, err := h.open(payload, sequence)
+	var entry HistoryEntry
+	if err != nil || json.Unmarshal(plaintext, &entry) != nil {
+		if sequence == h.next {
+			return nil // Cut short, or changed
+		}
+		return fmt.Errorf("%w: unreadable entry %d", ErrHistoryTampered, sequence)
+	}
+	if sequence != h.next {
+		return fmt.Errorf("%w: entry %d where entry %d belongs", ErrHistoryTampered, sequence, h.next)
+	}
+	h.entries = append(h.entries, entry)
+	h.next++
+	return nil
+}
+
+// create writes the header of a new history
+func (h *historyStore) create(passphrase string) error {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	var err error
+	if h.key, err = historyKey(passphrase, salt, historyIterations); err != nil {
+		return err
+	}
+	header, _ := json.Marshal(historyHeader{
+		Version:    historyVersion,
+		Salt:       base64.StdEncoding.EncodeToString(salt),
+		Iterations: historyIterations,
+		Check:      h.seal([]byte(historyCheck), 0),
+	})
+	if _, err := h.file.Write(append(header, '\n')); err != nil {
+		return fmt.Errorf("failed to create chat history: %w", err)
+	}
+	return nil
+}
+
+// historyKey derives the AES-256 key of the history from the passphrase, with PBKDF2-HMAC-SHA256
+func historyKey(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	if iterations <= 0 {
+		return nil, fmt.Errorf("chat history is corrupt")
+	}
+	key := pbkdf2.Key([]byte(passphrase), salt, iterations, 32, sha256.New)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the entry with the given sequence number
+func (h *historyStore) seal(plaintext []byte, sequence uint64) string {
+	nonce := make([]byte, h.key.NonceSize())
+	rand.Read(nonce)
+	return base64.StdEncoding.EncodeToString(h.key.Seal(nonce, nonce, plaintext, h.additionalData(sequence)))
+}
+
+// open decrypts the entry with the given sequence number, it fails for an entry sealed with another
+func (h *historyStore) open(payload string, sequence uint64) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < h.key.NonceSize() {
+		return nil, fmt.Errorf("entry is too short")
+	}
+	return h.key.Open(nil, sealed[:h.key.NonceSize()], sealed[h.key.NonceSize():], h.additionalData(sequence))
+}
+
+func (h *historyStore) additionalData(sequence uint64) []byte {
+	return []byte(h.aad + "#" + strconv.FormatUint(sequence, 10))
+}
+
+// append keeps an entry, on disk and in memory
+func (h *historyStore) append(entry HistoryEntry) error {
+	plaintext, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	line := fmt.Sprintf("%d %s\n", h.next, h.seal(plaintext, h.next))
+	if _, err := h.file.WriteString(line); err != nil {
+		return fmt.Errorf("failed to save to chat history: %w", err)
+	}
+	h.entries = append(h.entries, entry)
+	h.next++
+	return nil
+}
+
+func (h *historyStore) close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.file.Close()
+}
+
+// closeHistory closes the history file, if the client keeps one
+func (c *Client) closeHistory() {
+	if c.history != nil {
+		c.history.close()
+	}
+}
+
+// recordHistory keeps a line of the room in the history, if the client keeps one
+func (c *Client) recordHistory(r *chatRoom, entry TranscriptEntry) {
+	if c.history == nil {
+		return
+	}
+	c.lock.Lock()
+	with := r.with
+	c.lock.Unlock()
+	err := c.history.append(HistoryEntry{
+		RoomID:  r.id,
+		With:    with,
+		Time:    entry.Time,
+		Kind:    entry.Kind,
+		Sender:  entry.Sender,
+		Message: entry.Message,
+	})
+	if err != nil {
+		c.emit(ErrorEvent{RoomID: r.id, Err: err})
+	}
+}
+
+// HistoryRooms returns the rooms in the history, the most recently active first
+func (c *Client) HistoryRooms() ([]HistoryRoom, error) {
+	if c.history == nil {
+		return nil, ErrNoHistory
+	}
+	c.history.mu.Lock()
+	rooms := map[string]*HistoryRoom{}
+	for _, entry := range c.history.entries {
+		room, ok := rooms[entry.RoomID]
+		if !ok {
+			room = &HistoryRoom{ID: entry.RoomID, With: entry.With, First: entry.Time}
+			rooms[entry.RoomID] = room
+		}
+		room.Last = entry.Time
+		room.Entries++
+	}
+	c.history.mu.Unlock()
+
+	list := make([]HistoryRoom, 0, len(rooms))
+	for _, room := range rooms {
+		list = append(list, *room)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Last.After(list[j].Last) })
+	return list, nil
+}
+
+// History returns the entries of a room in the history, oldest first
+func (c *Client) History(roomId string) ([]HistoryEntry, error) {
+	if c.history == nil {
+		return nil, ErrNoHistory
+	}
+	c.history.mu.Lock()
+	defer c.history.mu.Unlock()
+	entries := []HistoryEntry{}
+	for _, entry := range c.history.entries {
+		if entry.RoomID == roomId {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+/*
+SearchHistory returns the entries of every room containing all words of query, oldest
+first. Words match case-insensitively anywhere in the message, the sender or who the
+room was with.
+*/
+func (c *Client) SearchHistory(query string) ([]HistoryEntry, error) {
+	if c.history == nil {
+		return nil, ErrNoHistory
+	}
+	words := strings.Fields(strings.ToLower(query))
+	if len(words) == 0 {
+		return nil, fmt.Errorf("nothing to search for")
+	}
+
+	c.history.mu.Lock()
+	defer c.history.mu.Unlock()
+	matches := []HistoryEntry{}
+	for _, entry := range c.history.entries {
+		text := strings.ToLower(entry.Sender + " " + entry.With + " " + entry.Message)
+		found := true
+		for _, word := range words {
+			if !strings.Contains(text, word) {
+				found = false
+				break
+			}
+		}
+		if found {
+			matches = append(matches, entry)
+		}
+	}
+	return matches, nil
+}
+
+// String formats the entry the way the chat server sends it
+func (e HistoryEntry) String() string {
+	if e.Kind == EntryNotice {
+		return "* " + e.Message
+	}
+	return e.Sender + ": " + e.Message
+}
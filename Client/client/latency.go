@@ -0,0 +1,230 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"time"
+)
+
+// Probes sent to each server per round, the pause between them and how long an answer may take
+const (
+	probeSamples = 5
+	probeGap     = 20 * time.Millisecond
+	probeTimeout = time.Second
+)
+
+/*
+Chat servers answer UDP probes on the port they're pinged on over TCP. A probe is 32
+bytes: the magic, a sequence number, the client's send time, and the server's receive
+and send times, which it fills in. See chatserver/internal/probe.
+*/
+const probePacketSize = 32
+
+var probeMagic = []byte("CPRB")
+
+/*
+ServerStats is what the client measured to a chat server, times in milliseconds. RTT and
+Jitter are smoothed the way TCP smooths its round trip time, Loss is the smoothed share
+of probes that failed, from 0 to 1. A server is Down until it is probed, and when none of
+the last round's probes were answered.
+
+Uplink and Downlink split the RTT into one-way delays, from UDP probes only. The clocks
+of client and server differ, so the offset between them is estimated from the fastest
+probe of each round, assuming its two ways took equally long. The split of the other
+probes shows where they were held up.
+
+Current is the unsmoothed average RTT of the last round, to compare against RTT.
+*/
+type ServerStats struct {
+	RTT       float32   `json:"rtt"`
+	Current   float32   `json:"current"`
+	Jitter    float32   `json:"jitter"`
+	Loss      float32   `json:"loss"`
+	Uplink    float32   `json:"uplink"`
+	Downlink  float32   `json:"downlink"`
+	Samples   int       `json:"samples"`   // Probes answered so far
+	Transport string    `json:"transport"` // How the last answered probes were sent, udp or tcp
+	Down      bool      `json:"down"`
+	LastProbe time.Time `json:"-"`
+}
+
+// probeSample is an answered probe
+type probeSample struct {
+	rtt     time.Duration // Without the time the server held the probe
+	forward time.Duration // Server receive time minus client send time, UDP only
+	back    time.Duration // Client receive time minus server send time, UDP only
+	udp     bool
+}
+
+// Reachable tells if the server answered probes in the last round
+func (s ServerStats) Reachable() bool {
+	return !s.Down
+}
+
+// delay is the plain latency reported to Central, math.MaxFloat32 for unreachable servers
+func (s ServerStats) delay() float32 {
+	if !s.Reachable() {
+		return math.MaxFloat32
+	}
+	return s.RTT
+}
+
+// milliseconds converts a duration for the stats
+func milliseconds(d time.Duration) float32 {
+	return float32(d.Seconds() * 1000)
+}
+
+// smooth moves average a share of the way to sample
+func smooth(average, sample, share float32) float32 {
+	return (1-share)*average + share*sample
+}
+
+// add folds a round of probes into the stats, samples are the answered ones out of sent
+func (s ServerStats) add(samples []probeSample, sent int, at time.Time) ServerStats {
+	var offset time.Duration
+	var fastest *probeSample
+	for i, sample := range samples {
+		if sample.udp && (fastest == nil || sample.rtt < fastest.rtt) {
+			fastest = &samples[i]
+		}
+	}
+	if fastest != nil {
+		offset = (fastest.forward - fastest.back) / 2
+	} else if len(samples) > 0 {
+		s.Uplink, s.Downlink = 0, 0 // Answered over TCP only, which can't tell
+	}
+
+	s.Current = 0
+	for _, sample := range samples {
+		rtt := milliseconds(sample.rtt)
+		s.Current += rtt / float32(len(samples))
+		if s.Samples == 0 {
+			s.RTT, s.Jitter = rtt, rtt/2
+		} else {
+			s.Jitter = smooth(s.Jitter, float32(math.Abs(float64(s.RTT-rtt))), 0.25)
+			s.RTT = smooth(s.RTT, rtt, 0.125)
+		}
+		s.Samples++
+
+		s.Transport = "tcp"
+		if sample.udp {
+			uplink, downlink := milliseconds(sample.forward-offset), milliseconds(sample.back+offset)
+			if s.Uplink == 0 && s.Downlink == 0 {
+				s.Uplink, s.Downlink = uplink, downlink
+			} else {
+				s.Uplink = smooth(s.Uplink, uplink, 0.125)
+				s.Downlink = smooth(s.Downlink, downlink, 0.125)
+			}
+			s.Transport = "udp"
+		}
+	}
+
+	loss := float32(sent-len(samples)) / float32(sent)
+	if s.LastProbe.IsZero() {
+		s.Loss = loss
+	} else {
+		s.Loss = smooth(s.Loss, loss, 0.25)
+	}
+	s.Down = len(samples) == 0
+	s.LastProbe = at
+	return s
+}
+
+// pingServer measures the time to open a connection to a server, in milliseconds
+func pingServer(serverIP string) (float32, error) {
+	if serverIP == "::1" {
+		serverIP = "localhost"
+	}
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(serverIP, pingPort), 2*time.Second)
+	if err != nil {
+		return 0, fmt.Errorf("failed to ping server %s: %w", serverIP, err)
+	}
+	defer conn.Close()
+
+	delay := time.Since(start).Seconds() * 1000 // Convert to milliseconds
+	return float32(delay), nil
+}
+
+// probeServer probes a server over UDP, and times TCP connections to servers that don't answer those
+func probeServer(serverIP string) []probeSample {
+	if samples := probeUDP(serverIP); len(samples) > 0 {
+		return samples
+	}
+	return probeTCP(serverIP)
+}
+
+// probeTCP pings a server several times over TCP
+func probeTCP(serverIP string) []probeSample {
+	samples := make([]probeSample, 0, probeSamples)
+	for i := 0; i < probeSamples; i++ {
+		if i > 0 {
+			time.Sleep(probeGap)
+		}
+		if rtt, err := pingServer(serverIP); err == nil {
+			samples = append(samples, probeSample{rtt: time.Duration(float64(rtt) * float64(time.Millisecond))})
+		}
+	}
+	return samples
+}
+
+/*
+probeUDP sends a round of UDP probes to a server, one at a time. It gives up after two
+unanswered probes when none were answered yet, the server likely runs no responder or
+UDP is blocked.
+*/
+func probeUDP(serverIP string) []probeSample {
+	if serverIP == "::1" {
+		serverIP = "localhost"
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(serverIP, pingPort))
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+
+	samples := make([]probeSample, 0, probeSamples)
+	packet := make([]byte, probePacketSize)
+	reply := make([]byte, 1500)
+	for seq := 0; seq < probeSamples; seq++ {
+		if len(samples) == 0 && seq >= 2 {
+			return nil
+		}
+		if seq > 0 {
+			time.Sleep(probeGap)
+		}
+
+		start := time.Now()
+		clear(packet)
+		copy(packet, probeMagic)
+		binary.BigEndian.PutUint32(packet[4:8], uint32(seq))
+		binary.BigEndian.PutUint64(packet[8:16], uint64(start.UnixNano()))
+		if _, err := conn.Write(packet); err != nil {
+			continue
+		}
+
+		// Answers to earlier probes may still arrive, skip them
+		conn.SetReadDeadline(start.Add(probeTimeout))
+		for {
+			n, err := conn.Read(reply)
+			if err != nil {
+				break
+			}
+			elapsed := time.Since(start)
+			if n != probePacketSize || !bytes.Equal(reply[:4], probeMagic) || binary.BigEndian.Uint32(reply[4:8]) != uint32(seq) {
+				continue
+			}
+
+			serverReceived := int64(binary.BigEndian.Uint64(reply[16:24]))
+			serverSent := int64(binary.BigEndian.Uint64(reply[24:32]))
+			forward := time.Duration(serverReceived - start.UnixNano())
+			back := time.Duration(start.UnixNano() + elapsed.Nanoseconds() - serverSent)
+			samples = append(samples, probeSample{rtt: forward + back, forward: forward, back: back, udp: true})
+			break
+		}
+	}
+	return samples
+}
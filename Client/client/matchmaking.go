@@ -0,0 +1,234 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Matchmaking statuses, as Central sends them
+var (
+	ACK_CONN       = "ACK"
+	MSG_REQ_SENT   = "REQ_SENT"
+	AWAITING_REQ   = "AWAITING_REQ"
+	REQ_ACCEPTED   = "REQ_ACCEPTED"
+	USER_NOT_FOUND = "USER_NOT_FOUND"
+	SERVER_ERROR   = "SERVER_ERROR"
+	ACCEPT_REQ     = "ACCEPT_REQ"
+	REQ_EXPIRED    = "REQ_EXPIRED"
+	UNAUTHORIZED   = "Unauthorized"
+)
+
+// matchmakingAddress derives the address of Central's matchmaking server, on the host of its URL
+func matchmakingAddress(centralURL string) (string, error) {
+	parsed, err := url.Parse(centralURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid central URL: %w", err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Hostname() == "" {
+		return "", fmt.Errorf("invalid central URL %q, expected http://host:port", centralURL)
+	}
+	return net.JoinHostPort(parsed.Hostname(), matchmakingPort), nil
+}
+
+/*
+Request asks username to chat and joins the room once they accept. The statuses Central
+reports meanwhile are published as RequestProgress events, each once. Cancelling ctx
+withdraws the request.
+*/
+func (c *Client) Request(ctx context.Context, username string) (Room, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.matchmaking)
+	if err != nil {
+		return Room{}, fmt.Errorf("failed to connect to matchmaking server: %w", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// Our own username too, Central can't tell clients sharing an IP apart
+	if _, err := conn.Write([]byte(username + "\n" + c.username + "\n")); err != nil {
+		return Room{}, fmt.Errorf("failed to send chat request: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	server, last := "", ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if ctx.Err() != nil {
+				return Room{}, ctx.Err()
+			}
+			return Room{}, fmt.Errorf("%w: %v", ErrMatchmaking, err)
+		}
+		status := strings.TrimSpace(line)
+
+		switch {
+		case status == USER_NOT_FOUND:
+			return Room{}, ErrUnavailable
+		case status == REQ_EXPIRED:
+			return Room{}, ErrExpired
+		case status == SERVER_ERROR:
+			return Room{}, ErrMatchmaking
+		case status == UNAUTHORIZED:
+			return Room{}, ErrNotRegistered
+		case strings.HasPrefix(status, "IP:"):
+			server = strings.TrimPrefix(status, "IP:")
+		case strings.HasPrefix(status, "RoomID:"):
+			return c.Join(server, strings.TrimPrefix(status, "RoomID:"), username)
+		case status != last: // Central repeats AWAITING_REQ until they answer
+			last = status
+			c.emit(RequestProgress{To: username, Status: status})
+		}
+	}
+}
+
+/*
+chatRequest is a chat request Central passed on, over a connection it keeps open until
+we answer. Central closes it when the requester withdraws the request or it expires, so
+a goroutine reads it all along, see watchRequest, and hands the lines to Accept.
+*/
+type chatRequest struct {
+	conn     net.Conn
+	lines    chan string // Closed with the connection
+	received time.Time
+}
+
+// Accept takes the chat request of username and joins the room Central picks
+func (c *Client) Accept(ctx context.Context, username string) (Room, error) {
+	c.lock.Lock()
+	request, exists := c.requests[username]
+	delete(c.requests, username)
+	c.lock.Unlock()
+	if !exists {
+		return Room{}, fmt.Errorf("no chat request from %s", username)
+	}
+	conn := request.conn
+	defer conn.Close()
+
+	// send a ACCEPT_REQ message to Central
+	if _, err := conn.Write([]byte(ACCEPT_REQ + "\n")); err != nil {
+		return Room{}, fmt.Errorf("request was withdrawn: %w", err)
+	}
+
+	// Wait for Central to send us a chat server to connect to
+	server := ""
+	for {
+		var status string
+		select {
+		case line, ok := <-request.lines:
+			if !ok {
+				return Room{}, fmt.Errorf("%w: request was withdrawn", ErrMatchmaking)
+			}
+			status = line
+		case <-ctx.Done():
+			return Room{}, ctx.Err()
+		}
+
+		switch {
+		case strings.HasPrefix(status, "IP:"):
+			server = strings.TrimPrefix(status, "IP:")
+		case strings.HasPrefix(status, "RoomID:") && server != "":
+			return c.Join(server, strings.TrimPrefix(status, "RoomID:"), username)
+		case status == REQ_EXPIRED:
+			return Room{}, ErrExpired
+		default:
+			return Room{}, ErrMatchmaking
+		}
+	}
+}
+
+// Decline turns down the chat request of username, Central tells the requester
+func (c *Client) Decline(username string) error {
+	c.lock.Lock()
+	request, exists := c.requests[username]
+	delete(c.requests, username)
+	c.lock.Unlock()
+	if !exists {
+		return fmt.Errorf("no chat request from %s", username)
+	}
+	return request.conn.Close()
+}
+
+// PendingRequests returns the users waiting for an answer to their chat request
+func (c *Client) PendingRequests() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	usernames := make([]string, 0, len(c.requests))
+	for username := range c.requests {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// listenForRequests accepts the connections Central makes to pass on chat requests
+func (c *Client) listenForRequests(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		go c.handleChatRequest(conn)
+	}
+}
+
+func (c *Client) handleChatRequest(conn net.Conn) {
+	// Read the username from the connection
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		conn.Close()
+		c.emit(ErrorEvent{Err: fmt.Errorf("failed to read chat request: %w", err)})
+		return
+	}
+	username := strings.TrimSpace(string(buf[:n]))
+	request := &chatRequest{conn: conn, lines: make(chan string, 8), received: time.Now()}
+	c.lock.Lock()
+	previous := c.requests[username]
+	c.requests[username] = request
+	c.lock.Unlock()
+	// Asking again replaces the previous request, Central declines that one
+	if previous != nil {
+		previous.conn.Close()
+	}
+
+	c.emit(RequestReceived{From: username, Received: request.received})
+	c.watchRequest(username, request)
+}
+
+// watchRequest reads a chat request's connection until it closes, dropping the request if it is still pending
+func (c *Client) watchRequest(username string, request *chatRequest) {
+	reader := bufio.NewReader(request.conn)
+	expired := false
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		status := strings.TrimSpace(line)
+		expired = expired || status == REQ_EXPIRED
+		request.lines <- status
+	}
+	close(request.lines)
+
+	c.lock.Lock()
+	pending := c.requests[username] == request
+	if pending {
+		delete(c.requests, username)
+	}
+	c.lock.Unlock()
+	if pending {
+		request.conn.Close()
+		c.emit(RequestCancelled{From: username, Expired: expired})
+	}
+}
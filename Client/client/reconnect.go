@@ -0,0 +1,214 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+Reconnecting after losing the connection to the chat server. The client keeps the room
+and retries with exponential backoff: it asks Central which server the room is placed on
+now, since it may have moved off a server that went down, and rejoins it. The join line
+then carries the hash of the last line received, and the server replays what followed:
+
+	username#roomId#<first 8 bytes of the line's SHA-256 in hex>
+
+The keys of the room are kept, so replayed messages can still be decrypted, and a fresh
+key is announced once back in the room. A server disconnecting us on purpose, e.g. for a
+kick, says so in a last notice starting with closedNotice, and we stay out.
+*/
+const (
+	reconnectFirstDelay = 500 * time.Millisecond
+	reconnectMaxDelay   = 15 * time.Second
+)
+
+const closedNotice = "* /closed "
+
+// Notices remembered for skipping their replay, as many as the chat server keeps lines by default
+const maxReplayedNotices = 200
+
+var errRoomClosed = errors.New("the room was closed")
+
+// joinLine is the first line sent to a chat server, resuming after lastLine when rejoining
+func joinLine(username, roomId, lastLine string, rejoin bool) string {
+	if rejoin && lastLine != "" {
+		return fmt.Sprintf("%s#%s#%s\n", username, roomId, lastLine)
+	}
+	return fmt.Sprintf("%s#%s\n", username, roomId)
+}
+
+// seen remembers the last line received on the room's current connection, notices may not be kept by the server
+func (c *Client) seen(r *chatRoom, conn net.Conn, line string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if r.conn != conn {
+		return
+	}
+	if strings.HasPrefix(line, "* ") {
+		r.notices = append(r.notices, line)
+		if len(r.notices) > maxReplayedNotices {
+			r.notices = r.notices[len(r.notices)-maxReplayedNotices:]
+		}
+		return
+	}
+	sum := sha256.Sum256([]byte(line))
+	r.lastLine, r.notices = hex.EncodeToString(sum[:8]), nil
+}
+
+/*
+replayed tells if a line is one the server replays although we got it before losing the
+connection. The server replays from the last line we can name, and notices that followed
+it come again. They are skipped until the first line that isn't a notice.
+*/
+func (c *Client) replayed(r *chatRoom, conn net.Conn, line string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if r.conn != conn || len(r.replay) == 0 {
+		return false
+	}
+	if !strings.HasPrefix(line, "* ") {
+		r.replay = nil
+		return false
+	}
+	for i, notice := range r.replay {
+		if notice == line {
+			r.replay = r.replay[i+1:]
+			return true
+		}
+	}
+	return false
+}
+
+// reconnecting tells if the client is still trying to get back into the room, not left, rejoined or rerouted
+func (c *Client) reconnecting(r *chatRoom) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.current(r) && r.rejoin
+}
+
+// reconnect tries to rejoin the room until it succeeds or the timeout passes
+func (c *Client) reconnect(r *chatRoom, cause error) {
+	ctx := c.context()
+	if c.options.reconnectTimeout <= 0 {
+		c.abandonRoom(r, cause)
+		return
+	}
+	deadline := time.Now().Add(c.options.reconnectTimeout)
+	delay := reconnectFirstDelay
+	for attempt := 1; ; attempt++ {
+		c.emit(Reconnecting{RoomID: r.id, Attempt: attempt, Retry: delay, Err: cause})
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		if !c.reconnecting(r) {
+			return
+		}
+
+		server, err := c.roomServer(r.id)
+		if errors.Is(err, errRoomClosed) {
+			c.abandonRoom(r, err)
+			return
+		}
+		if err == nil {
+			if err = c.rejoinRoom(r, server); err == nil {
+				return
+			}
+		}
+		cause = err
+		if time.Now().After(deadline) {
+			c.abandonRoom(r, fmt.Errorf("failed to reconnect: %w", cause))
+			return
+		}
+		delay = min(delay*2, reconnectMaxDelay)
+	}
+}
+
+// roomServer asks Central which chat server we are placed on in roomId
+func (c *Client) roomServer(roomId string) (string, error) {
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	resp, err := httpClient.Get(c.roomURL(roomId))
+	if err != nil {
+		return "", fmt.Errorf("failed to reach central server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", errRoomClosed
+	default:
+		return "", fmt.Errorf("failed to look up room: %s", resp.Status)
+	}
+
+	var placement struct {
+		Home    string            `json:"home"`
+		Members map[string]string `json:"members"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&placement); err != nil {
+		return "", fmt.Errorf("failed to look up room: %w", err)
+	}
+	if server, ok := placement.Members[c.username]; ok && server != "" {
+		return server, nil
+	}
+	return placement.Home, nil
+}
+
+// rejoinRoom connects to server and resumes the room after the last line seen
+func (c *Client) rejoinRoom(r *chatRoom, server string) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(server, chatPort), 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to connect to server at %s: %w", server, err)
+	}
+
+	c.lock.Lock()
+	if !c.current(r) || !r.rejoin {
+		c.lock.Unlock()
+		conn.Close()
+		return nil // Left, or rerouted meanwhile
+	}
+	if _, err := conn.Write([]byte(joinLine(c.username, r.id, r.lastLine, true))); err != nil {
+		c.lock.Unlock()
+		conn.Close()
+		return fmt.Errorf("failed to send room ID: %w", err)
+	}
+	r.conn, r.server, r.rejoin = conn, server, false
+	r.replay, r.notices = r.notices, nil
+	room := r.info()
+	c.lock.Unlock()
+
+	c.recordTranscript(r, TranscriptEntry{Time: time.Now(), Kind: EntryReconnect, Server: server})
+	c.emit(Reconnected{Room: room})
+	if err := c.startKeyExchange(r); err != nil {
+		c.emit(ErrorEvent{RoomID: r.id, Err: fmt.Errorf("failed to start key exchange: %w", err)})
+	}
+	go c.readRoom(r, conn)
+	return nil
+}
+
+// abandonRoom gives up on the room, it is lost and a Left event says why
+func (c *Client) abandonRoom(r *chatRoom, cause error) {
+	c.lock.Lock()
+	if !c.current(r) || !r.rejoin {
+		c.lock.Unlock()
+		return
+	}
+	delete(c.rooms, r.id)
+	r.rejoin = false
+	c.lock.Unlock()
+
+	r.e2eLock.Lock()
+	r.e2e = nil
+	r.e2eLock.Unlock()
+	c.discardTransfers(r)
+	go c.closeRoom(r.id)
+	c.emit(Left{RoomID: r.id, Err: cause})
+}
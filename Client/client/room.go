@@ -0,0 +1,444 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Room is a chat the client is in
+type Room struct {
+	ID           string
+	Server       string // Chat server the client is connected to, it may relay the room to another
+	With         string
+	Reconnecting bool // The connection was lost and the client is trying to rejoin, see reconnect.go
+}
+
+/*
+chatRoom is a room the client is in. Every room has its own connection, possibly to
+another chat server, and its own keys, file transfers and transcript.
+*/
+type chatRoom struct {
+	id   string
+	with string
+
+	conn     net.Conn // Guarded by the client's lock, like server, lastLine and rejoin
+	server   string
+	lastLine string   // Hash of the last line received, to resume after reconnecting
+	rejoin   bool     // The connection was lost and the client is reconnecting, conn is nil meanwhile
+	notices  []string // Notices received since the line of lastLine, the server replays them too
+	replay   []string // Notices expected again right after rejoining, skipped, see replayed
+
+	writeLock      sync.Mutex // Serializes the lines written to the chat server
+	transferLock   sync.Mutex
+	transfers      map[string]*Transfer // File transfers in the room, by ID
+	e2eLock        sync.Mutex
+	e2e            *e2eSession // Keys of the room, see e2e.go
+	transcriptLock sync.Mutex
+	transcript     []TranscriptEntry // What the room showed, for exports
+}
+
+// info describes the room, the client's lock must be held
+func (r *chatRoom) info() Room {
+	return Room{ID: r.id, Server: r.server, With: r.with, Reconnecting: r.rejoin}
+}
+
+// Rooms returns the rooms the client is in, oldest first as room IDs start with their creation time
+func (c *Client) Rooms() []Room {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	rooms := make([]Room, 0, len(c.rooms))
+	for _, r := range c.rooms {
+		rooms = append(rooms, r.info())
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].ID < rooms[j].ID })
+	return rooms
+}
+
+// Room returns a room the client is in, false if it isn't in roomId
+func (c *Client) Room(roomId string) (Room, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	r, ok := c.rooms[roomId]
+	if !ok {
+		return Room{}, false
+	}
+	return r.info(), true
+}
+
+// room returns the state of a room the client is in
+func (c *Client) room(roomId string) (*chatRoom, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	r, ok := c.rooms[roomId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotInRoom, roomId)
+	}
+	return r, nil
+}
+
+// current tells if r is still the client's room, not left or abandoned, the client's lock must be held
+func (c *Client) current(r *chatRoom) bool {
+	return c.rooms[r.id] == r
+}
+
+/*
+Join connects to roomId on a chat server, next to the rooms the client is in already.
+Joining a room again replaces its connection. Request and Accept join the room Central
+picks, Join is for rooms agreed on some other way.
+*/
+func (c *Client) Join(server, roomId, with string) (Room, error) {
+	conn, err := net.Dial("tcp", net.JoinHostPort(server, chatPort))
+	if err != nil {
+		return Room{}, fmt.Errorf("failed to connect to server at %s: %w", server, err)
+	}
+	// Send the room ID to the server
+	if _, err := conn.Write([]byte(joinLine(c.username, roomId, "", false))); err != nil {
+		conn.Close()
+		return Room{}, fmt.Errorf("failed to send room ID: %w", err)
+	}
+
+	c.lock.Lock()
+	r, ok := c.rooms[roomId]
+	if !ok {
+		r = &chatRoom{id: roomId, transfers: make(map[string]*Transfer)}
+		c.rooms[roomId] = r
+	}
+	previous := r.conn
+	r.conn, r.server, r.with = conn, server, with
+	r.lastLine, r.rejoin = "", false
+	r.notices, r.replay = nil, nil
+	room := r.info()
+	c.lock.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+
+	c.recordTranscript(r, TranscriptEntry{Time: time.Now(), Kind: EntryJoin, Message: roomId, Server: server})
+	c.emit(Matched{Room: room})
+	if err := c.startKeyExchange(r); err != nil {
+		c.emit(ErrorEvent{RoomID: roomId, Err: fmt.Errorf("failed to start key exchange: %w", err)})
+	}
+	go c.readRoom(r, conn)
+	return room, nil
+}
+
+// Leave disconnects from a room, and stops reconnecting to it
+func (c *Client) Leave(roomId string) error {
+	return c.leave(roomId, nil)
+}
+
+// leave disconnects from a room, the Left event carries the cause unless the user asked to leave
+func (c *Client) leave(roomId string, cause error) error {
+	c.lock.Lock()
+	r, ok := c.rooms[roomId]
+	delete(c.rooms, roomId)
+	var conn net.Conn
+	if ok {
+		conn = r.conn
+		r.conn, r.rejoin = nil, false
+	}
+	c.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotInRoom, roomId)
+	}
+
+	r.e2eLock.Lock()
+	r.e2e = nil
+	r.e2eLock.Unlock()
+	c.discardTransfers(r)
+	var err error
+	if conn != nil {
+		err = conn.Close()
+	}
+	go c.closeRoom(roomId)
+	c.emit(Left{RoomID: roomId, Err: cause})
+	return err
+}
+
+// closeRoom tells Central we left a room, so it stops placing and rerouting it
+func (c *Client) closeRoom(roomId string) {
+	req, err := http.NewRequest("DELETE", c.centralURL+"/clients/"+url.PathEscape(c.username)+"/rooms/"+url.PathEscape(roomId), nil)
+	if err != nil {
+		return
+	}
+	httpClient := &http.Client{Timeout: 2 * time.Second}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close() // Not found once the other member left first
+}
+
+/*
+startRoomsJob leaves the rooms Central closed, e.g. because the other member left, until
+ctx is done. The chat servers don't tell, so Central is asked as often as the servers are
+probed. A room must be missing twice in a row, Central replaces rooms it reroutes.
+*/
+func (c *Client) startRoomsJob(ctx context.Context) {
+	ticker := time.NewTicker(c.options.pingInterval)
+	defer ticker.Stop()
+	missing := make(map[string]bool)
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		for _, room := range c.Rooms() {
+			if !c.roomClosed(room.ID) {
+				delete(missing, room.ID)
+				continue
+			}
+			if missing[room.ID] {
+				delete(missing, room.ID)
+				c.leave(room.ID, ErrRoomClosed)
+				continue
+			}
+			missing[room.ID] = true
+		}
+	}
+}
+
+// roomClosed reports whether Central no longer knows a room, not when Central can't be reached
+func (c *Client) roomClosed(roomId string) bool {
+	httpClient := &http.Client{Timeout: 2 * time.Second}
+	resp, err := httpClient.Get(c.roomURL(roomId))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusNotFound
+}
+
+// leaveAll leaves every room, when the client stops
+func (c *Client) leaveAll() {
+	for _, room := range c.Rooms() {
+		c.Leave(room.ID)
+	}
+}
+
+// Send sends a message to a room, encrypted once the key exchange completed
+func (c *Client) Send(roomId, message string) error {
+	r, err := c.room(roomId)
+	if err != nil {
+		return err
+	}
+	if _, err := c.connected(r); err != nil {
+		return err
+	}
+	// Messages are framed by newlines, so a message can't contain any
+	message = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(message)
+	if c.queueUntilKeyed(r, message) {
+		return nil // Sent once the other member's key arrives
+	}
+	if sealed, ok := c.seal(r, []byte(message), c.username); ok {
+		message = encryptedMessagePrefix + sealed
+	}
+	if err := c.sendLine(r, message); err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+	return nil
+}
+
+// sendLine writes a single protocol line to the room's chat server as is
+func (c *Client) sendLine(r *chatRoom, line string) error {
+	conn, err := c.connected(r)
+	if err != nil {
+		return err
+	}
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+	_, err = conn.Write([]byte(line + "\n"))
+	return err
+}
+
+// connected returns the connection to the room's chat server, failing once left and while reconnecting
+func (c *Client) connected(r *chatRoom) (net.Conn, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch {
+	case !c.current(r):
+	case r.conn != nil:
+		return r.conn, nil
+	case r.rejoin:
+		return nil, ErrReconnecting
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNotInRoom, r.id)
+}
+
+/*
+readRoom handles the lines of a chat server connection until it closes. A reroute or
+Leave closing it is expected, otherwise the client reconnects, see reconnect.go.
+*/
+func (c *Client) readRoom(r *chatRoom, conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	closed := "" // Why the server disconnects us on purpose, we don't reconnect then
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			c.lock.Lock()
+			current, server := c.current(r) && r.conn == conn, r.server
+			if current {
+				r.conn, r.rejoin = nil, true
+			}
+			c.lock.Unlock()
+			switch {
+			case !current:
+			case closed != "":
+				c.abandonRoom(r, errors.New(closed))
+			default:
+				go c.reconnect(r, fmt.Errorf("connection to %s lost: %w", server, err))
+			}
+			return
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if reason, ok := strings.CutPrefix(line, closedNotice); ok {
+			closed, line = reason, "* "+reason
+		}
+		c.seen(r, conn, line)
+		if c.replayed(r, conn, line) {
+			continue
+		}
+		c.handleLine(r, line)
+	}
+}
+
+// handleLine processes a line of the room, file transfers and keys are shown as notices, not as raw lines
+func (c *Client) handleLine(r *chatRoom, line string) {
+	if notice, handled := c.handleFileMessage(r, line); handled {
+		if notice != "" {
+			c.deliver(r, notice)
+		}
+		return
+	}
+	if notice, handled := c.handleKeyMessage(r, line); handled {
+		if notice != "" {
+			c.deliver(r, notice)
+		}
+		return
+	}
+	if plaintext, handled := c.decryptMessage(r, line); handled {
+		line = plaintext
+	} else if notice := c.noteUnencrypted(r, line); notice != "" {
+		c.deliver(r, notice)
+	}
+	c.deliver(r, line)
+}
+
+// deliver publishes a line of the room, keeping it for the transcript
+func (c *Client) deliver(r *chatRoom, line string) {
+	c.lock.Lock()
+	server := r.server
+	c.lock.Unlock()
+
+	entry := TranscriptEntry{Time: time.Now(), Kind: EntryMessage, Server: server}
+	message := MessageReceived{RoomID: r.id, Time: entry.Time}
+	if notice, ok := strings.CutPrefix(line, "* "); ok {
+		entry.Kind, entry.Message = EntryNotice, notice
+		message.Notice, message.Text = true, notice
+	} else if sender, text, found := strings.Cut(line, ": "); found {
+		entry.Sender, entry.Message = sender, text
+		message.From, message.Text = sender, text
+	} else {
+		entry.Sender = line
+		message.Text = line
+	}
+	c.recordTranscript(r, entry)
+	c.recordHistory(r, entry)
+	c.emit(message)
+}
+
+// listenForReroutes accepts the connections Central makes to move us to another chat server
+func (c *Client) listenForReroutes(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		go c.reroute(conn)
+	}
+}
+
+/*
+reroute reads where Central moves us, the chat server and the room on their own lines.
+Central versions that predate rooms being named send the server only, which then applies
+to every room.
+*/
+func (c *Client) reroute(serverConn net.Conn) {
+	defer serverConn.Close()
+	buf := make([]byte, 1024)
+	n, err := serverConn.Read(buf)
+	if err != nil {
+		c.emit(ErrorEvent{Err: fmt.Errorf("failed to read reroute: %w", err)})
+		return
+	}
+	server, roomId, _ := strings.Cut(strings.TrimSpace(string(buf[:n])), "\n")
+	server, roomId = strings.TrimSpace(server), strings.TrimSpace(roomId)
+
+	rooms := []*chatRoom{}
+	c.lock.Lock()
+	for _, r := range c.rooms {
+		if roomId == "" || r.id == roomId {
+			rooms = append(rooms, r)
+		}
+	}
+	c.lock.Unlock()
+	for _, r := range rooms {
+		c.rerouteRoom(r, server)
+	}
+}
+
+// rerouteRoom moves a room to another chat server, the old server drains it once we leave
+func (c *Client) rerouteRoom(r *chatRoom, server string) {
+	newConn, err := net.Dial("tcp", net.JoinHostPort(server, chatPort))
+	if err != nil {
+		c.emit(ErrorEvent{RoomID: r.id, Err: fmt.Errorf("failed to connect to new server %s: %w", server, err)})
+		return
+	}
+	c.lock.Lock()
+	if !c.current(r) {
+		c.lock.Unlock()
+		newConn.Close() // Left the room meanwhile
+		return
+	}
+	// Central moving a room off a server that went down ends a reconnect
+	oldConn, oldServer, rejoined, lastLine := r.conn, r.server, r.rejoin, r.lastLine
+	r.conn, r.server, r.rejoin = newConn, server, false
+	if rejoined {
+		r.replay, r.notices = r.notices, nil
+	}
+	room := r.info()
+	c.lock.Unlock()
+	// Leave the old server so it can drain the room
+	if oldConn != nil {
+		oldConn.Close()
+	}
+
+	// Send the room ID to the new server
+	if _, err := newConn.Write([]byte(joinLine(c.username, r.id, lastLine, rejoined))); err != nil {
+		c.emit(ErrorEvent{RoomID: r.id, Err: fmt.Errorf("failed to send room ID: %w", err)})
+	}
+	c.recordTranscript(r, TranscriptEntry{Time: time.Now(), Kind: EntryReroute, Server: server})
+	c.recordReroute(Reroute{RoomID: r.id, From: oldServer, To: server, Time: time.Now()})
+	c.emit(Rerouted{RoomID: r.id, Server: server})
+	if rejoined {
+		c.emit(Reconnected{Room: room})
+	}
+	// A fresh key for the new server, the old one may have kept ours
+	if err := c.startKeyExchange(r); err != nil {
+		c.emit(ErrorEvent{RoomID: r.id, Err: fmt.Errorf("failed to start key exchange: %w", err)})
+	}
+	go c.readRoom(r, newConn)
+}
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Kinds of transcript entries
+const (
+	EntryMessage   = "message"
+	EntryNotice    = "notice"
+	EntryJoin      = "join"      // We joined the room, on Server
+	EntryReroute   = "reroute"   // Central moved us to Server
+	EntryReconnect = "reconnect" // We rejoined the room on Server after losing the connection
+)
+
+// Transcript formats, as the chat server's admin API exports them
+const (
+	FormatText     = "txt"
+	FormatJSON     = "json"
+	FormatMarkdown = "md"
+)
+
+// Entries kept per room, older ones are dropped
+const maxTranscriptEntries = 5000
+
+// TranscriptEntry is a line of a room, as it was shown, with the server we were on
+type TranscriptEntry struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Sender  string    `json:"sender,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Server  string    `json:"server"`
+}
+
+// recordTranscript keeps an entry of the room, for exports
+func (c *Client) recordTranscript(r *chatRoom, entry TranscriptEntry) {
+	r.transcriptLock.Lock()
+	defer r.transcriptLock.Unlock()
+	r.transcript = append(r.transcript, entry)
+	if len(r.transcript) > maxTranscriptEntries {
+		r.transcript = r.transcript[len(r.transcript)-maxTranscriptEntries:]
+	}
+}
+
+// ExportTranscript renders the transcript of a room as plain text, JSON or Markdown
+func (c *Client) ExportTranscript(roomId, format string) ([]byte, error) {
+	r, err := c.room(roomId)
+	if err != nil {
+		return nil, err
+	}
+	r.transcriptLock.Lock()
+	entries := append([]TranscriptEntry{}, r.transcript...)
+	r.transcriptLock.Unlock()
+
+	switch format {
+	case FormatJSON:
+		return json.MarshalIndent(map[string]interface{}{"roomId": roomId, "entries": entries}, "", "  ")
+	case FormatText, FormatMarkdown:
+	default:
+		return nil, fmt.Errorf("unknown transcript format %s, use txt, json or md", format)
+	}
+
+	markdown := format == FormatMarkdown
+	var out bytes.Buffer
+	if markdown {
+		fmt.Fprintf(&out, "# Transcript of room %s\n\n", roomId)
+	} else {
+		fmt.Fprintf(&out, "Transcript of room %s\n\n", roomId)
+	}
+
+	for i, entry := range entries {
+		timestamp := entry.Time.Format("2006-01-02 15:04:05")
+
+		// Joins, reroutes and reconnects start a span handled by another server
+		marker := ""
+		switch entry.Kind {
+		case EntryJoin:
+			marker = fmt.Sprintf("Joined on server %s at %s", entry.Server, timestamp)
+		case EntryReroute:
+			marker = fmt.Sprintf("Rerouted to server %s at %s", entry.Server, timestamp)
+		case EntryReconnect:
+			marker = fmt.Sprintf("Reconnected to server %s at %s", entry.Server, timestamp)
+		}
+		if marker != "" {
+			if markdown {
+				if i > 0 {
+					out.WriteString("\n")
+				}
+				fmt.Fprintf(&out, "**%s**\n\n", marker)
+			} else {
+				fmt.Fprintf(&out, "--- %s ---\n", marker)
+			}
+			continue
+		}
+
+		line := fmt.Sprintf("%s: %s", entry.Sender, entry.Message)
+		if markdown {
+			line = fmt.Sprintf("**%s**: %s", entry.Sender, entry.Message)
+		}
+		if entry.Kind == EntryNotice {
+			line = "* " + entry.Message
+			if markdown {
+				line = "_" + entry.Message + "_"
+			}
+		}
+
+		if markdown {
+			fmt.Fprintf(&out, "- `%s` %s\n", timestamp, line)
+		} else {
+			fmt.Fprintf(&out, "[%s] %s\n", timestamp, line)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// SaveTranscript exports the transcript of a room to the downloads directory
+func (c *Client) SaveTranscript(roomId, format string) (string, error) {
+	data, err := c.ExportTranscript(roomId, format)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(c.options.downloadDir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(c.options.downloadDir, fmt.Sprintf("transcript-%s.%s", roomId, format))
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to save transcript: %w", err)
+	}
+	return path, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"client/bot"
+	"client/client"
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+)
+
+// Echo bot: repeats every message back to the room
+func main() {
+	centralURL := flag.String("central", "http://localhost:8080", "URL of the Central server")
+	username := flag.String("name", "echobot", "Username to register")
+	requestPort := flag.Int("request-port", 0, "Port to listen on for chat requests, 0 picks a free one")
+	reroutePort := flag.Int("reroute-port", 0, "Port to listen on for reroutes, 0 picks a free one")
+	flag.Parse()
+
+	b, err := bot.New(bot.Config{
+		Username:    *username,
+		CentralURL:  *centralURL,
+		Description: "Repeats everything you say",
+		Options:     []client.Option{client.WithRequestPort(*requestPort), client.WithReroutePort(*reroutePort)},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	b.OnJoin(func(b *bot.Bot, roomId, with string) {
+		b.Say("Hi " + with + ", I repeat everything you say")
+	})
+	b.OnMessage(func(b *bot.Bot, message bot.Message) {
+		b.Say(message.Text)
+	})
+
+	// Deregister on Ctrl-C, so the name can be used again
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := b.Run(ctx); err != nil {
+		log.Fatalf("Echo bot stopped: %v", err)
+	}
+}
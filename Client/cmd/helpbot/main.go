@@ -0,0 +1,76 @@
+package main
+
+import (
+	"client/bot"
+	"client/client"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Help bot: answers a few commands, and points at the others
+func main() {
+	centralURL := flag.String("central", "http://localhost:8080", "URL of the Central server")
+	username := flag.String("name", "helpbot", "Username to register")
+	requestPort := flag.Int("request-port", 0, "Port to listen on for chat requests, 0 picks a free one")
+	reroutePort := flag.Int("reroute-port", 0, "Port to listen on for reroutes, 0 picks a free one")
+	flag.Parse()
+
+	b, err := bot.New(bot.Config{
+		Username:    *username,
+		CentralURL:  *centralURL,
+		Description: "Answers questions about using the chat, say help",
+		Options:     []client.Option{client.WithRequestPort(*requestPort), client.WithReroutePort(*reroutePort)},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	commands := map[string]string{
+		"help":  "Lists the commands",
+		"files": "How to send and save files",
+		"ping":  "Checks the bot is there",
+		"time":  "Tells the time on the bot's machine",
+		"bye":   "Ends the chat",
+	}
+	b.OnJoin(func(b *bot.Bot, roomId, with string) {
+		b.Say(fmt.Sprintf("Hi %s, say help to see what I can do", with))
+	})
+	b.OnMessage(func(b *bot.Bot, message bot.Message) {
+		switch strings.ToLower(strings.TrimSpace(message.Text)) {
+		case "help":
+			names := []string{}
+			for name := range commands {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				b.Say(fmt.Sprintf("%s: %s", name, commands[name]))
+			}
+		case "files":
+			b.Say("Type /send <path> to share a file, and /save <id> to save one you received")
+		case "ping":
+			b.Say("pong")
+		case "time":
+			b.Say(time.Now().Format(time.RFC1123))
+		case "bye":
+			b.Say("Bye " + message.From)
+			b.Leave()
+		default:
+			b.Say("I don't know that one, say help to see what I can do")
+		}
+	})
+
+	// Deregister on Ctrl-C, so the name can be used again
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := b.Run(ctx); err != nil {
+		log.Fatalf("Help bot stopped: %v", err)
+	}
+}
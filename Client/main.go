@@ -1,9 +1,26 @@
 package main
 
-import clientrunner "client/runner"
+import (
+	"client/cli"
+	"client/client"
+	clientrunner "client/runner"
+	"flag"
+	"os"
+	"strings"
+)
 
 func main() {
-	clientrunner.NewClientRunner().Start()
+	// Subcommands run the headless client, see the cli package
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(cli.Run(os.Args[1:]))
+	}
+
+	requestPort := flag.Int("request-port", 3001, "Port to listen on for chat requests, 0 picks a free one")
+	reroutePort := flag.Int("reroute-port", 3003, "Port to listen on for reroutes, 0 picks a free one")
+	historyDir := flag.String("history", "history", "Directory of the encrypted chat history, empty keeps none")
+	flag.Parse()
+
+	clientrunner.NewClientRunner(*historyDir, client.WithRequestPort(*requestPort), client.WithReroutePort(*reroutePort)).Start()
 	go func() {
 		for {
 			// Do nothing, just loop forever
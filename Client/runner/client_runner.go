@@ -2,6 +2,8 @@ package clientrunner
 
 import (
 	"client/client"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -25,30 +27,57 @@ const (
 var options = []string{
 	"1. Send a chat request",
 	"2. View chat requests",
+	"3. Open chats",
+	"4. Chat history",
+	"5. Contacts",
+	"6. Connection diagnostics",
 }
 
-var (
-	ACK_CONN       = "ACK"
-	MSG_REQ_SENT   = "REQ_SENT"
-	AWAITING_REQ   = "AWAITING_REQ"
-	USER_NOT_FOUND = "USER_NOT_FOUND"
-	SERVER_ERROR   = "SERVER_ERROR"
-	REQ_ACCEPTED   = "REQ_ACCEPTED"
-	ACCEPT_REQ     = "ACCEPT_REQ"
-)
-
 type ClientRunner interface {
 	Start()
 }
 
 type clientRunner struct {
-	client *client.Client
-	app    *tview.Application
-	pages  *tview.Pages
+	options     []client.Option
+	historyDir  string // Where the chat history is kept, empty to keep none
+	client      *client.Client
+	ctx         context.Context // Stops the client, on quit
+	cancel      context.CancelFunc
+	app         *tview.Application
+	pages       *tview.Pages
+	chat        *chatView             // Views of the chat page, nil until the first room
+	rooms       map[string]*roomState // Rooms the client is in, by ID
+	order       []string              // Room IDs in the order of their tabs
+	active      string                // Room shown on the chat page
+	matchmaking func(status string)   // Shows the progress of our pending chat request
+	menu        *tview.List
+	menuFrame   *tview.Frame // Its header tells about pending chat requests
+	contacts    *tview.List  // The list of the contacts page, to keep the selection as it refreshes
+}
+
+// chatView holds the views of the chat page, they show the active room
+type chatView struct {
+	tabs      *tview.TextView
+	header    *tview.TextView
+	status    *tview.TextView // Banner shown while the connection is lost
+	messages  *tview.TextView
+	transfers *tview.TextView
 }
 
-func NewClientRunner() ClientRunner {
-	return &clientRunner{client: client.GetClient()}
+// roomState is what the chat page shows for a room, kept while other rooms are shown
+type roomState struct {
+	room      client.Room
+	text      string
+	status    string
+	transfers string
+	unread    int // Messages received while the room wasn't shown
+}
+
+const chatHint = "[gray]/send <path> to share a file, /save <id> to save one, /export [txt|json|md] for a transcript, /plaintext to skip encryption, /leave to close the chat[white]"
+
+// NewClientRunner creates the interactive client, keeping the chat history in historyDir, options are passed on to client.New
+func NewClientRunner(historyDir string, options ...client.Option) ClientRunner {
+	return &clientRunner{options: options, historyDir: historyDir, rooms: make(map[string]*roomState)}
 }
 
 func (cr *clientRunner) Start() {
@@ -56,6 +85,7 @@ func (cr *clientRunner) Start() {
 	cr.pages = tview.NewPages()
 	cr.startup()
 	cr.drawMenu()
+	go cr.handleEvents()
 
 	cr.app.SetRoot(cr.pages, true).Run()
 }
@@ -75,24 +105,21 @@ func clearTerminal() {
 }
 
 // Deprecate after migrating everything to Tview
-func (cr *clientRunner) showLoadingBarWithInitialization(task string, initFunc func() <-chan error) error {
-	// Call the initialization function and get the result channel
-	resultChan := initFunc()
+func (cr *clientRunner) showLoadingBarWithInitialization(task string, initFunc func() error) error {
+	// Run the initialization function and wait for its result
+	resultChan := make(chan error)
+	go func() { resultChan <- initFunc() }()
 
 	fmt.Printf("%s", task)
 	dots := ""
 
 	for {
 		select {
-		case _, ok := <-resultChan:
+		case err := <-resultChan:
 			fmt.Printf("\r%s%s", task, "...")
-			// Exit the loop if the channel is closed
-			if ok {
-				fmt.Println(" done!")
-				return nil
-			} else {
-				fmt.Println("Error!")
-				os.Exit(1)
+			if err != nil {
+				fmt.Println(" error!")
+				return err
 			}
 			fmt.Println(" done!")
 			return nil
@@ -113,21 +140,48 @@ func (cr *clientRunner) startup() {
 	clearTerminal() // Clear terminal before showing the message
 	fmt.Println(string(blue) + "Welcome to Low Latency Chat!" + reset)
 	fmt.Println(string(green) + "Enter your username to begin:" + reset)
-	fmt.Scanln(&cr.client.UserName)
+	username := ""
+	fmt.Scanln(&username)
 	clearTerminal()
-	fmt.Printf("Hello, %s! Let's get you setup...\n", cr.client.UserName)
+	fmt.Printf("Hello, %s! Let's get you setup...\n", username)
+
+	// The history is encrypted with a passphrase, without one none is kept
+	if cr.historyDir != "" {
+		fmt.Println(string(green) + "Enter the passphrase of your chat history, or nothing to keep none:" + reset)
+		passphrase := readPassphrase()
+		if passphrase != "" {
+			cr.options = append(cr.options, client.WithHistory(cr.historyDir, passphrase))
+		}
+	}
 
-	err := cr.showLoadingBarWithInitialization("Registering", cr.client.Register)
+	url, err := client.ReadConfig(client.ConfigFile)
 	if err != nil {
-		fmt.Println(string(red) + "Failed to register client. Please try again later." + reset)
+		fmt.Println(string(red) + "Error reading config: " + err.Error() + reset)
 		os.Exit(1)
-		return
 	}
-	err = cr.showLoadingBarWithInitialization("Fetching Servers", cr.client.Initialize)
+	cr.client, err = client.New(url, username, cr.options...)
 	if err != nil {
-		fmt.Println(string(red) + "Failed to fetch servers. Please try again later." + reset)
+		fmt.Println(string(red) + err.Error() + reset)
+		os.Exit(1)
+	}
+
+	cr.ctx, cr.cancel = context.WithCancel(context.Background())
+	err = cr.showLoadingBarWithInitialization("Registering", func() error { return cr.client.Start(cr.ctx) })
+	if errors.Is(err, client.ErrUsernameTaken) {
+		fmt.Println(string(red) + "Please Register Using a unique username!" + reset)
+		os.Exit(1)
+	}
+	if errors.Is(err, client.ErrWrongPassphrase) {
+		fmt.Println(string(red) + "Wrong passphrase for your chat history!" + reset)
+		os.Exit(1)
+	}
+	if errors.Is(err, client.ErrHistoryTampered) {
+		fmt.Println(string(red) + "Your chat history was changed outside the client! " + err.Error() + reset)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Println(string(red) + "Failed to register client. Please try again later. " + err.Error() + reset)
 		os.Exit(1)
-		return
 	}
 	time.Sleep(1 * time.Second)
 	clearTerminal()
@@ -135,51 +189,253 @@ func (cr *clientRunner) startup() {
 	clearTerminal()
 }
 
-func (cr *clientRunner) acceptChatRequest(username string) {
-	textView := tview.NewTextView().SetChangedFunc(func() { cr.app.Draw() }).SetRegions(true)
-	frame := tview.NewFrame(textView)
-	frame.SetTitle(fmt.Sprintf("Accepting Chat Request with %s", username)).SetTitleAlign(tview.AlignCenter)
-	frame.SetBorder(true)
-	cr.pages.AddAndSwitchToPage("acceptingChatRequest", frame, true)
-	go func() {
-		statusChannel := make(chan string)
-		defer close(statusChannel)
-
-		go cr.client.AcceptMessageRequest(username, statusChannel)
-
-		text := fmt.Sprintf("Accepting request from %s... ", username)
-		textView.SetText(text)
-		response := <-statusChannel
-		if response == ACCEPT_REQ {
-			text += "[green]Accepted![white]\n"
-			textView.SetText(text)
-		} else {
-			textView.SetText("[red]Chat request declined! [red]You cannot chat with " + username + "[white]")
-			time.Sleep(1 * time.Second)
-			cr.pages.SwitchToPage("menu")
+// handleEvents applies the client's events to the UI, on the UI goroutine
+func (cr *clientRunner) handleEvents() {
+	for {
+		select {
+		case event := <-cr.client.Events():
+			cr.app.QueueUpdateDraw(func() { cr.handleEvent(event) })
+		case <-cr.ctx.Done():
 			return
 		}
-		text += "Awaiting for server matchmaking..."
-		textView.SetText(text)
-		response = <-statusChannel
-		if response == SERVER_ERROR {
-			textView.SetText("[red]Failed to connect to server! Please try again later.")
-			time.Sleep(1 * time.Second)
-			cr.pages.SwitchToPage("menu")
+	}
+}
+
+func (cr *clientRunner) handleEvent(event client.Event) {
+	switch event := event.(type) {
+	case client.RequestProgress:
+		if cr.matchmaking != nil {
+			cr.matchmaking(event.Status)
+		}
+	case client.RequestReceived:
+		cr.refreshRequests()
+	case client.RequestCancelled:
+		cr.refreshRequests()
+		if front, _ := cr.pages.GetFrontPage(); front == "answerRequest:"+event.From {
+			cr.pages.RemovePage(front)
+			if event.Expired {
+				cr.showError(fmt.Sprintf("The chat request from %s expired", event.From))
+			} else {
+				cr.showError(fmt.Sprintf("%s withdrew their chat request", event.From))
+			}
+		}
+	case client.Matched:
+		cr.matchmaking = nil
+		cr.addRoom(event.Room)
+		cr.refreshRequests()
+	case client.MessageReceived:
+		state, ok := cr.rooms[event.RoomID]
+		if !ok {
 			return
 		}
-		roomId := <-statusChannel
-		if roomId == SERVER_ERROR {
-			textView.SetText("[red]Failed to connect to server! Please try again later.")
-			time.Sleep(1 * time.Second)
+		if event.From == cr.client.Username() {
+			state.text += "[yellow]" + event.String() + "[white]\n"
+		} else {
+			state.text += "[green]" + event.String() + "[white]\n"
+		}
+		if !cr.showing(event.RoomID) {
+			state.unread++
+		}
+		cr.renderChat()
+	case client.Rerouted:
+		cr.refreshRoom(event.RoomID)
+	case client.Reconnecting:
+		if state, ok := cr.rooms[event.RoomID]; ok {
+			state.status = fmt.Sprintf("[black:yellow] Connection lost, reconnecting in %s (attempt %d): %v ",
+				event.Retry.Round(time.Millisecond), event.Attempt, event.Err)
+			cr.refreshRoom(event.RoomID)
+		}
+	case client.Reconnected:
+		if state, ok := cr.rooms[event.Room.ID]; ok {
+			state.status = "[black:green] Reconnected to server " + event.Room.Server + " "
+			cr.refreshRoom(event.Room.ID)
+			time.AfterFunc(5*time.Second, func() {
+				cr.app.QueueUpdateDraw(func() {
+					if room, ok := cr.client.Room(event.Room.ID); ok && !room.Reconnecting && cr.rooms[room.ID] == state {
+						state.status = ""
+						cr.renderChat()
+					}
+				})
+			})
+		}
+	case client.TransferUpdated:
+		if state, ok := cr.rooms[event.Transfer.RoomID]; ok {
+			state.transfers = formatTransfer(event.Transfer)
+			cr.renderChat()
+		}
+	case client.ContactsUpdated:
+		cr.refreshContacts()
+	case client.ContactAdded:
+		cr.contactAdded(event.By)
+	case client.Left:
+		cr.removeRoom(event.RoomID)
+		if event.Err != nil {
+			cr.showError(fmt.Sprintf("You left the room: %v", event.Err))
+		}
+	case client.ErrorEvent:
+		roomId := event.RoomID
+		if roomId == "" {
+			roomId = cr.active
+		}
+		if state, ok := cr.rooms[roomId]; ok {
+			state.transfers = "[red]" + event.Err.Error() + "[white]"
+			cr.renderChat()
+		}
+	}
+}
+
+// addRoom opens a tab for a room the client joined, and shows it
+func (cr *clientRunner) addRoom(room client.Room) {
+	if state, ok := cr.rooms[room.ID]; ok {
+		state.room = room
+	} else {
+		cr.rooms[room.ID] = &roomState{room: room}
+		cr.order = append(cr.order, room.ID)
+	}
+	cr.showRoom(room.ID)
+}
+
+// removeRoom closes the tab of a room the client left, showing the next one if it was shown
+func (cr *clientRunner) removeRoom(roomId string) {
+	index := -1
+	for i, id := range cr.order {
+		if id == roomId {
+			index = i
+		}
+	}
+	if index < 0 {
+		return
+	}
+	shown := cr.showing(roomId)
+	delete(cr.rooms, roomId)
+	cr.order = append(cr.order[:index], cr.order[index+1:]...)
+	if cr.active != roomId {
+		cr.renderChat()
+		return
+	}
+
+	cr.active = ""
+	switch {
+	case len(cr.order) == 0:
+		if shown {
 			cr.pages.SwitchToPage("menu")
+		}
+	case shown:
+		cr.showRoom(cr.order[min(index, len(cr.order)-1)])
+	default:
+		cr.active = cr.order[min(index, len(cr.order)-1)]
+	}
+}
+
+// refreshRoom updates what the client knows of a room, e.g. its server after a reroute
+func (cr *clientRunner) refreshRoom(roomId string) {
+	state, ok := cr.rooms[roomId]
+	if !ok {
+		return
+	}
+	if room, ok := cr.client.Room(roomId); ok {
+		state.room = room
+	}
+	cr.renderChat()
+}
+
+// showing tells if the chat page is shown with roomId in front
+func (cr *clientRunner) showing(roomId string) bool {
+	front, _ := cr.pages.GetFrontPage()
+	return front == "chat" && cr.active == roomId
+}
+
+// showRoom switches the chat page to a room, its messages are read then
+func (cr *clientRunner) showRoom(roomId string) {
+	state, ok := cr.rooms[roomId]
+	if !ok {
+		return
+	}
+	cr.chatPage()
+	cr.active = roomId
+	state.unread = 0
+	cr.pages.SwitchToPage("chat")
+	cr.renderChat()
+}
+
+// cycleRooms shows the next tab, or the previous one for a negative step
+func (cr *clientRunner) cycleRooms(step int) {
+	for i, id := range cr.order {
+		if id == cr.active {
+			cr.showRoom(cr.order[(i+step+len(cr.order))%len(cr.order)])
 			return
 		}
+	}
+}
 
-		text += "[green]Connected![white]\n"
-		text += "Joining chat server on " + response
-		textView.SetText(text)
-		go cr.chatPage(response, roomId)
+// renderChat shows the active room on the chat page, and the tabs of all rooms
+func (cr *clientRunner) renderChat() {
+	if cr.chat == nil {
+		return
+	}
+	tabs := ""
+	for _, id := range cr.order {
+		state := cr.rooms[id]
+		label := state.room.With
+		if state.room.Reconnecting {
+			label += " …"
+		}
+		if state.unread > 0 {
+			label += fmt.Sprintf(" (%d)", state.unread)
+		}
+		if id == cr.active {
+			tabs += "[black:white] " + tview.Escape(label) + " [-:-] "
+		} else {
+			tabs += " " + tview.Escape(label) + "  "
+		}
+	}
+	if pending := len(cr.client.PendingRequests()); pending > 0 {
+		tabs += fmt.Sprintf(" [black:yellow] %s, Ctrl-R to answer [-:-]", requestCount(pending))
+	}
+	cr.chat.tabs.SetText(tabs + " [gray]Tab: next chat, Ctrl-D: diagnostics, Esc: menu[white]")
+
+	state, ok := cr.rooms[cr.active]
+	if !ok {
+		return
+	}
+	cr.chat.header.SetText(chatHeader(cr.client, state.room))
+	cr.chat.status.SetText(state.status)
+	cr.chat.messages.SetText(state.text)
+	if state.transfers == "" {
+		cr.chat.transfers.SetText(chatHint)
+	} else {
+		cr.chat.transfers.SetText(state.transfers)
+	}
+}
+
+// showError tells the user what went wrong, and goes back to the menu
+func (cr *clientRunner) showError(message string) {
+	modal := tview.NewModal().
+		SetText(message).
+		AddButtons([]string{"OK"}).
+		SetDoneFunc(func(int, string) {
+			cr.pages.RemovePage("error")
+			cr.pages.SwitchToPage("menu")
+		})
+	cr.pages.AddAndSwitchToPage("error", modal, true)
+}
+
+func (cr *clientRunner) acceptChatRequest(username string) {
+	textView := tview.NewTextView().SetRegions(true).SetDynamicColors(true)
+	frame := tview.NewFrame(textView)
+	frame.SetTitle(fmt.Sprintf("Accepting Chat Request with %s", username)).SetTitleAlign(tview.AlignCenter)
+	frame.SetBorder(true)
+	cr.pages.AddAndSwitchToPage("acceptingChatRequest", frame, true)
+	textView.SetText(fmt.Sprintf("Accepting request from %s... Awaiting for server matchmaking...", username))
+
+	// The chat page opens on the Matched event
+	go func() {
+		if _, err := cr.client.Accept(cr.ctx, username); err != nil {
+			cr.app.QueueUpdateDraw(func() {
+				cr.refreshRequests()
+				cr.showError(fmt.Sprintf("Failed to chat with %s: %v", username, err))
+			})
+		}
 	}()
 }
 
@@ -187,23 +443,65 @@ func (cr *clientRunner) drawMenu() {
 	list := tview.NewList().
 		AddItem(options[0], "Begin a chat with another user!", 'a', cr.beginChatPage).
 		AddItem(options[1], "View your incoming message requests!", 'b', cr.beginChatRequestPage).
+		AddItem(options[2], "Switch to the chats you are in!", 'c', func() {
+			if cr.active == "" {
+				cr.showError("You are not in any chat yet")
+				return
+			}
+			cr.showRoom(cr.active)
+		}).
+		AddItem(options[3], "Browse and search your past chats!", 'd', cr.historyPage).
+		AddItem(options[4], "See who is online and ask them to chat!", 'e', cr.contactsPage).
+		AddItem(options[5], "See the latency to each server and why your chat is routed there!", 'f', cr.diagnosticsPage).
 		AddItem("Quit", "Press to exit", 'q', func() {
+			// Leave the rooms and deregister before exiting
+			cr.cancel()
+			select {
+			case <-cr.client.Done():
+			case <-time.After(3 * time.Second):
+			}
 			cr.app.Stop()
 			os.Exit(0)
 		})
 	frame := tview.NewFrame(list).SetBorders(0, 0, 0, 0, 0, 0)
 	frame.SetTitle("Main Menu").SetTitleAlign(tview.AlignCenter)
 	frame.SetBorder(true)
+	cr.menu, cr.menuFrame = list, frame
 	cr.pages.AddPage("menu", frame, true, true)
 }
 
+// refreshRequests shows how many chat requests wait for an answer, wherever the user is
+func (cr *clientRunner) refreshRequests() {
+	pending := cr.client.PendingRequests()
+	main := options[1]
+	cr.menuFrame.Clear()
+	if len(pending) > 0 {
+		main += fmt.Sprintf(" (%d)", len(pending))
+		cr.menuFrame.AddText(fmt.Sprintf("%s waiting, press b to answer", requestCount(len(pending))), true, tview.AlignCenter, tcell.ColorYellow)
+	}
+	cr.menu.SetItemText(1, main, "View your incoming message requests!")
+	cr.renderChat()
+	if front, _ := cr.pages.GetFrontPage(); front == "chatRequests" {
+		cr.beginChatRequestPage()
+	}
+}
+
+// requestCount describes a number of pending chat requests
+func requestCount(pending int) string {
+	if pending == 1 {
+		return "1 chat request"
+	}
+	return fmt.Sprintf("%d chat requests", pending)
+}
+
 func (cr *clientRunner) beginChatRequestPage() {
 	list := tview.NewList()
 	list.AddItem("Back", "", 'q', func() {
 		cr.pages.SwitchToPage("menu")
 	})
-	for username := range cr.client.ChatRequests {
-		list.AddItem("Chat Request from: "+username, "", 0, func() { cr.acceptChatRequest(username) })
+	// The list follows requests arriving, and going away unanswered
+	for _, username := range cr.client.PendingRequests() {
+		list.AddItem("Chat Request from: "+username, "Enter to accept or decline", 0, func() { cr.answerRequest(username) })
 	}
 	frame := tview.NewFrame(list).SetBorders(0, 0, 0, 0, 0, 0)
 	frame.SetTitle("").SetTitleAlign(tview.AlignCenter)
@@ -211,6 +509,31 @@ func (cr *clientRunner) beginChatRequestPage() {
 	cr.pages.AddAndSwitchToPage("chatRequests", frame, true)
 }
 
+// answerRequest asks whether to accept or decline the chat request of username
+func (cr *clientRunner) answerRequest(username string) {
+	page := "answerRequest:" + username
+	modal := tview.NewModal().
+		SetText(fmt.Sprintf("%s wants to chat with you", username)).
+		AddButtons([]string{"Accept", "Decline", "Later"}).
+		SetDoneFunc(func(_ int, label string) {
+			cr.pages.RemovePage(page)
+			switch label {
+			case "Accept":
+				cr.acceptChatRequest(username)
+			case "Decline":
+				if err := cr.client.Decline(username); err != nil {
+					cr.showError(err.Error())
+					return
+				}
+				cr.refreshRequests()
+				cr.beginChatRequestPage()
+			default:
+				cr.beginChatRequestPage()
+			}
+		})
+	cr.pages.AddAndSwitchToPage(page, modal, true)
+}
+
 func (cr *clientRunner) beginChatPage() {
 	usernameInput := tview.NewInputField().SetLabel("Enter username: ").SetFieldWidth(30).SetFieldBackgroundColor(tview.Styles.PrimitiveBackgroundColor)
 	frame := tview.NewFrame(tview.NewForm().
@@ -229,199 +552,238 @@ func (cr *clientRunner) beginChatPage() {
 	cr.pages.AddAndSwitchToPage("beginChat", frame, true)
 }
 
-func (cr *clientRunner) chatPage(serverAddr string, roomId string) {
-	// Channel to receive chat messages
-	messagesChannel := make(chan string)
+// chatPage creates the chat page, once, it shows one room at a time
+func (cr *clientRunner) chatPage() {
+	if cr.chat != nil {
+		return
+	}
+	chat := &chatView{}
+	cr.chat = chat
 
-	// Start the chat with the server
-	go cr.client.StartChat(messagesChannel, serverAddr, roomId)
+	// Create a text view for the tabs of the rooms
+	chat.tabs = tview.NewTextView().
+		SetDynamicColors(true).
+		SetWrap(false)
 
 	// Create a text view to display the server name
-	headerView := tview.NewTextView().
+	chat.header = tview.NewTextView().
 		SetDynamicColors(true).
 		SetScrollable(false).
 		SetWrap(false).
-		SetTextAlign(tview.AlignCenter).
-		SetText("[cyan]Chatting on server: [white]" + cr.client.CurrentChatServer)
+		SetTextAlign(tview.AlignCenter)
+
+	// Create a text view for the connection banner, empty while connected
+	chat.status = tview.NewTextView().
+		SetDynamicColors(true).
+		SetWrap(false).
+		SetTextAlign(tview.AlignCenter)
 
 	// Create a text view to display chat messages
-	chatView := tview.NewTextView().
+	chat.messages = tview.NewTextView().
 		SetDynamicColors(true).
 		SetScrollable(false).
-		SetWrap(true).
-		SetChangedFunc(func() {
-			cr.app.Draw()
-		})
+		SetWrap(true)
 
 	// Create an input field for user input
 	inputField := tview.NewInputField().
 		SetLabel("Enter a message: ").
 		SetFieldWidth(30)
 
+	// Create a text view to show the progress of file transfers
+	chat.transfers = tview.NewTextView().
+		SetDynamicColors(true).
+		SetWrap(false).
+		SetText(chatHint)
+
+	// Commands apply to the room shown when they are entered
+	fail := func(roomId string, err error) {
+		if state, ok := cr.rooms[roomId]; ok {
+			state.transfers = "[red]" + err.Error() + "[white]"
+			cr.renderChat()
+		}
+	}
 	inputField.SetDoneFunc(func(key tcell.Key) {
 		if key == tcell.KeyEnter {
 			// Get user input
 			userMessage := inputField.GetText()
-			cr.client.SendMessage(userMessage)
 			inputField.SetText("")
+			roomId := cr.active
+			if userMessage == "/plaintext" {
+				if err := cr.client.AllowPlaintext(roomId); err != nil {
+					fail(roomId, err)
+				}
+				cr.renderChat()
+				return
+			}
+			if userMessage == "/leave" {
+				if err := cr.client.Leave(roomId); err != nil {
+					fail(roomId, err)
+				}
+				return
+			}
+			if path, ok := strings.CutPrefix(userMessage, "/send "); ok {
+				if err := cr.client.SendFile(roomId, strings.TrimSpace(path)); err != nil {
+					fail(roomId, err)
+				}
+				return
+			}
+			if format, ok := strings.CutPrefix(userMessage, "/export"); ok {
+				format = strings.TrimSpace(format)
+				if format == "" {
+					format = client.FormatText
+				}
+				path, err := cr.client.SaveTranscript(roomId, format)
+				if err != nil {
+					fail(roomId, err)
+				} else if state, ok := cr.rooms[roomId]; ok {
+					state.transfers = "[green]Transcript saved to " + path + "[white]"
+					cr.renderChat()
+				}
+				return
+			}
+			if id, ok := strings.CutPrefix(userMessage, "/save "); ok {
+				if err := cr.client.AcceptFile(roomId, strings.TrimSpace(id)); err != nil {
+					fail(roomId, err)
+				}
+				return
+			}
+			if err := cr.client.Send(roomId, userMessage); err != nil {
+				fail(roomId, err)
+			}
 		}
 	})
 
 	// Create a grid layout
 	grid := tview.NewGrid().
-		SetRows(1, 0, 3).                             // Header (fixed height), chat area (expandable), and input area (fixed height)
-		SetColumns(0).                                // Full width
-		AddItem(headerView, 0, 0, 1, 1, 0, 0, false). // Server name at the top
-		AddItem(chatView, 1, 0, 1, 1, 0, 0, false).   // Chat messages in the middle
-		AddItem(inputField, 2, 0, 1, 1, 0, 0, true)   // Input field at the bottom
-
-	// Add the grid to pages and switch to it
-	cr.pages.AddAndSwitchToPage("chat", grid, true)
-
-	//Wait for the chat to start
-	start := <-messagesChannel
-	if start != "START_CHAT" {
-		cr.pages.SwitchToPage("menu")
-		close(messagesChannel)
-		return
-	}
-
-	// Goroutine to listen to messages from the server
-	go func() {
-		text := ""
-		for serverMessage := range messagesChannel {
-			// We know that cr.client.CurrentChatServer is hydrated for sure, so now we set it again
-			headerView.SetText("[cyan]Chatting on server: [white]" + cr.client.CurrentChatServer)
-			if strings.HasPrefix(serverMessage, cr.client.UserName) {
-				text += "[yellow]" + serverMessage + "[white]\n"
-			} else {
-				text += "[green]" + serverMessage + "[white]\n"
-			}
-			chatView.SetText(text)
+		SetRows(1, 1, 1, 0, 1, 3).                        // Tabs, header and banner (fixed height), chat area (expandable), transfers and input area (fixed height)
+		SetColumns(0).                                    // Full width
+		AddItem(chat.tabs, 0, 0, 1, 1, 0, 0, false).      // Rooms at the top
+		AddItem(chat.header, 1, 0, 1, 1, 0, 0, false).    // Server name of the room shown
+		AddItem(chat.status, 2, 0, 1, 1, 0, 0, false).    // Connection status
+		AddItem(chat.messages, 3, 0, 1, 1, 0, 0, false).  // Chat messages in the middle
+		AddItem(chat.transfers, 4, 0, 1, 1, 0, 0, false). // File transfer progress
+		AddItem(inputField, 5, 0, 1, 1, 0, 0, true)       // Input field at the bottom
+
+	// Tab and Ctrl-N switch to the next room, Shift-Tab and Ctrl-P to the previous one, Ctrl-R opens the requests
+	grid.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyTab, tcell.KeyCtrlN:
+			cr.cycleRooms(1)
+		case tcell.KeyBacktab, tcell.KeyCtrlP:
+			cr.cycleRooms(-1)
+		case tcell.KeyEscape:
+			cr.pages.SwitchToPage("menu")
+		case tcell.KeyCtrlR:
+			cr.beginChatRequestPage()
+		case tcell.KeyCtrlD:
+			cr.diagnosticsPage()
+		default:
+			return event
 		}
-	}()
+		return nil
+	})
 
+	cr.pages.AddPage("chat", grid, true, false)
 }
 
 func (cr *clientRunner) startMatchMaking(username string) {
-	textView := tview.NewTextView().SetChangedFunc(func() { cr.app.Draw() })
+	textView := tview.NewTextView().SetRegions(true).SetDynamicColors(true)
 	frame := tview.NewFrame(textView)
 	frame.SetTitle("Matchmaking").SetTitleAlign(tview.AlignCenter)
 	frame.SetBorder(true)
 	cr.pages.AddAndSwitchToPage("matchmaking", frame, true)
-	responseChannel := make(chan string)
-	go cr.client.StartMatchmaking(username, responseChannel) // Make sure to run this in a goroutine
-	go func() {
-		text := ""
-		text += "Waiting for server..."
-		textView.SetRegions(true).SetText(text)
-		response := <-responseChannel
-		if response == ACK_CONN {
-			text += " [green]Connected![white]\n"
-			textView.SetText(text)
-		} else {
-			textView.Clear()
-			textView.SetText("Failed to connect to server! [red]Please try again later")
-			cr.pages.SwitchToPage("menu")
-			// close the channel
-			close(responseChannel)
+
+	text := "Waiting for server..."
+	awaiting := false
+	dots := []string{".", "..", "...", "....", ".....", "......"}
+	dotIdx := 0
+	render := func() {
+		if awaiting {
+			textView.SetText(text + "Awaiting response" + dots[dotIdx])
 			return
 		}
-		//time.Sleep(1 * time.Second)
-		text += fmt.Sprintf("Sending chat request to %s...", username)
 		textView.SetText(text)
-		response = <-responseChannel
-		if response == MSG_REQ_SENT {
+	}
+	render()
+	cr.matchmaking = func(status string) {
+		switch status {
+		case client.ACK_CONN:
+			text += " [green]Connected![white]\n"
+			text += fmt.Sprintf("Sending chat request to %s...", username)
+		case client.MSG_REQ_SENT:
 			text += " [green]Sent![white]\n"
-			textView.SetText(text)
-		} else {
-			textView.Clear()
-			textView.SetText(fmt.Sprintf("[red] Failed to send chat request to %s! Please try again later", username))
-			cr.pages.SwitchToPage("menu")
-			// close the channel
-			close(responseChannel)
-			return
+		case client.AWAITING_REQ:
+			awaiting = true
+		case client.REQ_ACCEPTED:
+			awaiting = false
+			text += "Awaiting response... [green]Chat request accepted![white]\n"
 		}
+		render()
+	}
 
-		// Show loading bar
-		terminated := false
-		dots := []string{".", "..", "...", "....", ".....", "......"}
-		dotIdx := 0
-		for !terminated {
+	// Show the loading dots until Central answers, the chat page opens on the Matched event
+	result := make(chan error, 1)
+	go func() { _, err := cr.client.Request(cr.ctx, username); result <- err }()
+	go func() {
+		ticker := time.NewTicker(300 * time.Millisecond)
+		defer ticker.Stop()
+		for {
 			select {
-			case chatAccepted := <-responseChannel:
-				// Channel value read, exit the loop
-				if chatAccepted == REQ_ACCEPTED {
-					text += "Awaiting response... [green]Chat request accepted![white]\n"
-					textView.SetText(text)
-					terminated = true
-				} else if chatAccepted == SERVER_ERROR {
-					text += "Awaiting response... [red]Chat request declined![white]\n"
-					textView.SetText(text)
-					terminated = true
-					break
-				} else if chatAccepted == AWAITING_REQ {
-					dot := dots[dotIdx]
-					loadingText := fmt.Sprintf("Awaiting response%s", dot)
-					text += loadingText
-					dotIdx++
-					if dotIdx == len(dots) {
-						dotIdx = 0
-					}
-					textView.SetText(text)
-					/* Remove the added line */
-					text = text[:len(text)-len(loadingText)]
-				} else {
-					textView.SetText("I HAVE NO IDEA WHAT JUST HAPPENED, here's what the server sent back: " + chatAccepted)
+			case <-ticker.C:
+				cr.app.QueueUpdateDraw(func() {
+					dotIdx = (dotIdx + 1) % len(dots)
+					render()
+				})
+			case err := <-result:
+				if err == nil {
+					return
 				}
-			default:
-				// Do nothing
-				continue
+				cr.app.QueueUpdateDraw(func() {
+					cr.matchmaking = nil
+					if errors.Is(err, client.ErrUnavailable) {
+						cr.showError(fmt.Sprintf("Chat request declined! You cannot chat with %s", username))
+					} else if errors.Is(err, client.ErrExpired) {
+						cr.showError(fmt.Sprintf("%s didn't answer your chat request in time", username))
+					} else {
+						cr.showError(fmt.Sprintf("Failed to connect to server! Please try again later (%v)", err))
+					}
+				})
+				return
 			}
-			// debounce by 20 ms
-			//time.Sleep(20 * time.Millisecond)
-		}
-
-		server := <-responseChannel
-		if server == SERVER_ERROR {
-			textView.SetText("Failed to connect to server! [red]Please try again later[white]")
-			cr.pages.SwitchToPage("menu")
-			// close the channel
-			close(responseChannel)
-			return
-		}
-
-		if !strings.HasPrefix(server, "IP:") {
-			textView.SetText("Failed to connect to server! [red]Please try again later[white]")
-			cr.pages.SwitchToPage("menu")
-			// close the channel
-			close(responseChannel)
-			return
 		}
+	}()
+}
 
-		serverAddress := strings.TrimPrefix(server, "IP:")
+// formatTransfer describes a file transfer with a progress bar
+func formatTransfer(transfer client.Transfer) string {
+	verb := "Receiving"
+	if transfer.Outgoing {
+		verb = "Sending"
+	}
+	switch {
+	case transfer.Err != nil:
+		return fmt.Sprintf("[red]%s %s failed: %v[white]", verb, transfer.Name, transfer.Err)
+	case transfer.SavedTo != "":
+		return fmt.Sprintf("[green]Saved %s to %s[white]", transfer.Name, transfer.SavedTo)
+	case transfer.Complete:
+		return fmt.Sprintf("[green]%s %s complete[white]", verb, transfer.Name)
+	}
 
-		roomId := <-responseChannel
-		if roomId == SERVER_ERROR {
-			textView.SetText("Failed to connect to server! [red]Please try again later[white]")
-			cr.pages.SwitchToPage("menu")
-			// close the channel
-			close(responseChannel)
-			return
-		}
-		if !strings.HasPrefix(roomId, "RoomID:") {
-			textView.SetText("Failed to connect to server! [red]Please try again later[white]")
-			cr.pages.SwitchToPage("menu")
-			// close the channel
-			close(responseChannel)
-			return
-		}
-		roomId = strings.TrimPrefix(roomId, "RoomID:")
-		roomId = strings.TrimSuffix(roomId, "\n")
+	const width = 20
+	filled := int(transfer.Progress() * width)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+	return fmt.Sprintf("%s %s [%s[] %3.0f%%", verb, transfer.Name, bar, transfer.Progress()*100)
+}
 
-		text += "Connecting to chat server on " + serverAddress
-		textView.SetText(text)
-		go cr.chatPage(serverAddress, roomId)
-		close(responseChannel)
-	}()
+// chatHeader shows who the room is with, its chat server, and the key fingerprint once messages are encrypted
+func chatHeader(c *client.Client, room client.Room) string {
+	header := "[cyan]Chatting with [white]" + room.With + " [cyan]on server: [white]" + room.Server
+	if fingerprint := c.Fingerprint(room.ID); fingerprint != "" {
+		header += "  [cyan]Encrypted, fingerprint: [white]" + fingerprint
+	} else if c.Unencrypted(room.ID) {
+		header += "  [red]Not encrypted[white]"
+	} else {
+		header += "  [yellow]Waiting for keys, messages are sent once encrypted[white]"
+	}
+	return header
 }
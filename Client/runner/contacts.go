@@ -0,0 +1,152 @@
+package clientrunner
+
+import (
+	"client/client"
+	"fmt"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// contactsPage lists the contacts with their status, to add and remove them and ask them to chat
+func (cr *clientRunner) contactsPage() {
+	contacts := cr.client.Contacts()
+
+	list := tview.NewList().ShowSecondaryText(true)
+	list.SetBorder(true).SetTitle("Contacts")
+	for _, contact := range contacts {
+		list.AddItem(contact.Username, contactStatus(contact.Status), 0, nil)
+	}
+	if len(contacts) == 0 {
+		list.AddItem("No contacts yet", "Add one with the field above", 0, nil)
+	}
+	if cr.contacts != nil {
+		list.SetCurrentItem(cr.contacts.GetCurrentItem())
+	}
+	cr.contacts = list
+	list.SetSelectedFunc(func(index int, _ string, _ string, _ rune) {
+		if index >= len(contacts) {
+			return
+		}
+		if contacts[index].Status == client.ContactOffline {
+			cr.showError(fmt.Sprintf("%s is offline", contacts[index].Username))
+			return
+		}
+		cr.startMatchMaking(contacts[index].Username)
+	})
+
+	// Create an input field to add a contact by username
+	add := tview.NewInputField().
+		SetLabel("Add contact: ").
+		SetFieldWidth(30)
+	add.SetDoneFunc(func(key tcell.Key) {
+		username := strings.TrimSpace(add.GetText())
+		if key != tcell.KeyEnter || username == "" {
+			return
+		}
+		if err := cr.client.AddContact(username); err != nil {
+			cr.showError(err.Error())
+			return
+		}
+		cr.contactsPage()
+	})
+
+	hint := tview.NewTextView().
+		SetDynamicColors(true).
+		SetText("[gray]Enter: ask to chat, Delete: remove the contact, Tab: switch between the field and the list, Esc: menu[white]")
+
+	flex := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(add, 1, 0, false).
+		AddItem(list, 0, 1, true).
+		AddItem(hint, 1, 0, false)
+	flex.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyTab:
+			if add.HasFocus() {
+				cr.app.SetFocus(list)
+			} else {
+				cr.app.SetFocus(add)
+			}
+		case tcell.KeyDelete:
+			index := list.GetCurrentItem()
+			if !list.HasFocus() || index >= len(contacts) {
+				return event
+			}
+			if err := cr.client.RemoveContact(contacts[index].Username); err != nil {
+				cr.showError(err.Error())
+				return nil
+			}
+			cr.contactsPage()
+		case tcell.KeyEscape:
+			cr.pages.SwitchToPage("menu")
+		default:
+			return event
+		}
+		return nil
+	})
+
+	frame := tview.NewFrame(flex).SetBorders(0, 0, 0, 0, 0, 0)
+	frame.SetTitle("Contacts").SetTitleAlign(tview.AlignCenter)
+	frame.SetBorder(true)
+	cr.pages.AddAndSwitchToPage("contacts", frame, true)
+}
+
+// refreshContacts redraws the contacts page with the new status of the contacts, if it is shown
+func (cr *clientRunner) refreshContacts() {
+	if front, _ := cr.pages.GetFrontPage(); front == "contacts" {
+		cr.contactsPage()
+	}
+}
+
+/*
+contactAdded tells the user someone added them as a contact, offering to add them back.
+In a chat the room's status line tells instead, not to get in the way of the conversation.
+*/
+func (cr *clientRunner) contactAdded(username string) {
+	known := false
+	for _, contact := range cr.client.Contacts() {
+		known = known || contact.Username == username
+	}
+
+	front, _ := cr.pages.GetFrontPage()
+	if front == "chat" {
+		if state, ok := cr.rooms[cr.active]; ok {
+			state.transfers = fmt.Sprintf("[yellow]%s added you as a contact[white]", tview.Escape(username))
+			cr.renderChat()
+			return
+		}
+	}
+
+	page := "contactAdded:" + username
+	buttons := []string{"OK"}
+	if !known {
+		buttons = []string{"Add back", "OK"}
+	}
+	modal := tview.NewModal().
+		SetText(fmt.Sprintf("%s added you as a contact", username)).
+		AddButtons(buttons).
+		SetDoneFunc(func(_ int, label string) {
+			cr.pages.RemovePage(page)
+			if label == "Add back" {
+				if err := cr.client.AddContact(username); err != nil {
+					cr.showError(err.Error())
+					return
+				}
+			}
+			cr.pages.SwitchToPage(front)
+			cr.refreshContacts()
+		})
+	cr.pages.AddAndSwitchToPage(page, modal, true)
+}
+
+// contactStatus colors the status of a contact
+func contactStatus(status string) string {
+	switch status {
+	case client.ContactOnline:
+		return "[green]online[white]"
+	case client.ContactInChat:
+		return "[yellow]in a chat[white]"
+	}
+	return "[gray]offline[white]"
+}
@@ -0,0 +1,225 @@
+package clientrunner
+
+import (
+	"client/client"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// Refresh interval of the diagnostics page
+const diagnosticsRefresh = time.Second
+
+/*
+diagnosticsPage shows why the rooms are routed the way they are: the latency measured to
+every chat server, where Central placed the room shown on the chat page with the minimax
+score its home server won with, and the reroutes of the session. It refreshes until the
+user leaves it.
+*/
+func (cr *clientRunner) diagnosticsPage() {
+	servers := tview.NewTable().
+		SetBorders(false).
+		SetFixed(1, 0)
+	servers.SetBorder(true).SetTitle("Chat servers")
+
+	placement := tview.NewTextView().
+		SetDynamicColors(true).
+		SetWrap(true)
+	placement.SetBorder(true).SetTitle("Current room")
+
+	reroutes := tview.NewTextView().
+		SetDynamicColors(true).
+		SetWrap(false)
+	reroutes.SetBorder(true).SetTitle("Reroutes this session")
+
+	hint := tview.NewTextView().
+		SetDynamicColors(true).
+		SetText("[gray]* the server you are connected to, h the home server Central picked, Esc: menu[white]")
+
+	flex := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(servers, 0, 2, true).
+		AddItem(placement, 5, 0, false).
+		AddItem(reroutes, 0, 1, false).
+		AddItem(hint, 1, 0, false)
+
+	flex.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyEscape {
+			cr.pages.SwitchToPage("menu")
+			return nil
+		}
+		return event
+	})
+
+	frame := tview.NewFrame(flex).SetBorders(0, 0, 0, 0, 0, 0)
+	frame.SetTitle("Connection Diagnostics").SetTitleAlign(tview.AlignCenter)
+	frame.SetBorder(true)
+	cr.pages.AddAndSwitchToPage("diagnostics", frame, true)
+
+	// Central is asked for the placement off the UI goroutine, the page is drawn with the answer
+	done := make(chan struct{})
+	render := func(room client.Room, inRoom bool, place client.Placement, placeErr error) {
+		renderServers(servers, cr.client.ServerStats(), room, place)
+		switch {
+		case !inRoom:
+			placement.SetText("[gray]You are not in a chat, the servers Central would pick depend on who you chat with[white]")
+		case placeErr != nil:
+			placement.SetText(fmt.Sprintf("Chatting with %s on %s\n[red]%v[white]", tview.Escape(room.With), room.Server, placeErr))
+		default:
+			placement.SetText(formatPlacement(room, place))
+		}
+		reroutes.SetText(formatReroutes(cr.client.Reroutes(), cr.client.Rooms()))
+	}
+	refresh := func() {
+		var room client.Room
+		inRoom := false
+		cr.app.QueueUpdate(func() {
+			if state, ok := cr.rooms[cr.active]; ok {
+				room, inRoom = state.room, true
+			}
+		})
+		var place client.Placement
+		var err error
+		if inRoom {
+			if current, ok := cr.client.Room(room.ID); ok {
+				room = current
+			}
+			place, err = cr.client.Placement(room.ID)
+		}
+		cr.app.QueueUpdateDraw(func() {
+			// Stop once the user left the page, or opened it again
+			if _, front := cr.pages.GetFrontPage(); front != frame {
+				select {
+				case <-done:
+				default:
+					close(done)
+				}
+				return
+			}
+			render(room, inRoom, place, err)
+		})
+	}
+	render(client.Room{}, false, client.Placement{}, nil)
+
+	go func() {
+		refresh()
+		ticker := time.NewTicker(diagnosticsRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				refresh()
+			case <-done:
+				return
+			case <-cr.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// renderServers fills the table of the chat servers, marking those of the room
+func renderServers(table *tview.Table, stats map[string]client.ServerStats, room client.Room, place client.Placement) {
+	table.Clear()
+	headers := []string{"", "Server", "Current", "Smoothed", "Jitter", "Loss", "Via", "Last probe"}
+	for column, header := range headers {
+		table.SetCell(0, column, tview.NewTableCell(header).
+			SetTextColor(tcell.ColorYellow).
+			SetSelectable(false).
+			SetExpansion(1))
+	}
+	if len(stats) == 0 {
+		table.SetCell(1, 1, tview.NewTableCell("No chat servers known yet").SetTextColor(tcell.ColorGray))
+		return
+	}
+
+	names := make([]string, 0, len(stats))
+	for server := range stats {
+		names = append(names, server)
+	}
+	sort.Strings(names)
+	for i, server := range names {
+		s := stats[server]
+		marks := ""
+		if server == room.Server {
+			marks += "*"
+		}
+		if server == place.Home {
+			marks += "h"
+		}
+
+		current, smoothed, jitter, loss, via, probed := "-", "-", "-", "-", "-", "never"
+		if s.Reachable() {
+			current = fmt.Sprintf("%.2f ms", s.Current)
+			via = s.Transport
+		}
+		if s.Samples > 0 {
+			smoothed = fmt.Sprintf("%.2f ms", s.RTT)
+			jitter = fmt.Sprintf("%.2f ms", s.Jitter)
+		}
+		if !s.LastProbe.IsZero() {
+			loss = fmt.Sprintf("%.0f%%", s.Loss*100)
+			probed = fmt.Sprintf("%s ago", time.Since(s.LastProbe).Round(time.Second))
+		}
+		color := tcell.ColorWhite
+		if !s.Reachable() {
+			color = tcell.ColorRed
+			current = "down"
+		}
+
+		for column, text := range []string{marks, server, current, smoothed, jitter, loss, via, probed} {
+			table.SetCell(i+1, column, tview.NewTableCell(text).SetTextColor(color).SetExpansion(1))
+		}
+	}
+}
+
+// formatPlacement describes where Central placed a room, and the score its home server won with
+func formatPlacement(room client.Room, place client.Placement) string {
+	score := "unknown"
+	if place.Score >= math.MaxFloat32 {
+		score = "unreachable"
+	} else if place.Score > 0 {
+		score = fmt.Sprintf("%.2f ms", place.Score)
+	}
+	placed := ""
+	if !place.Placed.IsZero() {
+		placed = fmt.Sprintf(", picked at %s", place.Placed.Local().Format("15:04:05"))
+	}
+
+	text := fmt.Sprintf("Chatting with [white]%s[-], connected to [white]%s[-]\n", tview.Escape(room.With), room.Server)
+	text += fmt.Sprintf("Central picked home server [white]%s[-] with a minimax score of [white]%s[-]%s\n", place.Home, score, placed)
+	members := make([]string, 0, len(place.Members))
+	for user, server := range place.Members {
+		members = append(members, fmt.Sprintf("%s on %s", tview.Escape(user), server))
+	}
+	sort.Strings(members)
+	text += "[gray]Members: " + strings.Join(members, ", ") + "[white]"
+	return text
+}
+
+// formatReroutes lists the reroutes of the session, the latest first
+func formatReroutes(reroutes []client.Reroute, rooms []client.Room) string {
+	if len(reroutes) == 0 {
+		return "[gray]No reroutes yet[white]"
+	}
+	with := make(map[string]string)
+	for _, room := range rooms {
+		with[room.ID] = room.With
+	}
+
+	var text strings.Builder
+	for i := len(reroutes) - 1; i >= 0; i-- {
+		reroute := reroutes[i]
+		room := reroute.RoomID
+		if name, ok := with[room]; ok {
+			room = "chat with " + name
+		}
+		fmt.Fprintf(&text, "[gray]%s[white] %s: %s -> %s\n",
+			reroute.Time.Local().Format("15:04:05"), tview.Escape(room), reroute.From, reroute.To)
+	}
+	return text.String()
+}
@@ -0,0 +1,136 @@
+package clientrunner
+
+import (
+	"bufio"
+	"client/client"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"golang.org/x/term"
+)
+
+// readPassphrase reads a line from the terminal without echoing it
+func readPassphrase() string {
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		if err == nil {
+			return string(passphrase)
+		}
+	}
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSpace(line)
+}
+
+// historyPage lists the rooms of the chat history, shows one of them, and searches all of them
+func (cr *clientRunner) historyPage() {
+	rooms, err := cr.client.HistoryRooms()
+	if err != nil {
+		cr.showError("No chat history is kept, enter a passphrase when starting the client to keep one")
+		return
+	}
+
+	// Create a text view for the room picked, or the search results
+	entries := tview.NewTextView().
+		SetDynamicColors(true).
+		SetWrap(true)
+	entries.SetBorder(true)
+
+	list := tview.NewList().ShowSecondaryText(true)
+	list.SetBorder(true).SetTitle("Chats")
+	for _, room := range rooms {
+		secondary := fmt.Sprintf("%s, %d messages", room.Last.Local().Format("2006-01-02 15:04"), room.Entries)
+		list.AddItem(room.With, secondary, 0, nil)
+	}
+	showRoom := func(index int) {
+		if index < 0 || index >= len(rooms) {
+			entries.SetTitle("")
+			entries.SetText("[gray]No chats yet[white]")
+			return
+		}
+		room := rooms[index]
+		history, err := cr.client.History(room.ID)
+		if err != nil {
+			entries.SetText("[red]" + err.Error() + "[white]")
+			return
+		}
+		entries.SetTitle(fmt.Sprintf("Chat with %s", room.With))
+		entries.SetText(formatHistory(history, false))
+	}
+	list.SetChangedFunc(func(index int, _ string, _ string, _ rune) { showRoom(index) })
+	showRoom(0)
+
+	// Create an input field to search every room
+	search := tview.NewInputField().
+		SetLabel("Search: ").
+		SetFieldWidth(30)
+	search.SetDoneFunc(func(key tcell.Key) {
+		if key != tcell.KeyEnter {
+			return
+		}
+		query := search.GetText()
+		if strings.TrimSpace(query) == "" {
+			showRoom(list.GetCurrentItem())
+			return
+		}
+		matches, err := cr.client.SearchHistory(query)
+		if err != nil {
+			entries.SetText("[red]" + err.Error() + "[white]")
+			return
+		}
+		entries.SetTitle(fmt.Sprintf("%d messages matching %q", len(matches), query))
+		entries.SetText(formatHistory(matches, true))
+	})
+
+	hint := tview.NewTextView().
+		SetDynamicColors(true).
+		SetText("[gray]Tab: switch between search, chats and messages, Esc: menu[white]")
+
+	flex := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(search, 1, 0, true).
+		AddItem(tview.NewFlex().
+			AddItem(list, 40, 0, false).
+			AddItem(entries, 0, 1, false), 0, 1, false).
+		AddItem(hint, 1, 0, false)
+
+	// Tab moves the focus between the search field, the list of chats and the messages
+	focusable := []tview.Primitive{search, list, entries}
+	flex.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyTab:
+			for i, primitive := range focusable {
+				if primitive.HasFocus() {
+					cr.app.SetFocus(focusable[(i+1)%len(focusable)])
+					break
+				}
+			}
+		case tcell.KeyEscape:
+			cr.pages.SwitchToPage("menu")
+		default:
+			return event
+		}
+		return nil
+	})
+
+	frame := tview.NewFrame(flex).SetBorders(0, 0, 0, 0, 0, 0)
+	frame.SetTitle("Chat History").SetTitleAlign(tview.AlignCenter)
+	frame.SetBorder(true)
+	cr.pages.AddAndSwitchToPage("history", frame, true)
+}
+
+// formatHistory renders entries of the chat history, with who the room was with for search results
+func formatHistory(entries []client.HistoryEntry, withRoom bool) string {
+	var text strings.Builder
+	for _, entry := range entries {
+		timestamp := entry.Time.Local().Format("2006-01-02 15:04:05")
+		if withRoom {
+			fmt.Fprintf(&text, "[gray]%s with %s[white] %s\n", timestamp, tview.Escape(entry.With), tview.Escape(entry.String()))
+		} else {
+			fmt.Fprintf(&text, "[gray]%s[white] %s\n", timestamp, tview.Escape(entry.String()))
+		}
+	}
+	return text.String()
+}
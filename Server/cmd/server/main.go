@@ -1,9 +1,16 @@
 package main
 
 import (
+	"chatserver/internal/admin"
 	"chatserver/internal/chat"
+	"chatserver/internal/config"
+	"chatserver/internal/load"
+	"chatserver/internal/probe"
 	"chatserver/jobs"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -15,13 +22,58 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error initializing Heartbeat job: %v", err)
 	}
-	chatManager := chat.NewChatManager(":3002")
+	centralURL, err := config.ReadConfig("config.txt")
+	if err != nil {
+		log.Fatalf("Error reading config: %v", err)
+	}
+	// Deployments tune the chat manager in chat.json, anything left out keeps its default
+	settings := chat.DefaultSettings()
+	if err := config.ReadJSON("chat.json", &settings); err != nil {
+		log.Fatalf("Error reading chat settings: %v", err)
+	}
+	chatManager := chat.NewChatManager(":3002", centralURL, settings)
+	// Closing rooms and reporting offenders to Central take its operator token
+	operatorToken, err := config.ReadConfig("operator_token.txt")
+	if err != nil {
+		log.Printf("Rooms closed here stay open in Central, offenders are not reported: %v", err)
+	} else {
+		chatManager.SetCentralToken(operatorToken)
+	}
+	// Relay rooms whose members Central placed on other chat servers, peers share a secret.
+	// Central only splits a room across servers which all report the relay with their heartbeat,
+	// the relay looks rooms up in Central with the operator token
+	relaySecret, err := config.ReadConfig("relay_secret.txt")
+	if err != nil {
+		log.Printf("Relay disabled, rooms here keep all their members on this server: %v", err)
+	} else if operatorToken == "" {
+		log.Printf("Relay disabled, rooms here keep all their members on this server: it needs operator_token.txt")
+	} else {
+		chatManager.EnableRelay(":3004", relaySecret)
+		heartbeat.SetRelay(true)
+	}
+	// Report the chat manager's load with every heartbeat
+	collector := load.NewCollector(chatManager)
+	heartbeat.SetLoadCollector(collector)
+	heartbeat.SetCapacity(chatManager.Capacity())
+	drain := jobs.NewDrainJob(heartbeat, chatManager, 2*time.Minute)
+	// Clients measure their latency with UDP probes, on the port number they ping over TCP
+	go probe.NewResponder(":3000").Start()
+
+	// The admin API stays disabled unless a token is configured
+	adminToken, err := config.ReadConfig("admin_token.txt")
+	if err != nil {
+		log.Printf("Admin API disabled: %v", err)
+	}
+	adminAPI := admin.NewAdminAPI(chatManager, collector, heartbeat, drain, adminToken)
 
 	// Start the Heartbeat job
 	heartbeat.Start()
 	go chatManager.Start()
 	// Initialize Gin router
 	r := gin.Default()
+	adminAPI.RegisterRoutes(r)
+	// Browser clients chat over a WebSocket instead of the raw TCP port
+	r.GET("/ws", gin.WrapH(chatManager.WebSocketHandler()))
 
 	// Start the Gin server on port 3000
 	go func() {
@@ -29,6 +81,17 @@ func main() {
 			log.Fatalf("Error starting server: %v", err)
 		}
 	}()
-	// Keep the application running
-	select {}
+
+	// The first interrupt drains the server, a second one exits right away
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		drain.Start()
+		<-signals
+		os.Exit(1)
+	}()
+
+	// Keep the application running until drained
+	<-drain.Done()
 }
@@ -0,0 +1,192 @@
+package admin
+
+import (
+	"chatserver/internal/chat"
+	"chatserver/internal/load"
+	"chatserver/jobs"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+API for operating a chat server, served on the same port clients ping.
+Everything under /admin requires the admin token, either as a bearer token
+or in the X-Admin-Token header. Without a configured token those routes are refused.
+*/
+type AdminAPI struct {
+	manager   *chat.ChatManager
+	collector *load.Collector
+	heartbeat *jobs.HeartbeatJob
+	drain     *jobs.DrainJob
+	token     string
+}
+
+func NewAdminAPI(manager *chat.ChatManager, collector *load.Collector, heartbeat *jobs.HeartbeatJob, drain *jobs.DrainJob, token string) *AdminAPI {
+	return &AdminAPI{
+		manager:   manager,
+		collector: collector,
+		heartbeat: heartbeat,
+		drain:     drain,
+		token:     token,
+	}
+}
+
+func (api *AdminAPI) RegisterRoutes(router *gin.Engine) {
+	router.GET("/health", api.Health)
+	router.GET("/ready", api.Ready)
+
+	group := router.Group("/admin", api.authenticate)
+	{
+		group.GET("/stats", api.GetStats)
+		group.GET("/rooms", api.GetRooms)
+		group.GET("/rooms/:roomId", api.GetRoom)
+		group.DELETE("/rooms/:roomId", api.CloseRoom)
+		group.GET("/rooms/:roomId/transcript", api.GetTranscript)
+		group.GET("/transcripts", api.GetTranscripts)
+		group.POST("/rooms/:roomId/notice", api.SendNotice)
+		group.DELETE("/rooms/:roomId/members/:username", api.KickMember)
+		group.GET("/moderation", api.GetModerationLog)
+		group.POST("/drain", api.Drain)
+	}
+}
+
+// authenticate rejects requests which don't carry the admin token
+func (api *AdminAPI) authenticate(c *gin.Context) {
+	if api.token == "" {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Admin API is disabled, no admin token configured"})
+		return
+	}
+
+	token := c.GetHeader("X-Admin-Token")
+	if bearer := c.GetHeader("Authorization"); strings.HasPrefix(bearer, "Bearer ") {
+		token = strings.TrimPrefix(bearer, "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(api.token)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin token"})
+		return
+	}
+	c.Next()
+}
+
+// Health reports that the process is up.
+func (api *AdminAPI) Health(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Ready reports whether the server is registered with Central and accepting rooms.
+func (api *AdminAPI) Ready(c *gin.Context) {
+	registered, draining := api.heartbeat.Registered(), api.heartbeat.Draining()
+	status := http.StatusOK
+	if !registered || draining {
+		status = http.StatusServiceUnavailable
+	}
+
+	c.JSON(status, gin.H{"registered": registered, "draining": draining})
+}
+
+func (api *AdminAPI) GetStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"stats": api.collector.Collect(), "draining": api.heartbeat.Draining()})
+}
+
+func (api *AdminAPI) GetRooms(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"rooms": api.manager.Rooms()})
+}
+
+func (api *AdminAPI) GetRoom(c *gin.Context) {
+	roomId := c.Param("roomId")
+	members, err := api.manager.RoomMembers(roomId)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"roomId": roomId, "members": members})
+}
+
+// GetTranscripts lists the rooms with a transcript, closed ones included.
+func (api *AdminAPI) GetTranscripts(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"rooms": api.manager.TranscriptRooms()})
+}
+
+// GetTranscript exports the history of a room, as ?format=txt, json or md (txt by default).
+func (api *AdminAPI) GetTranscript(c *gin.Context) {
+	roomId := c.Param("roomId")
+	entries, err := api.manager.Transcript(roomId)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	format := c.DefaultQuery("format", chat.FormatText)
+	data, contentType, err := chat.FormatTranscript(roomId, entries, format)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"transcript-%s.%s\"", roomId, format))
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// CloseRoom ends a room, for the members connected to this server and, through Central, everywhere else.
+func (api *AdminAPI) CloseRoom(c *gin.Context) {
+	roomId := c.Param("roomId")
+	if err := api.manager.CloseRoom(roomId, "This room was closed by an administrator"); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Room closed", "roomId": roomId})
+}
+
+// NoticeRequest represents the payload for a system notice.
+type NoticeRequest struct {
+	Message string `json:"message" binding:"required"`
+}
+
+// SendNotice broadcasts a system notice to every member of the room.
+func (api *AdminAPI) SendNotice(c *gin.Context) {
+	var req NoticeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON payload"})
+		return
+	}
+
+	roomId := c.Param("roomId")
+	if err := api.manager.Notice(roomId, req.Message); errors.Is(err, chat.ErrInvalidNotice) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Notice sent", "roomId": roomId})
+}
+
+// KickMember disconnects a user from the room, which closes it in Central.
+func (api *AdminAPI) KickMember(c *gin.Context) {
+	roomId, username := c.Param("roomId"), c.Param("username")
+	if err := api.manager.Kick(roomId, username, "You were removed from this room by an administrator"); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User kicked", "roomId": roomId, "username": username})
+}
+
+// GetModerationLog returns the latest messages the filters acted on.
+func (api *AdminAPI) GetModerationLog(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"events": api.manager.ModerationLog().Events()})
+}
+
+// Drain takes the server out of rotation, see jobs.DrainJob.
+func (api *AdminAPI) Drain(c *gin.Context) {
+	api.drain.Start()
+	c.JSON(http.StatusAccepted, gin.H{"message": "Server draining"})
+}
@@ -0,0 +1,132 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ErrInvalidNotice is returned for notices which are not a single line of text within the message limit
+var ErrInvalidNotice = errors.New("notices must be one line of text without control characters, within the message size limit")
+
+// Rooms returns the members connected to this server, by room ID
+func (cm *ChatManager) Rooms() map[string][]string {
+	cm.clientMutex.Lock()
+	defer cm.clientMutex.Unlock()
+
+	rooms := make(map[string][]string)
+	for roomId, clientsInRoom := range cm.clients {
+		members := []string{}
+		for _, client := range clientsInRoom {
+			members = append(members, client.username)
+		}
+		sort.Strings(members)
+		rooms[roomId] = members
+	}
+	return rooms
+}
+
+// RoomMembers returns the members of a room connected to this server
+func (cm *ChatManager) RoomMembers(roomId string) ([]string, error) {
+	members, ok := cm.Rooms()[roomId]
+	if !ok {
+		return nil, fmt.Errorf("room %s not found", roomId)
+	}
+	return members, nil
+}
+
+/*
+Notice broadcasts a message from the server itself to every member of a room. It goes out
+as a line of the protocol, so control characters, line breaks first, are refused.
+*/
+func (cm *ChatManager) Notice(roomId, message string) error {
+	if strings.TrimSpace(message) == "" || strings.ContainsFunc(message, unicode.IsControl) || len(message) > cm.settings.MaxMessageBytes {
+		return ErrInvalidNotice
+	}
+	if _, err := cm.RoomMembers(roomId); err != nil {
+		return err
+	}
+	cm.broadcastMessage(systemSender, roomId, message)
+	return nil
+}
+
+/*
+Kick disconnects a user from a room, telling them why first. Rooms are between two users,
+so the room is closed in Central too, which ends it for the other member wherever they
+are connected.
+*/
+func (cm *ChatManager) Kick(roomId, username, reason string) error {
+	cm.clientMutex.Lock()
+	kicked := false
+	for _, client := range cm.clients[roomId] {
+		if client.username == username {
+			client.send(closedNotice(reason))
+			client.disconnect()
+			kicked = true
+		}
+	}
+	cm.clientMutex.Unlock()
+	if !kicked {
+		return fmt.Errorf("user %s not found in room %s", username, roomId)
+	}
+
+	if err := cm.closeInCentral(roomId); err != nil {
+		log.Printf("Failed to close room %s in Central: %v\n", roomId, err)
+	}
+	return nil
+}
+
+/*
+CloseRoom disconnects every member of a room connected to this server, and closes the room
+in Central so members connected to other servers leave it too and it is no longer rerouted.
+It fails only when neither this server nor Central knows the room.
+*/
+func (cm *ChatManager) CloseRoom(roomId, reason string) error {
+	cm.clientMutex.Lock()
+	clientsInRoom, local := cm.clients[roomId]
+	for _, client := range clientsInRoom {
+		client.send(closedNotice(reason))
+		client.disconnect()
+	}
+	cm.clientMutex.Unlock()
+
+	err := cm.closeInCentral(roomId)
+	if err != nil && !local {
+		return fmt.Errorf("room %s not found: %w", roomId, err)
+	}
+	if err != nil {
+		log.Printf("Failed to close room %s in Central: %v\n", roomId, err)
+	}
+	return nil
+}
+
+// SetCentralToken sets the operator token sent with the requests only Central's operators and chat servers can make
+func (cm *ChatManager) SetCentralToken(token string) {
+	cm.centralToken = token
+}
+
+// closeInCentral removes a room from Central
+func (cm *ChatManager) closeInCentral(roomId string) error {
+	req, err := http.NewRequest(http.MethodDelete, cm.centralURL+"/rooms/"+url.PathEscape(roomId), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Operator-Token", cm.centralToken)
+
+	httpClient := &http.Client{Timeout: 2 * time.Second}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("central responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package chat
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+Files are sent into a room as chat lines, so they are relayed, ordered and federated
+like any other message:
+
+	/file offer <id> <size> <sha256> <chunks> <name>
+	/file chunk <id> <index> <base64 data>
+	/file cancel <id>
+
+The server checks every upload against the size cap and paces it on its own byte
+budget, on top of the message rate limits. Chunks must come in order, a chunk out of
+order cancels the upload for everyone. Recipients verify the checksum.
+*/
+const fileCommandPrefix = "/file "
+
+// AttachmentSettings limits the files users can send into a room
+type AttachmentSettings struct {
+	MaxBytes       int64   `json:"maxBytes"`       // Largest file a user can send
+	BytesPerSecond float64 `json:"bytesPerSecond"` // Upload pace per user, uploads over it are slowed down
+	MaxOpenUploads int     `json:"maxOpenUploads"` // Files a user can send at once, 4 if unset
+}
+
+// Files a user can send at once unless the deployment says otherwise
+const defaultMaxOpenUploads = 4
+
+// Upload IDs are short tokens clients pick, see the client's attachments.go
+var uploadIDPattern = regexp.MustCompile(`^[0-9A-Za-z]{1,32}$`)
+
+// Longest file name accepted in an offer, in bytes
+const maxFileNameBytes = 255
+
+// upload tracks a file a client is sending
+type upload struct {
+	size     int64
+	chunks   int
+	next     int // Index of the next chunk, chunks must come in order
+	received int64
+}
+
+// isFileCommand reports whether a message is part of a file transfer
+func isFileCommand(message string) bool {
+	return strings.HasPrefix(message, fileCommandPrefix)
+}
+
+/*
+admitFile validates a file transfer line from a client, returning whether it can be
+broadcast. Lines must be exactly as the protocol describes, with nothing trailing, for an
+upload the client opened; anything else would reach the room unchecked. Every line is
+charged to the sender's and the room's rate limits, file lines are held rather than
+dropped so the file arrives whole.
+*/
+func (cm *ChatManager) admitFile(client *chatClient, roomId, message string) bool {
+	wait, violations := cm.limiter.admitFile(client.username, roomId, len(message))
+	if cm.limiter.shouldReport(violations) {
+		go cm.reportOffender(client.username, roomId, violations)
+	}
+	time.Sleep(wait)
+
+	fields := strings.Split(message, " ")
+	if len(fields) < 3 || !uploadIDPattern.MatchString(fields[2]) {
+		client.send(fmt.Sprintf("%s Invalid file transfer command\n", systemSender))
+		return false
+	}
+	id := fields[2]
+
+	switch fields[1] {
+	case "offer":
+		upload, ok := parseOffer(fields)
+		if !ok {
+			client.send(fmt.Sprintf("%s Invalid file offer\n", systemSender))
+			return false
+		}
+		if upload.size > cm.settings.Attachments.MaxBytes {
+			client.send(fmt.Sprintf("%s Your file was not sent, files are limited to %d bytes\n", systemSender, cm.settings.Attachments.MaxBytes))
+			return false
+		}
+		if _, exists := client.uploads[id]; exists {
+			client.send(fmt.Sprintf("%s Upload %s is already open\n", systemSender, id))
+			return false
+		}
+		maxOpen := cm.settings.Attachments.MaxOpenUploads
+		if maxOpen <= 0 {
+			maxOpen = defaultMaxOpenUploads
+		}
+		if len(client.uploads) >= maxOpen {
+			client.send(fmt.Sprintf("%s Your file was not sent, you can send %d files at once\n", systemSender, maxOpen))
+			return false
+		}
+		if upload.chunks == 0 {
+			return true // Nothing will follow
+		}
+		client.uploads[id] = upload
+		return true
+
+	case "chunk":
+		upload, ok := client.uploads[id]
+		if !ok || len(fields) != 5 {
+			return false // Rejected or cancelled upload, its sender was already told
+		}
+		index, err := strconv.Atoi(fields[3])
+		if err != nil || index != upload.next {
+			client.send(fmt.Sprintf("%s Chunk out of order, upload %s cancelled\n", systemSender, id))
+			cm.cancelUpload(client, roomId, id)
+			return false
+		}
+		data, err := base64.StdEncoding.DecodeString(fields[4])
+		if err != nil {
+			client.send(fmt.Sprintf("%s Invalid file chunk, upload %s cancelled\n", systemSender, id))
+			cm.cancelUpload(client, roomId, id)
+			return false
+		}
+
+		upload.received += int64(len(data))
+		upload.next++
+		if upload.received > upload.size || upload.next > upload.chunks {
+			client.send(fmt.Sprintf("%s Upload %s is larger than offered, cancelled\n", systemSender, id))
+			cm.cancelUpload(client, roomId, id)
+			return false
+		}
+		if upload.next == upload.chunks {
+			delete(client.uploads, id)
+		}
+
+		// Uploads are slowed down rather than dropped, so files arrive whole
+		client.uploadBudget.refill(time.Now())
+		client.uploadBudget.take(float64(len(data)))
+		time.Sleep(client.uploadBudget.wait())
+		return true
+
+	case "cancel":
+		if _, ok := client.uploads[id]; !ok || len(fields) != 3 {
+			client.send(fmt.Sprintf("%s Invalid file cancel\n", systemSender))
+			return false
+		}
+		delete(client.uploads, id)
+		return true
+	}
+
+	client.send(fmt.Sprintf("%s Invalid file transfer command\n", systemSender))
+	return false
+}
+
+/*
+parseOffer checks an offer field by field. The checksum is 64 hex digits, or for files
+encrypted end to end, whose IDs start with "e", the sealed checksum and name in base64
+with "-" as the name. The name of other files runs to the end of the line.
+*/
+func parseOffer(fields []string) (*upload, bool) {
+	if len(fields) < 7 {
+		return nil, false
+	}
+	size, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil || size < 0 {
+		return nil, false
+	}
+	chunks, err := strconv.Atoi(fields[5])
+	if err != nil || chunks < 0 || int64(chunks) > max(size, 1) || (size > 0 && chunks == 0) {
+		return nil, false
+	}
+
+	if strings.HasPrefix(fields[2], "e") {
+		sealed, err := base64.StdEncoding.DecodeString(fields[4])
+		if err != nil || len(sealed) == 0 || len(fields) != 7 || fields[6] != "-" {
+			return nil, false
+		}
+	} else {
+		if _, err := hex.DecodeString(fields[4]); err != nil || len(fields[4]) != 64 {
+			return nil, false
+		}
+		name := strings.Join(fields[6:], " ")
+		if name == "" || len(name) > maxFileNameBytes || !utf8.ValidString(name) || strings.ContainsFunc(name, unicode.IsControl) {
+			return nil, false
+		}
+	}
+	return &upload{size: size, chunks: chunks}, true
+}
+
+// cancelUpload drops an upload the server refused part way, telling the room it won't complete
+func (cm *ChatManager) cancelUpload(client *chatClient, roomId, id string) {
+	delete(client.uploads, id)
+	cm.broadcastMessage(client.username, roomId, fmt.Sprintf("%scancel %s", fileCommandPrefix, id))
+}
@@ -7,22 +7,70 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"time"
 )
 
+// Sender of the notices from the server itself, never a valid username
+const systemSender = "*"
+
 type ChatManager struct {
-	Port        string
-	clients     map[string][]net.Conn // Room ID -> list of clients
-	clientMutex sync.Mutex            // Mutex to protect access to the clients map
+	Port         string
+	centralURL   string
+	centralToken string // Operator token for Central, see SetCentralToken
+	settings     Settings
+	clients      map[string][]*chatClient // Room ID -> list of clients
+	clientMutex  sync.Mutex               // Mutex to protect access to the clients map
+	relay        *Relay                   // Links to peer chat servers, nil when federation is off
+	messages     *rateMeter               // Messages broadcast by our clients
+	limiter      *rateLimiter
+	filters      *filterChain // Moderation, between receiving and broadcasting a message
+	transcripts  *transcriptStore
+	backlog      *resumeBuffer // Recent lines of each room, for members rejoining after losing their connection
+}
+
+// Stats is a snapshot of the load on the chat manager
+type Stats struct {
+	Rooms             int     `json:"rooms"`
+	Connections       int     `json:"connections"`
+	MessagesPerSecond float64 `json:"messagesPerSecond"`
+	QueueDepth        int     `json:"queueDepth"` // Messages waiting to be written to clients and peers
 }
 
 // NewChatManager initializes a new ChatManager with the specified port
-func NewChatManager(port string) *ChatManager {
+func NewChatManager(port string, centralURL string, settings Settings) *ChatManager {
+	moderationLog, err := NewModerationLog(settings.Moderation.Log)
+	if err != nil {
+		log.Printf("Moderation log kept in memory only: %v\n", err)
+		moderationLog, _ = NewModerationLog("")
+	}
+	// A limit of 0 would refuse every message, it means the limit was left out
+	if settings.MaxMessageBytes <= 0 {
+		settings.MaxMessageBytes = DefaultSettings().MaxMessageBytes
+	}
+
 	return &ChatManager{
-		Port:    port,
-		clients: make(map[string][]net.Conn),
+		Port:       port,
+		centralURL: centralURL,
+		settings:   settings,
+		clients:    make(map[string][]*chatClient),
+		messages:   newRateMeter(10),
+		limiter:    newRateLimiter(settings.RateLimit),
+		filters: &filterChain{
+			filters: newModerationFilters(settings.Moderation),
+			log:     moderationLog,
+		},
+		transcripts: newTranscriptStore(settings.Transcripts),
+		backlog:     newResumeBuffer(settings.Resume),
 	}
 }
 
+// EnableRelay lets members of a room be spread across chat servers, relaying
+// room traffic to the peers Central assigned them to, which must share the secret
+func (cm *ChatManager) EnableRelay(port string, secret string) {
+	cm.relay = NewRelay(port, cm.centralURL, secret, cm)
+	go cm.relay.Start()
+}
+
 // Start initializes the chat server
 func (cm *ChatManager) Start() {
 	listener, err := net.Listen("tcp", cm.Port)
@@ -49,68 +97,244 @@ func (cm *ChatManager) Start() {
 }
 
 func (cm *ChatManager) handleClient(conn net.Conn) {
-	defer conn.Close()
-
 	clientIp := conn.RemoteAddr().String()
 	reader := bufio.NewReader(conn)
 
-	// Read the initial message (username#roomId)
+	// Read the initial message (username#roomId, or username#roomId#hash to resume, see resume.go)
 	input, err := reader.ReadString('\n')
 	if err != nil {
 		log.Printf("Error reading from client %s: %v\n", clientIp, err)
+		conn.Close()
 		return
 	}
 
 	// Trim the newline and parse the username and roomId
 	input = strings.TrimSpace(input)
-	parts := strings.SplitN(input, "#", 2)
-	if len(parts) != 2 {
+	parts := strings.SplitN(input, "#", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[0] == systemSender {
 		log.Printf("Invalid input format from client %s: %s\n", clientIp, input)
+		conn.Close()
 		return
 	}
 
 	username, roomId := parts[0], parts[1]
 	log.Printf("Client %s (%s) joined room %s\n", username, clientIp, roomId)
 
-	// Add the client to the appropriate room
+	// Add the client to the appropriate room, its writer closes the connection once it leaves
 	cm.clientMutex.Lock()
-	cm.clients[roomId] = append(cm.clients[roomId], conn)
+	if reason := cm.refuseJoin(roomId); reason != "" {
+		cm.clientMutex.Unlock()
+		log.Printf("Refused %s (%s) in room %s: %s\n", username, clientIp, roomId, reason)
+		conn.Write([]byte(closedNotice(reason)))
+		conn.Close()
+		return
+	}
+	client := newChatClient(conn, username, cm.settings.Attachments)
+	if len(parts) == 3 {
+		cm.resume(client, roomId, parts[2])
+	}
+	cm.clients[roomId] = append(cm.clients[roomId], client)
 	cm.clientMutex.Unlock()
+	cm.recordPresence(username, roomId, EntryJoin)
+	defer cm.recordPresence(username, roomId, EntryLeave)
+	defer cm.removeClient(roomId, client)
+
+	if cm.relay != nil {
+		cm.relay.JoinRoom(roomId)
+	}
 
-	// Listen for messages from the client
-	buffer := make([]byte, 1024) // Buffer for receiving messages
+	// Listen for messages from the client, one per line
 	for {
-		n, err := conn.Read(buffer)
+		message, err := readMessage(reader, cm.settings.MaxMessageBytes)
+		if err == errMessageTooLong {
+			client.send(tooLongNotice(cm.settings.MaxMessageBytes))
+			continue
+		}
 		if err != nil {
 			fmt.Printf("Error reading from client: %v\n", err)
 			break
 		}
 
-		message := string(buffer[:n])
 		if message == "" {
 			continue
 		}
 
+		// File transfers have their own checks and budget
+		if isFileCommand(message) {
+			if cm.admitFile(client, roomId, message) {
+				cm.broadcastMessage(username, roomId, message)
+			}
+			continue
+		}
+
+		if !cm.admit(client, roomId, message) {
+			if cm.settings.RateLimit.Action == RateLimitDisconnect {
+				break
+			}
+			continue
+		}
+
+		message, ok := cm.filter(client, roomId, message)
+		if !ok {
+			continue
+		}
+
 		// Broadcast the message to all clients in the same roomId
 		cm.broadcastMessage(username, roomId, message)
 	}
 }
 
+// refuseJoin checks the capacity caps, returning why a new member can't join the room, clientMutex must be held
+func (cm *ChatManager) refuseJoin(roomId string) string {
+	capacity := cm.settings.Capacity
+	if capacity.MaxRoomMembers > 0 && len(cm.clients[roomId]) >= capacity.MaxRoomMembers {
+		return fmt.Sprintf("Room %s is full, rooms are limited to %d members on this server", roomId, capacity.MaxRoomMembers)
+	}
+	if capacity.MaxConnections > 0 {
+		connections := 0
+		for _, clientsInRoom := range cm.clients {
+			connections += len(clientsInRoom)
+		}
+		if connections >= capacity.MaxConnections {
+			return fmt.Sprintf("Server is full, it accepts at most %d connections", capacity.MaxConnections)
+		}
+	}
+	return ""
+}
+
+// Capacity returns the caps this server enforces
+func (cm *ChatManager) Capacity() CapacitySettings {
+	return cm.settings.Capacity
+}
+
+// RoomCount returns the number of rooms with members connected to this server
+func (cm *ChatManager) RoomCount() int {
+	cm.clientMutex.Lock()
+	defer cm.clientMutex.Unlock()
+	return len(cm.clients)
+}
+
+// Stats returns the current load on the chat manager
+func (cm *ChatManager) Stats() Stats {
+	cm.clientMutex.Lock()
+	stats := Stats{Rooms: len(cm.clients)}
+	for _, clientsInRoom := range cm.clients {
+		stats.Connections += len(clientsInRoom)
+		for _, client := range clientsInRoom {
+			stats.QueueDepth += len(client.out)
+		}
+	}
+	cm.clientMutex.Unlock()
+
+	if cm.relay != nil {
+		stats.QueueDepth += cm.relay.QueueDepth()
+	}
+	stats.MessagesPerSecond = cm.messages.Rate()
+	return stats
+}
+
+// admit applies the rate limits to a message from a client, returning whether it can be broadcast
+func (cm *ChatManager) admit(client *chatClient, roomId, message string) bool {
+	wait, ok, violations := cm.limiter.admit(client.username, roomId, len(message))
+	if cm.limiter.shouldReport(violations) {
+		go cm.reportOffender(client.username, roomId, violations)
+	}
+
+	switch {
+	case wait > 0:
+		time.Sleep(wait)
+	case !ok && cm.settings.RateLimit.Action == RateLimitDisconnect:
+		log.Printf("Disconnecting %s from room %s for flooding\n", client.username, roomId)
+		client.send(closedNotice("You were disconnected for sending messages too fast"))
+	case !ok:
+		client.send(fmt.Sprintf("%s You are sending messages too fast, your message was dropped\n", systemSender))
+	}
+	return ok
+}
+
+// removeClient drops a disconnected client from its room
+func (cm *ChatManager) removeClient(roomId string, client *chatClient) {
+	cm.clientMutex.Lock()
+	defer cm.clientMutex.Unlock()
+
+	client.close()
+	clientsInRoom := cm.clients[roomId]
+	for i, c := range clientsInRoom {
+		if c == client {
+			clientsInRoom = append(clientsInRoom[:i], clientsInRoom[i+1:]...)
+			break
+		}
+	}
+
+	if len(clientsInRoom) > 0 {
+		cm.clients[roomId] = clientsInRoom
+	} else {
+		delete(cm.clients, roomId)
+		cm.limiter.forgetRoom(roomId)
+		if cm.relay != nil {
+			cm.relay.LeaveRoom(roomId)
+		}
+	}
+
+	if !cm.hasUser(client.username) {
+		cm.limiter.forgetUser(client.username)
+	}
+}
+
+// hasUser reports whether a user is still connected to any room, clientMutex must be held
+func (cm *ChatManager) hasUser(username string) bool {
+	for _, clientsInRoom := range cm.clients {
+		for _, client := range clientsInRoom {
+			if client.username == username {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (cm *ChatManager) broadcastMessage(username, roomId, message string) {
+	cm.messages.Mark()
 	cm.clientMutex.Lock()
 	defer cm.clientMutex.Unlock()
 
+	// Relay first so peers see messages in the same order as this server
+	if cm.relay != nil {
+		cm.relay.Forward(roomId, username, message)
+	}
+	cm.recordMessage(username, roomId, message, "")
+	cm.sendToRoom(username, roomId, message)
+}
+
+// deliverLocal sends a message relayed from a peer server to our members of the room
+func (cm *ChatManager) deliverLocal(username, roomId, message, peer string) {
+	cm.clientMutex.Lock()
+	defer cm.clientMutex.Unlock()
+
+	cm.recordMessage(username, roomId, message, peer)
+	cm.sendToRoom(username, roomId, message)
+}
+
+// sendToRoom queues a message for every local client in the room, clientMutex must be held
+func (cm *ChatManager) sendToRoom(username, roomId, message string) {
+	line := fmt.Sprintf("%s: %s", username, message)
+	if username == systemSender {
+		line = fmt.Sprintf("%s %s", systemSender, message)
+	}
+	// Kept even without local clients, a member may be about to rejoin
+	cm.backlog.record(roomId, line, replayable(username, message))
+
 	// Send the message to all clients in the specified roomId
 	clientsInRoom, ok := cm.clients[roomId]
 	if !ok {
 		return // No clients in this room
 	}
 
+	message = line + "\n"
 	for _, client := range clientsInRoom {
-		message := fmt.Sprintf("%s: %s\n", username, message)
-		clientIp := client.RemoteAddr().String()
-		if _, err := client.Write([]byte(message)); err != nil {
-			fmt.Printf("Error sending message to client %s: %v\n", clientIp, err)
+		clientIp := client.conn.RemoteAddr().String()
+		if !client.send(message) {
+			fmt.Printf("Outbound queue full for client %s, dropping message\n", clientIp)
 		} else {
 			fmt.Printf("Broadcasted '%s' to room %s '%s'\n", clientIp, message, roomId)
 		}
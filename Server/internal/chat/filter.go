@@ -0,0 +1,194 @@
+package chat
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What a filter decided about a message
+const (
+	FilterPass    = "pass"    // Leave the message as it is
+	FilterRewrite = "rewrite" // Broadcast the filter's version of the message instead
+	FilterReject  = "reject"  // Drop the message and tell the sender why
+	FilterFlag    = "flag"    // Broadcast the message, but record it for moderators
+)
+
+// FilterResult is a filter's verdict on a message, Reason is shown in the moderation log
+type FilterResult struct {
+	Action  string
+	Message string // The rewritten message, for FilterRewrite
+	Reason  string
+}
+
+/*
+Filter inspects the messages users send before they are broadcast. Filters run in the
+order they were added, each seeing the message as rewritten by the previous ones, and
+the first rejection stops the chain. Well-formed key exchanges and end-to-end encrypted
+messages are not filtered, their content is opaque to the server, anything merely
+starting like one is filtered as text. File transfers are validated by admitFile instead.
+*/
+type Filter interface {
+	Name() string
+	Apply(username, roomId, message string) FilterResult
+}
+
+// Pass is the verdict of a filter with nothing to say about a message
+func Pass() FilterResult {
+	return FilterResult{Action: FilterPass}
+}
+
+// Lines clients exchange which are not chat text, see the client's e2e.go
+const (
+	keyCommandPrefix       = "/key "
+	encryptedMessagePrefix = "/enc "
+	publicKeyBytes         = 32      // X25519 public key
+	sealOverheadBytes      = 12 + 16 // Nonce and GCM tag of a sealed message
+)
+
+/*
+isControlFrame reports whether a message is a key announcement or an encrypted message,
+exactly: a single base64 field of the right size with nothing around it.
+*/
+func isControlFrame(message string) bool {
+	if payload, ok := strings.CutPrefix(message, keyCommandPrefix); ok {
+		key, err := base64.StdEncoding.DecodeString(payload)
+		return err == nil && len(key) == publicKeyBytes
+	}
+	if payload, ok := strings.CutPrefix(message, encryptedMessagePrefix); ok {
+		sealed, err := base64.StdEncoding.DecodeString(payload)
+		return err == nil && len(sealed) >= sealOverheadBytes
+	}
+	return false
+}
+
+// ModerationEvent is an entry of the moderation log, for every message a filter acted on
+type ModerationEvent struct {
+	Time     time.Time `json:"time"`
+	Filter   string    `json:"filter"`
+	Action   string    `json:"action"`
+	Reason   string    `json:"reason"`
+	Username string    `json:"username"`
+	RoomId   string    `json:"roomId"`
+	Message  string    `json:"message"` // As sent by the user
+}
+
+// How many moderation events are kept in memory for the admin API
+const moderationLogSize = 500
+
+// ModerationLog keeps the latest moderation events, and appends every event to a file if configured
+type ModerationLog struct {
+	events []ModerationEvent
+	file   *os.File
+	mu     sync.Mutex
+}
+
+// NewModerationLog creates a moderation log, appending JSON lines to path unless it is empty
+func NewModerationLog(path string) (*ModerationLog, error) {
+	moderationLog := &ModerationLog{}
+	if path != "" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open moderation log: %w", err)
+		}
+		moderationLog.file = file
+	}
+	return moderationLog, nil
+}
+
+// Record logs an event and keeps it for the admin API
+func (l *ModerationLog) Record(event ModerationEvent) {
+	log.Printf("Moderation: %s %s message from %s in room %s: %s\n", event.Filter, event.Action, event.Username, event.RoomId, event.Reason)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+	if len(l.events) > moderationLogSize {
+		l.events = l.events[len(l.events)-moderationLogSize:]
+	}
+	if l.file != nil {
+		line, _ := json.Marshal(event)
+		if _, err := l.file.Write(append(line, '\n')); err != nil {
+			log.Printf("Failed to write moderation log: %v\n", err)
+		}
+	}
+}
+
+// Events returns the latest moderation events, oldest first
+func (l *ModerationLog) Events() []ModerationEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]ModerationEvent{}, l.events...)
+}
+
+// filterChain runs a list of filters over every chat message
+type filterChain struct {
+	filters []Filter
+	log     *ModerationLog
+	mu      sync.RWMutex
+}
+
+func (fc *filterChain) add(filter Filter) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.filters = append(fc.filters, filter)
+}
+
+// run applies the filters to a message, returning the message to broadcast, or the reason it was rejected
+func (fc *filterChain) run(username, roomId, message string) (string, string, bool) {
+	if isControlFrame(message) {
+		return message, "", true
+	}
+
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+
+	original := message
+	for _, filter := range fc.filters {
+		result := filter.Apply(username, roomId, message)
+		if result.Action == FilterPass {
+			continue
+		}
+		fc.log.Record(ModerationEvent{
+			Time:     time.Now(),
+			Filter:   filter.Name(),
+			Action:   result.Action,
+			Reason:   result.Reason,
+			Username: username,
+			RoomId:   roomId,
+			Message:  original,
+		})
+
+		switch result.Action {
+		case FilterRewrite:
+			message = result.Message
+		case FilterReject:
+			return "", result.Reason, false
+		}
+	}
+	return message, "", true
+}
+
+// AddFilter appends a filter to the chain every message goes through before being broadcast
+func (cm *ChatManager) AddFilter(filter Filter) {
+	cm.filters.add(filter)
+}
+
+// ModerationLog returns the log the filters report to
+func (cm *ChatManager) ModerationLog() *ModerationLog {
+	return cm.filters.log
+}
+
+// filter runs a message from a client through the filter chain, returning the message to broadcast
+func (cm *ChatManager) filter(client *chatClient, roomId, message string) (string, bool) {
+	message, reason, ok := cm.filters.run(client.username, roomId, message)
+	if !ok {
+		client.send(fmt.Sprintf("%s Your message was not sent: %s\n", systemSender, reason))
+	}
+	return message, ok
+}
@@ -0,0 +1,173 @@
+package chat
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+ModerationSettings picks the built-in filters of a deployment, every filter is off
+unless configured. BlocklistAction is what happens to a message with a blocked word:
+"reject" drops it, "mask" replaces the word with asterisks and "flag" only logs it.
+*/
+type ModerationSettings struct {
+	Blocklist              []string `json:"blocklist"`
+	BlocklistAction        string   `json:"blocklistAction"`
+	StripLinks             bool     `json:"stripLinks"`
+	MaxLength              int      `json:"maxLength"`              // In characters, unlike MaxMessageBytes
+	DuplicateWindowSeconds float64  `json:"duplicateWindowSeconds"` // How long a user can't repeat a message
+	Log                    string   `json:"log"`                    // File the moderation log is appended to
+}
+
+// newModerationFilters builds the built-in filters enabled in the settings, in the order they run
+func newModerationFilters(settings ModerationSettings) []Filter {
+	filters := []Filter{}
+	if settings.MaxLength > 0 {
+		filters = append(filters, NewMaxLengthFilter(settings.MaxLength))
+	}
+	if settings.DuplicateWindowSeconds > 0 {
+		filters = append(filters, NewDuplicateFilter(time.Duration(settings.DuplicateWindowSeconds*float64(time.Second))))
+	}
+	if len(settings.Blocklist) > 0 {
+		filters = append(filters, NewBlocklistFilter(settings.Blocklist, settings.BlocklistAction))
+	}
+	if settings.StripLinks {
+		filters = append(filters, NewLinkFilter())
+	}
+	return filters
+}
+
+// blocklistFilter catches messages containing blocked words, matched whole and ignoring case
+type blocklistFilter struct {
+	pattern *regexp.Regexp
+	action  string
+}
+
+func NewBlocklistFilter(words []string, action string) Filter {
+	quoted := []string{}
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	return &blocklistFilter{
+		pattern: regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`),
+		action:  action,
+	}
+}
+
+func (f *blocklistFilter) Name() string {
+	return "blocklist"
+}
+
+func (f *blocklistFilter) Apply(username, roomId, message string) FilterResult {
+	matches := f.pattern.FindAllString(message, -1)
+	if len(matches) == 0 {
+		return Pass()
+	}
+	reason := fmt.Sprintf("contains blocked words: %s", strings.Join(matches, ", "))
+
+	switch f.action {
+	case "flag":
+		return FilterResult{Action: FilterFlag, Reason: reason}
+	case "mask":
+		masked := f.pattern.ReplaceAllStringFunc(message, func(word string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(word))
+		})
+		return FilterResult{Action: FilterRewrite, Message: masked, Reason: reason}
+	}
+	return FilterResult{Action: FilterReject, Reason: "it contains blocked words"}
+}
+
+// linkFilter replaces links with a placeholder
+type linkFilter struct {
+	pattern *regexp.Regexp
+}
+
+func NewLinkFilter() Filter {
+	return &linkFilter{pattern: regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.-]*://|www\.)\S+`)}
+}
+
+func (f *linkFilter) Name() string {
+	return "links"
+}
+
+func (f *linkFilter) Apply(username, roomId, message string) FilterResult {
+	if !f.pattern.MatchString(message) {
+		return Pass()
+	}
+	return FilterResult{
+		Action:  FilterRewrite,
+		Message: f.pattern.ReplaceAllString(message, "[link removed]"),
+		Reason:  "contains links",
+	}
+}
+
+// maxLengthFilter rejects messages longer than a number of characters
+type maxLengthFilter struct {
+	max int
+}
+
+func NewMaxLengthFilter(max int) Filter {
+	return &maxLengthFilter{max: max}
+}
+
+func (f *maxLengthFilter) Name() string {
+	return "max-length"
+}
+
+func (f *maxLengthFilter) Apply(username, roomId, message string) FilterResult {
+	if utf8.RuneCountInString(message) <= f.max {
+		return Pass()
+	}
+	return FilterResult{Action: FilterReject, Reason: fmt.Sprintf("messages are limited to %d characters", f.max)}
+}
+
+// duplicateFilter rejects a message a user already sent to the room within the window
+type duplicateFilter struct {
+	window time.Duration
+	last   map[string]sentMessage // username#roomId -> last message
+	mu     sync.Mutex
+}
+
+type sentMessage struct {
+	text string
+	at   time.Time
+}
+
+// Above this many users, expired messages are forgotten
+const duplicatePruneSize = 1024
+
+func NewDuplicateFilter(window time.Duration) Filter {
+	return &duplicateFilter{window: window, last: make(map[string]sentMessage)}
+}
+
+func (f *duplicateFilter) Name() string {
+	return "duplicates"
+}
+
+func (f *duplicateFilter) Apply(username, roomId, message string) FilterResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	key := username + "#" + roomId
+	text := strings.ToLower(strings.TrimSpace(message))
+	if last, ok := f.last[key]; ok && last.text == text && now.Sub(last.at) < f.window {
+		return FilterResult{Action: FilterReject, Reason: "you already sent this message"}
+	}
+
+	if len(f.last) >= duplicatePruneSize {
+		for key, last := range f.last {
+			if now.Sub(last.at) >= f.window {
+				delete(f.last, key)
+			}
+		}
+	}
+	f.last[key] = sentMessage{text: text, at: now}
+	return Pass()
+}
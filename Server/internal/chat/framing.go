@@ -0,0 +1,58 @@
+package chat
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// errMessageTooLong is returned for a message over the size limit, the rest of its line is discarded
+var errMessageTooLong = errors.New("message too long")
+
+/*
+readMessage reads one newline terminated message from a client, without its line ending.
+Messages are counted in bytes, so multi-byte UTF-8 text is never split part way through
+a character; a line longer than max bytes is skipped entirely.
+*/
+func readMessage(reader *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		// Leave room for a \r\n line ending
+		if len(line)+len(chunk) > max+2 {
+			return "", discardLine(reader, err)
+		}
+		line = append(line, chunk...)
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+
+	message := strings.TrimRight(string(line), "\r\n")
+	if len(message) > max {
+		return "", errMessageTooLong
+	}
+	return message, nil
+}
+
+// discardLine skips the rest of an oversized line
+func discardLine(reader *bufio.Reader, err error) error {
+	for err == bufio.ErrBufferFull {
+		_, err = reader.ReadSlice('\n')
+	}
+	if err != nil {
+		return err
+	}
+	return errMessageTooLong
+}
+
+// tooLongNotice tells a client why its message was not sent
+func tooLongNotice(max int) string {
+	return fmt.Sprintf("%s Your message was not sent, messages are limited to %d bytes\n", systemSender, max)
+}
@@ -0,0 +1,129 @@
+package chat
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+type readResult struct {
+	message string
+	err     error
+}
+
+func TestReadMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		max      int
+		oneByte  bool // Feed the reader a byte at a time, so lines span reads
+		expected []readResult
+	}{
+		{
+			name:     "just under the limit",
+			input:    "123456789\n",
+			max:      10,
+			expected: []readResult{{"123456789", nil}, {"", io.EOF}},
+		},
+		{
+			name:     "at the limit",
+			input:    "1234567890\n",
+			max:      10,
+			expected: []readResult{{"1234567890", nil}, {"", io.EOF}},
+		},
+		{
+			name:     "just over the limit",
+			input:    "12345678901\nnext\n",
+			max:      10,
+			expected: []readResult{{"", errMessageTooLong}, {"next", nil}, {"", io.EOF}},
+		},
+		{
+			name:     "far over the limit, across buffer fills",
+			input:    strings.Repeat("x", 100) + "\nnext\n",
+			max:      20,
+			oneByte:  true,
+			expected: []readResult{{"", errMessageTooLong}, {"next", nil}, {"", io.EOF}},
+		},
+		{
+			name:     "multibyte runes split across reads",
+			input:    "héllo wörld ✓ done\n",
+			max:      64,
+			oneByte:  true,
+			expected: []readResult{{"héllo wörld ✓ done", nil}, {"", io.EOF}},
+		},
+		{
+			name:     "multibyte runes counted in bytes",
+			input:    "ééééé\néééééé\n",
+			max:      10,
+			expected: []readResult{{"ééééé", nil}, {"", errMessageTooLong}, {"", io.EOF}},
+		},
+		{
+			name:     "CRLF",
+			input:    "hi\r\nthere\r\n",
+			max:      10,
+			expected: []readResult{{"hi", nil}, {"there", nil}, {"", io.EOF}},
+		},
+		{
+			name:     "CRLF at the limit",
+			input:    "1234567890\r\n",
+			max:      10,
+			expected: []readResult{{"1234567890", nil}, {"", io.EOF}},
+		},
+		{
+			name:     "CRLF just over the limit",
+			input:    "12345678901\r\n",
+			max:      10,
+			expected: []readResult{{"", errMessageTooLong}, {"", io.EOF}},
+		},
+		{
+			name:     "empty line",
+			input:    "\n",
+			max:      10,
+			expected: []readResult{{"", nil}, {"", io.EOF}},
+		},
+		{
+			name:     "EOF without a newline",
+			input:    "complete\npartial",
+			max:      10,
+			expected: []readResult{{"complete", nil}, {"", io.EOF}},
+		},
+		{
+			name:     "EOF part way through an oversized line",
+			input:    strings.Repeat("x", 50),
+			max:      10,
+			oneByte:  true,
+			expected: []readResult{{"", io.EOF}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var source io.Reader = strings.NewReader(tt.input)
+			if tt.oneByte {
+				source = iotest.OneByteReader(source)
+			}
+			// The smallest buffer bufio allows, so long lines fill it
+			reader := bufio.NewReaderSize(source, 16)
+
+			for i, want := range tt.expected {
+				message, err := readMessage(reader, tt.max)
+				if message != want.message || err != want.err {
+					t.Fatalf("read %d = (%q, %v), want (%q, %v)", i, message, err, want.message, want.err)
+				}
+			}
+		})
+	}
+}
+
+func TestZeroMaxMessageBytesMeansDefault(t *testing.T) {
+	for _, max := range []int{0, -1} {
+		settings := DefaultSettings()
+		settings.MaxMessageBytes = max
+		cm := NewChatManager(":0", "", settings)
+		if got, want := cm.settings.MaxMessageBytes, DefaultSettings().MaxMessageBytes; got != want {
+			t.Errorf("MaxMessageBytes %d became %d, want the default %d", max, got, want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package chat
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// How many messages can wait for a slow client before new ones are dropped
+const outboundQueueSize = 256
+
+// How long a single write may block before the client is considered gone
+const writeTimeout = 10 * time.Second
+
+/*
+chatClient is a room member connected to this server. Messages for it are queued
+and written by its own goroutine, so a slow client never holds up the rest of the room.
+*/
+type chatClient struct {
+	conn     net.Conn
+	username string
+	out      chan string
+
+	// Files being sent, only touched by the client's reader
+	uploads      map[string]*upload
+	uploadBudget *tokenBucket
+}
+
+func newChatClient(conn net.Conn, username string, attachments AttachmentSettings) *chatClient {
+	client := &chatClient{
+		conn:         conn,
+		username:     username,
+		out:          make(chan string, outboundQueueSize),
+		uploads:      make(map[string]*upload),
+		uploadBudget: newTokenBucket(attachments.BytesPerSecond, 1),
+	}
+	go client.writeLoop()
+	return client
+}
+
+// send queues a message for the client, returning false if its queue is full
+func (c *chatClient) send(message string) bool {
+	select {
+	case c.out <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops the writer once the client has left its room, the writer
+// closes the connection after the messages still queued have been written
+func (c *chatClient) close() {
+	close(c.out)
+}
+
+// disconnect makes the client leave its room, as if it had hung up
+func (c *chatClient) disconnect() {
+	c.conn.SetReadDeadline(time.Now())
+}
+
+func (c *chatClient) writeLoop() {
+	defer c.conn.Close()
+	clientIp := c.conn.RemoteAddr().String()
+	for message := range c.out {
+		c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := c.conn.Write([]byte(message)); err != nil {
+			fmt.Printf("Error sending message to client %s: %v\n", clientIp, err)
+			// Unblocks the reader, which removes the client from its room
+			c.conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package chat
+
+import (
+	"sync"
+	"time"
+)
+
+// rateMeter counts events over a sliding window of one second buckets
+type rateMeter struct {
+	buckets []int
+	last    int64 // Unix second of the most recent bucket
+	mu      sync.Mutex
+}
+
+func newRateMeter(window int) *rateMeter {
+	return &rateMeter{buckets: make([]int, window)}
+}
+
+// Mark records a single event
+func (m *rateMeter) Mark() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(time.Now().Unix())
+	m.buckets[m.last%int64(len(m.buckets))]++
+}
+
+// Rate returns the average events per second over the completed buckets of the window
+func (m *rateMeter) Rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().Unix()
+	m.advance(now)
+
+	total := 0
+	for i, count := range m.buckets {
+		if int64(i) != now%int64(len(m.buckets)) {
+			total += count
+		}
+	}
+	return float64(total) / float64(len(m.buckets)-1)
+}
+
+// advance clears the buckets skipped since the last event, mu must be held
+func (m *rateMeter) advance(now int64) {
+	for second := m.last + 1; second <= now && second <= m.last+int64(len(m.buckets)); second++ {
+		m.buckets[second%int64(len(m.buckets))] = 0
+	}
+	if now > m.last {
+		m.last = now
+	}
+}
@@ -0,0 +1,225 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// What happens to a message over the rate limit
+const (
+	RateLimitDelay      = "delay"      // Hold the sender until the message fits
+	RateLimitDrop       = "drop"       // Drop the message and warn the sender
+	RateLimitDisconnect = "disconnect" // Drop the message and disconnect the sender
+)
+
+/*
+RateLimitSettings limits how fast users and rooms can send, in messages and bytes
+per second. A rate of 0 is unlimited. Buckets hold BurstSeconds worth of their rate,
+so short bursts are allowed. Central is told about a user every ReportAfter violations.
+*/
+type RateLimitSettings struct {
+	UserMessagesPerSecond float64 `json:"userMessagesPerSecond"`
+	UserBytesPerSecond    float64 `json:"userBytesPerSecond"`
+	RoomMessagesPerSecond float64 `json:"roomMessagesPerSecond"`
+	RoomBytesPerSecond    float64 `json:"roomBytesPerSecond"`
+	BurstSeconds          float64 `json:"burstSeconds"`
+	Action                string  `json:"action"`
+	ReportAfter           int     `json:"reportAfter"`
+}
+
+// tokenBucket refills at rate tokens per second, up to capacity
+type tokenBucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(rate float64, burstSeconds float64) *tokenBucket {
+	if rate <= 0 {
+		return nil // Unlimited
+	}
+	capacity := math.Max(rate*burstSeconds, 1)
+	return &tokenBucket{rate: rate, capacity: capacity, tokens: capacity, last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if b == nil {
+		return
+	}
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// cost caps a request at the bucket's capacity, so oversized messages are not refused forever
+func (b *tokenBucket) cost(n float64) float64 {
+	return math.Min(n, b.capacity)
+}
+
+// available reports whether n tokens can be taken right away
+func (b *tokenBucket) available(n float64) bool {
+	if b == nil {
+		return true
+	}
+	b.refill(time.Now())
+	return b.tokens >= b.cost(n)
+}
+
+// take removes n tokens, going into debt if there aren't enough
+func (b *tokenBucket) take(n float64) {
+	if b == nil {
+		return
+	}
+	b.tokens -= b.cost(n)
+}
+
+// wait returns how long until the bucket is out of debt
+func (b *tokenBucket) wait() time.Duration {
+	if b == nil || b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type limitBuckets struct {
+	messages   *tokenBucket
+	bytes      *tokenBucket
+	violations int
+}
+
+// rateLimiter holds the buckets of every user and room on this server
+type rateLimiter struct {
+	settings RateLimitSettings
+	users    map[string]*limitBuckets
+	rooms    map[string]*limitBuckets
+	mu       sync.Mutex
+}
+
+func newRateLimiter(settings RateLimitSettings) *rateLimiter {
+	return &rateLimiter{
+		settings: settings,
+		users:    make(map[string]*limitBuckets),
+		rooms:    make(map[string]*limitBuckets),
+	}
+}
+
+/*
+admit checks a message against the user's and the room's limits. With the delay action
+the message is always admitted, but the sender has to wait before it is sent. Otherwise
+it is admitted only if it fits right away. Over-limit messages count as violations.
+*/
+func (l *rateLimiter) admit(username, roomId string, size int) (time.Duration, bool, int) {
+	return l.charge(username, roomId, size, l.settings.Action == RateLimitDelay, true)
+}
+
+/*
+admitFile charges a file transfer line to the user's and the room's limits, always
+holding the sender rather than dropping it. The bytes of a file are paced by the user's
+upload budget instead of their message bytes, see attachments.go, so only the room's byte
+bucket is charged for them.
+*/
+func (l *rateLimiter) admitFile(username, roomId string, size int) (time.Duration, int) {
+	wait, _, violations := l.charge(username, roomId, size, true, false)
+	return wait, violations
+}
+
+// charge takes a message from the buckets, holding the sender with delay or refusing it otherwise when it doesn't fit
+func (l *rateLimiter) charge(username, roomId string, size int, delay bool, userBytes bool) (time.Duration, bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	user, ok := l.users[username]
+	if !ok {
+		user = &limitBuckets{
+			messages: newTokenBucket(l.settings.UserMessagesPerSecond, l.settings.BurstSeconds),
+			bytes:    newTokenBucket(l.settings.UserBytesPerSecond, l.settings.BurstSeconds),
+		}
+		l.users[username] = user
+	}
+	room, ok := l.rooms[roomId]
+	if !ok {
+		room = &limitBuckets{
+			messages: newTokenBucket(l.settings.RoomMessagesPerSecond, l.settings.BurstSeconds),
+			bytes:    newTokenBucket(l.settings.RoomBytesPerSecond, l.settings.BurstSeconds),
+		}
+		l.rooms[roomId] = room
+	}
+	byteBuckets := []*tokenBucket{room.bytes}
+	if userBytes {
+		byteBuckets = append(byteBuckets, user.bytes)
+	}
+
+	fits := user.messages.available(1) && room.messages.available(1)
+	for _, bucket := range byteBuckets {
+		fits = fits && bucket.available(float64(size))
+	}
+	if !fits {
+		user.violations++
+	}
+	if !fits && !delay {
+		return 0, false, user.violations
+	}
+
+	wait := time.Duration(0)
+	for _, bucket := range []*tokenBucket{user.messages, room.messages} {
+		bucket.take(1)
+		wait = max(wait, bucket.wait())
+	}
+	for _, bucket := range byteBuckets {
+		bucket.take(float64(size))
+		wait = max(wait, bucket.wait())
+	}
+	return wait, true, user.violations
+}
+
+// forgetUser drops the buckets of a user who left this server
+func (l *rateLimiter) forgetUser(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.users, username)
+}
+
+// forgetRoom drops the buckets of a room which has no members left on this server
+func (l *rateLimiter) forgetRoom(roomId string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.rooms, roomId)
+}
+
+// shouldReport reports whether Central should hear about a user with this many violations
+func (l *rateLimiter) shouldReport(violations int) bool {
+	return l.settings.ReportAfter > 0 && violations > 0 && violations%l.settings.ReportAfter == 0
+}
+
+// reportOffender tells Central that a user keeps going over the rate limit
+func (cm *ChatManager) reportOffender(username, roomId string, violations int) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"username":   username,
+		"roomId":     roomId,
+		"violations": violations,
+		"action":     cm.settings.RateLimit.Action,
+	})
+	if err != nil {
+		log.Printf("Error serializing offender report: %v\n", err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, cm.centralURL+"/clients/offenders", bytes.NewBuffer(payload))
+	if err != nil {
+		log.Printf("Failed to report offender %s: %v\n", username, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Operator-Token", cm.centralToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Failed to report offender %s: %v\n", username, err)
+		return
+	}
+	defer resp.Body.Close()
+}
@@ -0,0 +1,403 @@
+package chat
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	placementTTL = 5 * time.Second // How long a room placement fetched from Central is trusted before it is refreshed
+
+	placementRetries = 5                      // Attempts to fetch a placement Central doesn't know yet
+	placementBackoff = 250 * time.Millisecond // Before the first retry, doubled after each one
+	pendingFrames    = 256                    // Messages kept per room while its placement is unknown
+
+	relayNonceBytes       = 32
+	relayHandshakeTimeout = 5 * time.Second
+	relayLinkIdle         = 2 * time.Minute // Links without traffic for this long are closed
+)
+
+/*
+Relay links chat servers together so that members of the same room can be
+connected to different servers. Central decides which server each member
+connects to; the relay keeps one TCP link per peer server and forwards every
+message of a shared room over it. A single link per peer keeps the messages of
+each room in the order they were broadcast on the originating server.
+
+Frames on a link are single lines: roomId#username#"quoted message"
+
+Peers share a secret. A server accepting a link sends a random challenge line, the
+dialing server answers with the hex HMAC-SHA256 of it under the secret, and only then
+sends frames. Messages of a room whose placement is still being fetched from Central are
+kept until it arrives, then forwarded in order.
+*/
+type Relay struct {
+	Port       string
+	centralURL string
+	manager    *ChatManager
+	secret     []byte
+	maxFrame   int // Longest frame a peer may send, in bytes
+
+	links      map[string]*relayLink     // Peer server -> outbound link
+	placements map[string]*roomPlacement // Room ID -> where its members are connected
+	pending    map[string][]string       // Room ID -> frames waiting for its placement
+	mu         sync.Mutex
+}
+
+// roomPlacement mirrors Central's view of a room, as returned by GET /rooms/:roomId
+type roomPlacement struct {
+	Self    string            `json:"self"`    // This server, as Central sees it
+	Home    string            `json:"home"`    // The room's compromise server
+	Members map[string]string `json:"members"` // Username -> chat server
+	fetched time.Time
+}
+
+type relayLink struct {
+	peer string
+	out  chan string
+}
+
+// NewRelay creates a relay for the given chat manager, listening on port for peers which know the secret
+func NewRelay(port string, centralURL string, secret string, manager *ChatManager) *Relay {
+	return &Relay{
+		Port:       port,
+		centralURL: centralURL,
+		manager:    manager,
+		secret:     []byte(secret),
+		// Quoting makes a message at most 4 times longer, plus the room ID and username
+		maxFrame:   4*manager.settings.MaxMessageBytes + 1024,
+		links:      make(map[string]*relayLink),
+		placements: make(map[string]*roomPlacement),
+		pending:    make(map[string][]string),
+	}
+}
+
+// Start accepts links from peer chat servers
+func (r *Relay) Start() {
+	listener, err := net.Listen("tcp", r.Port)
+	if err != nil {
+		fmt.Printf("Error starting relay: %v\n", err)
+		return
+	}
+	defer listener.Close()
+
+	fmt.Printf("Relay listening on port %s...\n", r.Port)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Printf("Error accepting relay connection: %v\n", err)
+			continue
+		}
+
+		go r.handlePeer(conn)
+	}
+}
+
+// handlePeer delivers the messages relayed by a peer server to our local room members
+func (r *Relay) handlePeer(conn net.Conn) {
+	defer conn.Close()
+	peer := conn.RemoteAddr().String()
+	host, _, _ := net.SplitHostPort(peer)
+
+	reader := bufio.NewReader(conn)
+	if err := r.challenge(conn, reader); err != nil {
+		log.Printf("Refused relay link from %s: %v\n", peer, err)
+		return
+	}
+	log.Printf("Relay link from %s established\n", peer)
+
+	for {
+		// Peers close idle links, a link silent for longer is dead
+		conn.SetReadDeadline(time.Now().Add(2 * relayLinkIdle))
+		frame, err := readMessage(reader, r.maxFrame)
+		if err == errMessageTooLong {
+			log.Printf("Oversized relay frame from %s\n", peer)
+			continue
+		}
+		if err != nil {
+			break
+		}
+		parts := strings.SplitN(frame, "#", 3)
+		if len(parts) != 3 {
+			log.Printf("Invalid relay frame from %s\n", peer)
+			continue
+		}
+		message, err := strconv.Unquote(parts[2])
+		if err != nil {
+			log.Printf("Invalid relay payload from %s: %v\n", peer, err)
+			continue
+		}
+
+		r.manager.deliverLocal(parts[1], parts[0], message, host)
+	}
+	log.Printf("Relay link from %s closed\n", peer)
+}
+
+// challenge checks that a peer knows the secret before it can relay anything
+func (r *Relay) challenge(conn net.Conn, reader *bufio.Reader) error {
+	conn.SetDeadline(time.Now().Add(relayHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := make([]byte, relayNonceBytes)
+	rand.Read(nonce)
+	if _, err := conn.Write([]byte(hex.EncodeToString(nonce) + "\n")); err != nil {
+		return err
+	}
+	answer, err := readMessage(reader, 2*sha256.Size)
+	if err != nil {
+		return fmt.Errorf("no answer to the challenge: %w", err)
+	}
+	mac, err := hex.DecodeString(answer)
+	if err != nil || !hmac.Equal(mac, r.sign(nonce)) {
+		return fmt.Errorf("wrong relay secret")
+	}
+	return nil
+}
+
+// answer proves to the peer we dialed that we know the secret
+func (r *Relay) answer(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(relayHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	line, err := readMessage(bufio.NewReader(conn), 2*relayNonceBytes)
+	if err != nil {
+		return fmt.Errorf("no challenge: %w", err)
+	}
+	nonce, err := hex.DecodeString(line)
+	if err != nil {
+		return fmt.Errorf("invalid challenge: %w", err)
+	}
+	_, err = conn.Write([]byte(hex.EncodeToString(r.sign(nonce)) + "\n"))
+	return err
+}
+
+// sign is the HMAC of a challenge under the relay secret
+func (r *Relay) sign(nonce []byte) []byte {
+	mac := hmac.New(sha256.New, r.secret)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// JoinRoom refreshes the placement of a room when one of its members connects to us
+func (r *Relay) JoinRoom(roomId string) {
+	r.mu.Lock()
+	if _, ok := r.pending[roomId]; !ok {
+		r.pending[roomId] = []string{}
+	}
+	r.mu.Unlock()
+	go r.refreshPlacement(roomId)
+}
+
+// LeaveRoom forgets a room once none of its members are connected to us
+func (r *Relay) LeaveRoom(roomId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.placements, roomId)
+	delete(r.pending, roomId)
+}
+
+/*
+Forward queues a message for every peer server hosting members of the room.
+It must be called in broadcast order; messages for the same peer are written
+in the order they were queued.
+*/
+func (r *Relay) Forward(roomId, username, message string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	frame := fmt.Sprintf("%s#%s#%s\n", roomId, username, strconv.Quote(message))
+	placement, ok := r.placements[roomId]
+	if !ok {
+		// Kept until the placement arrives, the room is not ours if nobody joined it
+		if pending, fetching := r.pending[roomId]; fetching && len(pending) < pendingFrames {
+			r.pending[roomId] = append(pending, frame)
+		} else if fetching {
+			log.Printf("Placement of room %s still unknown, dropping message\n", roomId)
+		}
+		return
+	}
+	if time.Since(placement.fetched) > placementTTL {
+		placement.fetched = time.Now() // Avoid piling up refreshes
+		go r.refreshPlacement(roomId)
+	}
+	r.send(placement, frame)
+}
+
+// send queues a frame for the peers of a placement, r.mu must be held
+func (r *Relay) send(placement *roomPlacement, frame string) {
+	for _, peer := range placement.peers() {
+		link, ok := r.links[peer]
+		if !ok {
+			link = &relayLink{peer: peer, out: make(chan string, 256)}
+			r.links[peer] = link
+			go r.runLink(link)
+		}
+
+		select {
+		case link.out <- frame:
+		default:
+			log.Printf("Relay link to %s is backed up, dropping a message\n", peer)
+		}
+	}
+}
+
+// QueueDepth returns the number of frames waiting to be written to peers
+func (r *Relay) QueueDepth() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	depth := 0
+	for _, link := range r.links {
+		depth += len(link.out)
+	}
+	return depth
+}
+
+// peers returns the distinct servers, other than us, that host members of the room
+func (p *roomPlacement) peers() []string {
+	seen := make(map[string]bool)
+	peers := []string{}
+	for _, server := range p.Members {
+		if server == p.Self || seen[server] {
+			continue
+		}
+		seen[server] = true
+		peers = append(peers, server)
+	}
+	return peers
+}
+
+// runLink dials a peer and writes queued frames until the link fails or stays idle
+func (r *Relay) runLink(link *relayLink) {
+	defer func() {
+		r.mu.Lock()
+		if r.links[link.peer] == link {
+			delete(r.links, link.peer)
+		}
+		r.mu.Unlock()
+	}()
+
+	address := link.peer
+	// hack for local testing
+	if address == "::1" {
+		address = "localhost"
+	}
+	conn, err := net.DialTimeout("tcp", address+r.Port, 2*time.Second)
+	if err != nil {
+		log.Printf("Failed to open relay link to %s: %v\n", link.peer, err)
+		return
+	}
+	defer conn.Close()
+	if err := r.answer(conn); err != nil {
+		log.Printf("Relay link to %s refused: %v\n", link.peer, err)
+		return
+	}
+
+	idle := time.NewTimer(relayLinkIdle)
+	defer idle.Stop()
+	for {
+		select {
+		case frame := <-link.out:
+			if _, err := conn.Write([]byte(frame)); err != nil {
+				log.Printf("Relay link to %s failed: %v\n", link.peer, err)
+				return
+			}
+			idle.Reset(relayLinkIdle)
+		case <-idle.C:
+			// Forward queues under r.mu, so nothing can be queued once the link is gone
+			r.mu.Lock()
+			if len(link.out) > 0 {
+				r.mu.Unlock()
+				idle.Reset(relayLinkIdle)
+				continue
+			}
+			delete(r.links, link.peer)
+			r.mu.Unlock()
+			log.Printf("Closing idle relay link to %s\n", link.peer)
+			return
+		}
+	}
+}
+
+/*
+refreshPlacement asks Central where the members of a room are connected, retrying with
+a growing backoff, and forwards the messages kept while it was unknown. A room that is
+still unknown after the last attempt drops them, and its messages stay local until
+another member joins.
+*/
+func (r *Relay) refreshPlacement(roomId string) {
+	backoff := placementBackoff
+	for attempt := 1; ; attempt++ {
+		placement, err := r.fetchPlacement(roomId)
+		if err == nil {
+			r.mu.Lock()
+			r.placements[roomId] = placement
+			pending, joined := r.pending[roomId]
+			if joined {
+				for _, frame := range pending {
+					r.send(placement, frame)
+				}
+				r.pending[roomId] = []string{}
+			}
+			r.mu.Unlock()
+			return
+		}
+		log.Printf("Failed to fetch placement for room %s (attempt %d): %v\n", roomId, attempt, err)
+		if attempt == placementRetries {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, known := r.placements[roomId]; !known {
+		if len(r.pending[roomId]) > 0 {
+			log.Printf("Dropping %d messages of room %s, its placement is unknown\n", len(r.pending[roomId]), roomId)
+		}
+		delete(r.pending, roomId) // Until another member joins
+	}
+}
+
+// fetchPlacement gets a room's placement from Central
+func (r *Relay) fetchPlacement(roomId string) (*roomPlacement, error) {
+	req, err := http.NewRequest(http.MethodGet, r.centralURL+"/rooms/"+url.PathEscape(roomId), nil)
+	if err != nil {
+		return nil, err
+	}
+	// Only the members of a room and chat servers may look it up
+	req.Header.Set("X-Operator-Token", r.manager.centralToken)
+
+	httpClient := &http.Client{Timeout: 2 * time.Second}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+
+	var placement roomPlacement
+	if err := json.NewDecoder(resp.Body).Decode(&placement); err != nil {
+		return nil, fmt.Errorf("invalid placement: %w", err)
+	}
+	placement.fetched = time.Now()
+	return &placement, nil
+}
@@ -0,0 +1,144 @@
+package chat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResumeSettings limits the lines kept for members rejoining a room, MaxRooms 0 keeps none
+type ResumeSettings struct {
+	MaxLines int `json:"maxLines"` // Per room, older lines are dropped
+	MaxRooms int `json:"maxRooms"` // Rooms kept, the least recently active are dropped
+}
+
+/*
+A member who lost their connection rejoins with username#roomId#<hash>, the hash of the
+last line they received: the first 8 bytes of its SHA-256 in hex, without the line
+ending. The server sends the lines of the room that followed it before any new ones.
+Keys and file transfers are not replayed, the client announces a fresh key anyway and
+a transfer can't be resumed halfway.
+
+Members the server disconnects on purpose, e.g. kicked, are told with a last notice that
+starts with /closed, so their client doesn't reconnect.
+*/
+const closedPrefix = "/closed "
+
+// closedNotice is the last line sent to a member disconnected on purpose
+func closedNotice(reason string) string {
+	return fmt.Sprintf("%s %s%s\n", systemSender, closedPrefix, reason)
+}
+
+type backlogLine struct {
+	hash string
+	line string // Empty for lines that are not replayed
+}
+
+type roomBacklog struct {
+	lines   []backlogLine
+	updated time.Time
+}
+
+// resumeBuffer keeps the last lines sent to each room, after its members left too
+type resumeBuffer struct {
+	settings ResumeSettings
+	rooms    map[string]*roomBacklog
+	mu       sync.Mutex
+}
+
+func newResumeBuffer(settings ResumeSettings) *resumeBuffer {
+	return &resumeBuffer{settings: settings, rooms: make(map[string]*roomBacklog)}
+}
+
+// lineHash identifies a line for resuming, as clients compute it
+func lineHash(line string) string {
+	sum := sha256.Sum256([]byte(line))
+	return hex.EncodeToString(sum[:8])
+}
+
+// replayable tells if a line sent by username is replayed to rejoining members
+func replayable(username, message string) bool {
+	if username == systemSender {
+		return true
+	}
+	return !strings.HasPrefix(message, keyCommandPrefix) && !isFileCommand(message)
+}
+
+// record adds a line the room's members were sent, without its line ending
+func (rb *resumeBuffer) record(roomId, line string, replay bool) {
+	if rb.settings.MaxRooms <= 0 || rb.settings.MaxLines <= 0 {
+		return
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	backlog, ok := rb.rooms[roomId]
+	if !ok {
+		if len(rb.rooms) >= rb.settings.MaxRooms {
+			rb.evictOldest()
+		}
+		backlog = &roomBacklog{}
+		rb.rooms[roomId] = backlog
+	}
+	entry := backlogLine{hash: lineHash(line)}
+	if replay {
+		entry.line = line
+	}
+	backlog.lines = append(backlog.lines, entry)
+	if len(backlog.lines) > rb.settings.MaxLines {
+		backlog.lines = backlog.lines[len(backlog.lines)-rb.settings.MaxLines:]
+	}
+	backlog.updated = time.Now()
+}
+
+// evictOldest drops the least recently active room, mu must be held
+func (rb *resumeBuffer) evictOldest() {
+	oldest := ""
+	for roomId, backlog := range rb.rooms {
+		if oldest == "" || backlog.updated.Before(rb.rooms[oldest].updated) {
+			oldest = roomId
+		}
+	}
+	delete(rb.rooms, oldest)
+}
+
+// since returns the replayable lines that followed the line with hash, false if it isn't kept
+func (rb *resumeBuffer) since(roomId, hash string) ([]string, bool) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	backlog, ok := rb.rooms[roomId]
+	if !ok {
+		return nil, false
+	}
+	for i := len(backlog.lines) - 1; i >= 0; i-- {
+		if backlog.lines[i].hash != hash {
+			continue
+		}
+		lines := []string{}
+		for _, entry := range backlog.lines[i+1:] {
+			if entry.line != "" {
+				lines = append(lines, entry.line)
+			}
+		}
+		return lines, true
+	}
+	return nil, false
+}
+
+// resume sends a rejoining member what they missed, clientMutex must be held so nothing new slips in between
+func (cm *ChatManager) resume(client *chatClient, roomId, hash string) {
+	lines, ok := cm.backlog.since(roomId, hash)
+	if !ok {
+		client.send(fmt.Sprintf("%s Messages sent while you were disconnected are not available on this server\n", systemSender))
+		return
+	}
+	for _, line := range lines {
+		client.send(line + "\n")
+	}
+	if len(lines) > 0 {
+		client.send(fmt.Sprintf("%s Restored %d messages sent while you were disconnected\n", systemSender, len(lines)))
+	}
+}
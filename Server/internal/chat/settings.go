@@ -0,0 +1,55 @@
+package chat
+
+// Settings configures a chat manager for a deployment, read from chat.json
+type Settings struct {
+	MaxMessageBytes int                `json:"maxMessageBytes"` // Longest message a client may send, line ending excluded, the default if 0 or less
+	RateLimit       RateLimitSettings  `json:"rateLimit"`
+	Attachments     AttachmentSettings `json:"attachments"`
+	Moderation      ModerationSettings `json:"moderation"`
+	Transcripts     TranscriptSettings `json:"transcripts"`
+	Capacity        CapacitySettings   `json:"capacity"`
+	Resume          ResumeSettings     `json:"resume"`
+	WebSocket       WebSocketSettings  `json:"webSocket"`
+}
+
+// CapacitySettings caps what a server accepts, 0 is unlimited. Central is told with every heartbeat.
+type CapacitySettings struct {
+	MaxConnections int `json:"maxConnections"` // Clients connected to this server, in every room
+	MaxRoomMembers int `json:"maxRoomMembers"` // Members of a room connected to this server
+}
+
+// DefaultSettings returns the settings used when a deployment doesn't configure any
+func DefaultSettings() Settings {
+	return Settings{
+		MaxMessageBytes: 64 * 1024,
+		RateLimit: RateLimitSettings{
+			UserMessagesPerSecond: 5,
+			UserBytesPerSecond:    16 * 1024,
+			RoomMessagesPerSecond: 20,
+			RoomBytesPerSecond:    64 * 1024,
+			BurstSeconds:          2,
+			Action:                RateLimitDrop,
+			ReportAfter:           10,
+		},
+		Attachments: AttachmentSettings{
+			MaxBytes:       10 * 1024 * 1024,
+			BytesPerSecond: 256 * 1024,
+			MaxOpenUploads: defaultMaxOpenUploads,
+		},
+		Moderation: ModerationSettings{
+			BlocklistAction: "reject",
+		},
+		Transcripts: TranscriptSettings{
+			MaxEntries: 1000,
+			MaxRooms:   200,
+		},
+		Capacity: CapacitySettings{
+			MaxConnections: 1000,
+			MaxRoomMembers: 8,
+		},
+		Resume: ResumeSettings{
+			MaxLines: 200,
+			MaxRooms: 200,
+		},
+	}
+}
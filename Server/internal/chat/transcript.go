@@ -0,0 +1,227 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of transcript entries
+const (
+	EntryMessage = "message"
+	EntryNotice  = "notice"
+	EntryJoin    = "join"
+	EntryLeave   = "leave"
+)
+
+// Transcript formats
+const (
+	FormatText     = "txt"
+	FormatJSON     = "json"
+	FormatMarkdown = "md"
+)
+
+// TranscriptSettings limits the history kept for transcripts, MaxRooms 0 keeps none
+type TranscriptSettings struct {
+	MaxEntries int `json:"maxEntries"` // Per room, older entries are dropped
+	MaxRooms   int `json:"maxRooms"`   // Rooms kept, including closed ones, the least recently active are dropped
+}
+
+/*
+TranscriptEntry is a line of a room's history as this server saw it. Server is empty
+for what was handled here, or the peer server a message was relayed from, so a
+transcript shows which server handled each span of the conversation. Encrypted
+messages and files are opaque to the server and only recorded as such.
+*/
+type TranscriptEntry struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Sender  string    `json:"sender,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Server  string    `json:"server,omitempty"`
+}
+
+type roomHistory struct {
+	entries []TranscriptEntry
+	updated time.Time
+}
+
+// transcriptStore keeps the recent history of rooms, after they close too
+type transcriptStore struct {
+	settings TranscriptSettings
+	rooms    map[string]*roomHistory
+	mu       sync.Mutex
+}
+
+func newTranscriptStore(settings TranscriptSettings) *transcriptStore {
+	return &transcriptStore{settings: settings, rooms: make(map[string]*roomHistory)}
+}
+
+func (ts *transcriptStore) record(roomId string, entry TranscriptEntry) {
+	if ts.settings.MaxRooms <= 0 {
+		return
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	history, ok := ts.rooms[roomId]
+	if !ok {
+		if len(ts.rooms) >= ts.settings.MaxRooms {
+			ts.evictOldest()
+		}
+		history = &roomHistory{}
+		ts.rooms[roomId] = history
+	}
+	history.entries = append(history.entries, entry)
+	if ts.settings.MaxEntries > 0 && len(history.entries) > ts.settings.MaxEntries {
+		history.entries = history.entries[len(history.entries)-ts.settings.MaxEntries:]
+	}
+	history.updated = entry.Time
+}
+
+// evictOldest drops the least recently active room, mu must be held
+func (ts *transcriptStore) evictOldest() {
+	oldest := ""
+	for roomId, history := range ts.rooms {
+		if oldest == "" || history.updated.Before(ts.rooms[oldest].updated) {
+			oldest = roomId
+		}
+	}
+	delete(ts.rooms, oldest)
+}
+
+func (ts *transcriptStore) get(roomId string) ([]TranscriptEntry, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	history, ok := ts.rooms[roomId]
+	if !ok {
+		return nil, false
+	}
+	return append([]TranscriptEntry{}, history.entries...), true
+}
+
+// recordMessage adds a chat line to the room's history, server is empty for our own clients
+func (cm *ChatManager) recordMessage(username, roomId, message, server string) {
+	entry := TranscriptEntry{Time: time.Now(), Kind: EntryMessage, Sender: username, Message: message, Server: server}
+	switch {
+	case username == systemSender:
+		entry.Kind, entry.Sender = EntryNotice, ""
+	case strings.HasPrefix(message, keyCommandPrefix):
+		return
+	case strings.HasPrefix(message, encryptedMessagePrefix):
+		entry.Message = "[encrypted message]"
+	case isFileCommand(message):
+		fields := strings.Fields(message)
+		if len(fields) < 7 || fields[1] != "offer" {
+			return // Chunks and cancellations
+		}
+		entry.Message = "[file: " + strings.Join(fields[6:], " ") + "]"
+		if fields[6] == "-" {
+			entry.Message = "[encrypted file]"
+		}
+	}
+	cm.transcripts.record(roomId, entry)
+}
+
+// recordPresence marks a member connecting to or leaving this server
+func (cm *ChatManager) recordPresence(username, roomId, kind string) {
+	cm.transcripts.record(roomId, TranscriptEntry{Time: time.Now(), Kind: kind, Sender: username})
+}
+
+// Transcript returns the history of a room this server handled, oldest first
+func (cm *ChatManager) Transcript(roomId string) ([]TranscriptEntry, error) {
+	entries, ok := cm.transcripts.get(roomId)
+	if !ok {
+		return nil, fmt.Errorf("no transcript for room %s", roomId)
+	}
+	return entries, nil
+}
+
+// TranscriptRooms returns the rooms with a transcript, including closed ones
+func (cm *ChatManager) TranscriptRooms() []string {
+	cm.transcripts.mu.Lock()
+	defer cm.transcripts.mu.Unlock()
+	rooms := []string{}
+	for roomId := range cm.transcripts.rooms {
+		rooms = append(rooms, roomId)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// FormatTranscript renders a transcript as plain text, JSON or Markdown, returning its content type
+func FormatTranscript(roomId string, entries []TranscriptEntry, format string) ([]byte, string, error) {
+	switch format {
+	case FormatJSON:
+		data, err := json.MarshalIndent(map[string]interface{}{"roomId": roomId, "entries": entries}, "", "  ")
+		return data, "application/json", err
+	case FormatText, FormatMarkdown:
+	default:
+		return nil, "", fmt.Errorf("unknown transcript format %s, use txt, json or md", format)
+	}
+
+	markdown := format == FormatMarkdown
+	var out bytes.Buffer
+	if markdown {
+		fmt.Fprintf(&out, "# Transcript of room %s\n\n", roomId)
+	} else {
+		fmt.Fprintf(&out, "Transcript of room %s\n\n", roomId)
+	}
+
+	server := ""
+	for i, entry := range entries {
+		// Mark every change of the server handling the conversation
+		if i == 0 || entry.Server != server {
+			server = entry.Server
+			if markdown {
+				if i > 0 {
+					out.WriteString("\n")
+				}
+				fmt.Fprintf(&out, "**%s**\n\n", describeServer(server))
+			} else {
+				fmt.Fprintf(&out, "--- %s ---\n", describeServer(server))
+			}
+		}
+
+		timestamp := entry.Time.Format("2006-01-02 15:04:05")
+		line := ""
+		switch entry.Kind {
+		case EntryJoin:
+			line = fmt.Sprintf("%s connected", entry.Sender)
+		case EntryLeave:
+			line = fmt.Sprintf("%s disconnected", entry.Sender)
+		case EntryNotice:
+			line = "* " + entry.Message
+		default:
+			line = fmt.Sprintf("%s: %s", entry.Sender, entry.Message)
+		}
+
+		if markdown {
+			if entry.Kind == EntryMessage {
+				line = fmt.Sprintf("**%s**: %s", entry.Sender, entry.Message)
+			} else {
+				line = "_" + line + "_"
+			}
+			fmt.Fprintf(&out, "- `%s` %s\n", timestamp, line)
+		} else {
+			fmt.Fprintf(&out, "[%s] %s\n", timestamp, line)
+		}
+	}
+
+	contentType := "text/plain; charset=utf-8"
+	if markdown {
+		contentType = "text/markdown; charset=utf-8"
+	}
+	return out.Bytes(), contentType, nil
+}
+
+func describeServer(server string) string {
+	if server == "" {
+		return "handled by this server"
+	}
+	return "relayed from " + server
+}
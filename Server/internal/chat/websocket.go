@@ -0,0 +1,113 @@
+package chat
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketSettings lists the web front ends whose pages may connect, as origins like https://chat.example.com
+type WebSocketSettings struct {
+	AllowedOrigins []string `json:"allowedOrigins"` // "*" allows any, pages served by this server are always allowed
+}
+
+/*
+WebSocketHandler serves the chat protocol to browser clients. The semantics are the
+same as on the TCP port: the first text frame is username#roomId, every following
+frame is one message, and every line the server sends arrives as its own frame.
+Browsers only connect from the allowed origins, so other sites can't chat as their users.
+*/
+func (cm *ChatManager) WebSocketHandler() http.Handler {
+	return websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			return checkOrigin(req, cm.settings.WebSocket.AllowedOrigins)
+		},
+		Handler: func(ws *websocket.Conn) {
+			ws.MaxPayloadBytes = cm.settings.MaxMessageBytes + 2
+			done := make(chan struct{})
+			cm.handleClient(&lineConn{Conn: ws, remoteAddr: ws.Request().RemoteAddr, done: done})
+			// The handler must not return before the writer closed the connection
+			<-done
+		},
+	}
+}
+
+// lineConn adapts a WebSocket to the newline framed chat protocol
+type lineConn struct {
+	*websocket.Conn
+	remoteAddr string
+	pending    []byte
+	done       chan struct{}
+}
+
+// webSocketAddr is the browser's address, the WebSocket's own RemoteAddr is its origin
+type webSocketAddr string
+
+func (a webSocketAddr) Network() string { return "websocket" }
+func (a webSocketAddr) String() string  { return string(a) }
+
+func (c *lineConn) RemoteAddr() net.Addr {
+	return webSocketAddr(c.remoteAddr)
+}
+
+// Read returns the frames received, each as a single line
+func (c *lineConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		var frame string
+		if err := websocket.Message.Receive(c.Conn, &frame); err != nil {
+			return 0, err
+		}
+		frame = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(frame)
+		c.pending = []byte(frame + "\n")
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends every line as its own text frame
+func (c *lineConn) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		if err := websocket.Message.Send(c.Conn, line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close closes the WebSocket and lets the handler return
+func (c *lineConn) Close() error {
+	err := c.Conn.Close()
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+	return err
+}
+
+// checkOrigin refuses WebSocket requests from pages of other origins, requests without one don't come from a browser
+func checkOrigin(req *http.Request, allowed []string) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return fmt.Errorf("invalid origin %q", origin)
+	}
+	if strings.EqualFold(parsed.Host, req.Host) {
+		return nil
+	}
+	for _, allowedOrigin := range allowed {
+		if allowedOrigin == "*" || strings.EqualFold(strings.TrimSuffix(allowedOrigin, "/"), origin) {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %s is not allowed", origin)
+}
@@ -0,0 +1,22 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// ReadConfig reads a single value, such as the central server URL, from a configuration file.
+func ReadConfig(configFile string) (string, error) {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	url := string(bytes.TrimSpace(data))
+	if url == "" {
+		return "", fmt.Errorf("config file is empty")
+	}
+
+	return url, nil
+}
@@ -0,0 +1,23 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// ReadJSON decodes a JSON configuration file into v, leaving v untouched if the file doesn't exist.
+func ReadJSON(configFile string, v interface{}) error {
+	data, err := os.ReadFile(configFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", configFile, err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package load
+
+import (
+	"chatserver/internal/chat"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Report is a snapshot of how busy the chat server is, sent to Central with every heartbeat
+type Report struct {
+	chat.Stats
+	CPUPercent  float64 `json:"cpuPercent"`  // Share of one core used since the previous report
+	MemoryBytes uint64  `json:"memoryBytes"` // Memory obtained from the OS by the process
+}
+
+// Collector combines the chat manager's figures with the process' own usage
+type Collector struct {
+	manager  *chat.ChatManager
+	lastCPU  time.Duration
+	lastTime time.Time
+	mu       sync.Mutex
+}
+
+// NewCollector creates a new Collector for the given chat manager
+func NewCollector(manager *chat.ChatManager) *Collector {
+	return &Collector{
+		manager:  manager,
+		lastCPU:  processCPUTime(),
+		lastTime: time.Now(),
+	}
+}
+
+// Collect takes a new load report
+func (c *Collector) Collect() Report {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	return Report{
+		Stats:       c.manager.Stats(),
+		CPUPercent:  c.cpuPercent(),
+		MemoryBytes: memStats.Sys,
+	}
+}
+
+// cpuPercent returns the CPU used by the process since the previous call
+func (c *Collector) cpuPercent() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	cpu := processCPUTime()
+	elapsed := now.Sub(c.lastTime)
+	used := cpu - c.lastCPU
+	c.lastCPU, c.lastTime = cpu, now
+
+	if elapsed <= 0 {
+		return 0
+	}
+	return 100 * used.Seconds() / elapsed.Seconds()
+}
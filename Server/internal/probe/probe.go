@@ -0,0 +1,68 @@
+/*
+Package probe answers the latency probes of clients over UDP, which is cheaper and less
+noisy than timing a TCP handshake.
+
+A probe is a single datagram of PacketSize bytes, all integers big endian:
+
+	0   magic "CPRB"
+	4   sequence number, chosen by the client
+	8   client send time, echoed back untouched
+	16  server receive time, Unix nanoseconds, zero in requests
+	24  server send time, Unix nanoseconds, zero in requests
+
+The server answers with the same packet, its two timestamps filled in. Requests must be
+as large as the answer, so the responder can't be used to amplify traffic.
+*/
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// PacketSize is the size of probes and their answers
+const PacketSize = 32
+
+var magic = []byte("CPRB")
+
+// Responder answers probes on a UDP port
+type Responder struct {
+	Port string
+}
+
+// NewResponder creates a responder listening on port
+func NewResponder(port string) *Responder {
+	return &Responder{Port: port}
+}
+
+// Start answers probes until the process exits
+func (r *Responder) Start() {
+	conn, err := net.ListenPacket("udp", r.Port)
+	if err != nil {
+		fmt.Printf("Error starting probe responder, clients fall back to TCP: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	fmt.Printf("Probe responder listening on udp port %s...\n", r.Port)
+
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			fmt.Printf("Error reading probe: %v\n", err)
+			continue
+		}
+		received := time.Now()
+		if n != PacketSize || !bytes.Equal(buf[:4], magic) {
+			continue
+		}
+
+		binary.BigEndian.PutUint64(buf[16:24], uint64(received.UnixNano()))
+		binary.BigEndian.PutUint64(buf[24:32], uint64(time.Now().UnixNano()))
+		conn.WriteTo(buf[:PacketSize], addr)
+	}
+}
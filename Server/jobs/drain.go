@@ -0,0 +1,86 @@
+package jobs
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RoomCounter reports how many rooms still have members on this server.
+type RoomCounter interface {
+	RoomCount() int
+}
+
+// DrainJob takes the server out of rotation and waits for its rooms to move elsewhere.
+type DrainJob struct {
+	heartbeat *HeartbeatJob
+	rooms     RoomCounter
+	deadline  time.Duration
+	once      sync.Once
+	done      chan struct{}
+}
+
+// NewDrainJob creates a new DrainJob which gives up waiting on the rooms after deadline.
+func NewDrainJob(heartbeat *HeartbeatJob, rooms RoomCounter, deadline time.Duration) *DrainJob {
+	return &DrainJob{
+		heartbeat: heartbeat,
+		rooms:     rooms,
+		deadline:  deadline,
+		done:      make(chan struct{}),
+	}
+}
+
+// Start begins draining in a goroutine, calling it again has no effect.
+func (d *DrainJob) Start() {
+	d.once.Do(func() {
+		go d.drain()
+	})
+}
+
+// Done is closed once the rooms are empty or the deadline passed.
+func (d *DrainJob) Done() <-chan struct{} {
+	return d.done
+}
+
+func (d *DrainJob) drain() {
+	defer close(d.done)
+	log.Printf("Draining server, waiting up to %s for %d rooms to move", d.deadline, d.rooms.RoomCount())
+
+	// Stop new rooms from being assigned here, then ask Central to move the current ones
+	d.heartbeat.SetDraining(true)
+	d.requestMigration()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	timeout := time.After(d.deadline)
+	for {
+		select {
+		case <-ticker.C:
+			if d.rooms.RoomCount() == 0 {
+				log.Printf("All rooms moved, drain complete")
+				d.heartbeat.Stop()
+				return
+			}
+		case <-timeout:
+			log.Printf("Drain deadline passed with %d rooms left", d.rooms.RoomCount())
+			d.heartbeat.Stop()
+			return
+		}
+	}
+}
+
+// requestMigration asks Central to reroute the rooms hosted on this server.
+func (d *DrainJob) requestMigration() {
+	resp, err := http.Post(d.heartbeat.serverURL+"/services/drain", "application/json", bytes.NewBuffer(nil))
+	if err != nil {
+		log.Printf("Failed to request room migration: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Failed to request room migration. Server responded with: %s", resp.Status)
+	}
+}
@@ -2,10 +2,14 @@ package jobs
 
 import (
 	"bytes"
+	"chatserver/internal/chat"
+	"chatserver/internal/config"
+	"chatserver/internal/load"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
+	"sync"
 	"time"
 )
 
@@ -14,26 +18,17 @@ type HeartbeatJob struct {
 	serverURL  string
 	interval   time.Duration
 	registered bool // Tracks whether the service is registered
-}
-
-// readConfig reads the central server URL from a configuration file.
-func readConfig(configFile string) (string, error) {
-	data, err := os.ReadFile(configFile)
-	if err != nil {
-		return "", fmt.Errorf("failed to read config file: %w", err)
-	}
-
-	url := string(bytes.TrimSpace(data))
-	if url == "" {
-		return "", fmt.Errorf("config file is empty")
-	}
-
-	return url, nil
+	draining   bool // Tracks whether the server is draining, reported with every heartbeat
+	relay      bool // Reported so Central only splits rooms across servers which relay
+	load       *load.Collector
+	capacity   *chat.CapacitySettings // Reported so Central never places rooms we would refuse
+	stop       chan struct{}
+	mu         sync.Mutex
 }
 
 // NewHeartbeatJob creates a new HeartbeatJob instance.
 func NewHeartbeatJob(interval time.Duration) (*HeartbeatJob, error) {
-	url, err := readConfig("config.txt") // Assuming the config file is in the parent directory
+	url, err := config.ReadConfig("config.txt") // Assuming the config file is in the parent directory
 	if err != nil {
 		return nil, fmt.Errorf("error reading config: %w", err)
 	}
@@ -41,6 +36,7 @@ func NewHeartbeatJob(interval time.Duration) (*HeartbeatJob, error) {
 		serverURL:  url,
 		interval:   interval,
 		registered: false,
+		stop:       make(chan struct{}),
 	}, nil
 }
 
@@ -51,11 +47,14 @@ func (h *HeartbeatJob) Start() {
 		for {
 			select {
 			case <-ticker.C:
-				if !h.registered {
+				if !h.Registered() {
 					h.registerService()
 				} else {
 					h.sendHeartbeat()
 				}
+			case <-h.stop:
+				ticker.Stop()
+				return
 			}
 		}
 	}()
@@ -71,20 +70,99 @@ func (h *HeartbeatJob) registerService() {
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusCreated {
+		h.mu.Lock()
 		h.registered = true
+		h.mu.Unlock()
 		log.Printf("Service successfully registered. Server responded with: %s", resp.Status)
 	} else {
 		log.Printf("Failed to register service. Server responded with: %s", resp.Status)
 	}
 }
 
+// SetLoadCollector makes every heartbeat carry a load report from the collector.
+func (h *HeartbeatJob) SetLoadCollector(collector *load.Collector) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.load = collector
+}
+
+// SetCapacity makes every heartbeat carry the caps the server enforces.
+func (h *HeartbeatJob) SetCapacity(capacity chat.CapacitySettings) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.capacity = &capacity
+}
+
+// SetRelay makes every heartbeat tell whether the server relays rooms with other chat servers.
+func (h *HeartbeatJob) SetRelay(enabled bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.relay = enabled
+}
+
+// Registered reports whether Central has accepted the service.
+func (h *HeartbeatJob) Registered() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.registered
+}
+
+// Draining reports whether the server is draining.
+func (h *HeartbeatJob) Draining() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.draining
+}
+
+// SetDraining marks the server as draining and reports it to Central right away.
+func (h *HeartbeatJob) SetDraining(draining bool) {
+	h.mu.Lock()
+	h.draining = draining
+	h.mu.Unlock()
+	h.sendHeartbeat()
+}
+
+// Stop ends the heartbeat and removes the service from Central.
+func (h *HeartbeatJob) Stop() {
+	close(h.stop)
+
+	req, err := http.NewRequest(http.MethodDelete, h.serverURL+"/services", nil)
+	if err != nil {
+		log.Printf("Failed to create deregister request: %v", err)
+		return
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Failed to deregister service: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+}
+
 // sendHeartbeat sends a PATCH request to the server to indicate the service is alive.
 func (h *HeartbeatJob) sendHeartbeat() {
-	req, err := http.NewRequest(http.MethodPatch, h.serverURL+"/services", nil) // Assuming no payload for now
+	h.mu.Lock()
+	heartbeat := map[string]interface{}{"draining": h.draining, "relay": h.relay}
+	if h.load != nil {
+		heartbeat["load"] = h.load.Collect()
+	}
+	if h.capacity != nil {
+		heartbeat["capacity"] = h.capacity
+	}
+	h.mu.Unlock()
+	payload, err := json.Marshal(heartbeat)
+	if err != nil {
+		log.Printf("Failed to serialize heartbeat: %v", err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPatch, h.serverURL+"/services", bytes.NewBuffer(payload))
 	if err != nil {
 		log.Printf("Failed to create heartbeat request: %v", err)
 		return
 	}
+	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {